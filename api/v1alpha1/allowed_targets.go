@@ -0,0 +1,56 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// allowedTargets are the kinds that can be patched, all kinds when empty
+	allowedTargets     = []KindSelector{}
+	allowedTargetsLock sync.RWMutex
+)
+
+// SetAllowedTargets restricts the kinds that can be patched, an empty list allows all kinds
+func SetAllowedTargets(targets []KindSelector) {
+	allowedTargetsLock.Lock()
+	defer allowedTargetsLock.Unlock()
+	allowedTargets = append([]KindSelector{}, targets...)
+}
+
+// IsAllowedTarget returns whether the kind can be patched
+func IsAllowedTarget(gvk schema.GroupVersionKind) bool {
+	allowedTargetsLock.RLock()
+	defer allowedTargetsLock.RUnlock()
+	if len(allowedTargets) == 0 {
+		return true
+	}
+	for _, target := range allowedTargets {
+		if target.Matches(gvk) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns whether the kind is selected
+func (s *KindSelector) Matches(gvk schema.GroupVersionKind) bool {
+	return s.Group == gvk.Group && s.Kind == gvk.Kind && (s.Version == "" || s.Version == gvk.Version)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceAccountReference references a service account in a given namespace
+type ServiceAccountReference struct {
+	// Name of the service account
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Namespace of the service account
+	// +kubebuilder:validation:Required
+	Namespace string `json:"namespace"`
+}
+
+// ClusterPatchSpec defines the desired state of ClusterPatch
+type ClusterPatchSpec struct {
+	// Patches is a list of patches that should be enforced at runtime.
+	// +kubebuilder:validation:Required
+	Patches map[string]PatchDefinition `json:"patches,omitempty"`
+
+	// ServiceAccountRef is the service account to be used to run the controllers associated with this configuration
+	// +kubebuilder:validation:Required
+	ServiceAccountRef ServiceAccountReference `json:"serviceAccountRef"`
+
+	// DryRun, when true, prevents the patches from being enforced. Instead, for each target, the rendered patch and the changes it would cause are computed and written to the ConfigMap referenced by .status.previewConfigMapRef, in the namespace of the service account
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=false
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// ClusterPatch is the Schema for the clusterpatches API
+type ClusterPatch struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterPatchSpec `json:"spec,omitempty"`
+	Status PatchStatus      `json:"status,omitempty"`
+}
+
+// GetPatches returns the patches defined by the ClusterPatch
+func (r *ClusterPatch) GetPatches() map[string]PatchDefinition {
+	return r.Spec.Patches
+}
+
+// GetServiceAccountName returns the name of the service account used to enforce the patches
+func (r *ClusterPatch) GetServiceAccountName() string {
+	return r.Spec.ServiceAccountRef.Name
+}
+
+// GetServiceAccountNamespace returns the namespace of the service account used to enforce the patches
+func (r *ClusterPatch) GetServiceAccountNamespace() string {
+	return r.Spec.ServiceAccountRef.Namespace
+}
+
+// IsDryRun returns whether the patches should only be previewed
+func (r *ClusterPatch) IsDryRun() bool {
+	return r.Spec.DryRun
+}
+
+// GetPatchStatus returns the status of the ClusterPatch
+func (r *ClusterPatch) GetPatchStatus() *PatchStatus {
+	return &r.Status
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterPatchList contains a list of ClusterPatch
+type ClusterPatchList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterPatch `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterPatch{}, &ClusterPatchList{})
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+	"reflect"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var clusterpatchlog = logf.Log.WithName("clusterpatch-resource")
+
+func (r *ClusterPatch) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookRestConfig = mgr.GetConfig()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-redhatcop-redhat-io-v1alpha1-clusterpatch,mutating=true,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=clusterpatches,verbs=create;update,versions=v1alpha1,name=mclusterpatch.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Defaulter = &ClusterPatch{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *ClusterPatch) Default() {
+	clusterpatchlog.Info("default", "name", r.Name)
+	if !controllerutil.ContainsFinalizer(r, PatchControllerFinalizerName) {
+		controllerutil.AddFinalizer(r, PatchControllerFinalizerName)
+	}
+	defaults := GetPatchDefaults()
+	defaultPatchDefinitions(r.Spec.Patches, &defaults)
+}
+
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-clusterpatch,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=clusterpatches,verbs=create;update,versions=v1alpha1,name=vclusterpatch.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &ClusterPatch{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatch) ValidateCreate() error {
+	clusterpatchlog.Info("validate create", "name", r.Name)
+
+	return r.validatePatches()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatch) ValidateUpdate(old runtime.Object) error {
+	clusterpatchlog.Info("validate update", "name", r.Name)
+
+	oldClusterPatch := old.(*ClusterPatch)
+	if !reflect.DeepEqual(r.Spec.ServiceAccountRef, oldClusterPatch.Spec.ServiceAccountRef) {
+		return errors.New(".spec.serviceAccountRef is immutable after creation, it cannot be changed from " + oldClusterPatch.Spec.ServiceAccountRef.Namespace + "/" + oldClusterPatch.Spec.ServiceAccountRef.Name + " to " + r.Spec.ServiceAccountRef.Namespace + "/" + r.Spec.ServiceAccountRef.Name)
+	}
+	// the patches are only validated again when they change, so that the ClusterPatch can still be updated, and its finalizer removed, once its targets are no longer defined or allowed
+	if r.GetDeletionTimestamp() != nil || reflect.DeepEqual(r.Spec.Patches, oldClusterPatch.Spec.Patches) {
+		return nil
+	}
+	return r.validatePatches()
+}
+
+// validatePatches verifies that the patches can be processed at runtime, so that errors are reported at admission time instead of reconcile time
+func (r *ClusterPatch) validatePatches() error {
+	allErrs := validatePatchDefinitions(r.Spec.Patches, field.NewPath("spec", "patches"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("ClusterPatch").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatch) ValidateDelete() error {
+	clusterpatchlog.Info("validate delete", "name", r.Name)
+
+	return nil
+}
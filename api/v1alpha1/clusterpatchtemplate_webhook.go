@@ -0,0 +1,69 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var clusterpatchtemplatelog = logf.Log.WithName("clusterpatchtemplate-resource")
+
+func (r *ClusterPatchTemplate) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookRestConfig = mgr.GetConfig()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-clusterpatchtemplate,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=clusterpatchtemplates,verbs=create;update,versions=v1alpha1,name=vclusterpatchtemplate.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &ClusterPatchTemplate{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatchTemplate) ValidateCreate() error {
+	clusterpatchtemplatelog.Info("validate create", "name", r.Name)
+
+	return r.validateTemplate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatchTemplate) ValidateUpdate(old runtime.Object) error {
+	clusterpatchtemplatelog.Info("validate update", "name", r.Name)
+
+	return r.validateTemplate()
+}
+
+func (r *ClusterPatchTemplate) validateTemplate() error {
+	allErrs := validatePatchTemplateSpec(&r.Spec, field.NewPath("spec"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("ClusterPatchTemplate").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ClusterPatchTemplate) ValidateDelete() error {
+	clusterpatchtemplatelog.Info("validate delete", "name", r.Name)
+
+	return nil
+}
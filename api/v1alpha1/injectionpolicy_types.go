@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// InjectionOperation is an admission operation on which a patch can be injected
+// +kubebuilder:validation:Enum=CREATE;UPDATE
+type InjectionOperation string
+
+const (
+	// CreateInjectionOperation injects the patch when the object is created
+	CreateInjectionOperation InjectionOperation = "CREATE"
+	// UpdateInjectionOperation injects the patch when the object is updated
+	UpdateInjectionOperation InjectionOperation = "UPDATE"
+)
+
+// KindSelector selects the objects of a kind
+type KindSelector struct {
+	// Group of the kind, empty for the core group
+	// +kubebuilder:validation:Optional
+	Group string `json:"group,omitempty"`
+
+	// Version of the kind, when empty all of the versions are selected
+	// +kubebuilder:validation:Optional
+	Version string `json:"version,omitempty"`
+
+	// Kind of the objects
+	// +kubebuilder:validation:Required
+	Kind string `json:"kind"`
+}
+
+// InjectionPolicyMatch selects the admission requests on which the patch is injected
+type InjectionPolicyMatch struct {
+	// Kinds are the kinds of the selected objects
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Kinds []KindSelector `json:"kinds"`
+
+	// NamespaceSelector selects the objects by the labels of their namespace. Namespaces are selected by their own labels, other cluster-scoped objects are always selected.
+	// When not set, the objects of all of the namespaces are selected.
+	// +kubebuilder:validation:Optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ObjectSelector selects the objects by their labels. When not set, all of the objects are selected.
+	// +kubebuilder:validation:Optional
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+
+	// Operations are the admission operations on which the patch is injected
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default={"CREATE"}
+	// +listType=set
+	Operations []InjectionOperation `json:"operations,omitempty"`
+}
+
+// InjectionPolicySpec defines the desired state of InjectionPolicy
+type InjectionPolicySpec struct {
+	// Match selects the admission requests on which the patch is injected
+	// +kubebuilder:validation:Required
+	Match InjectionPolicyMatch `json:"match"`
+
+	// Template is a go template that is rendered against the object being admitted, like the template of the redhat-cop.redhat.io/patch annotation
+	// +kubebuilder:validation:Required
+	Template string `json:"template"`
+
+	// PatchType is the type of patch to be applied, one of "application/json-patch+json","application/merge-patch+json","application/strategic-merge-patch+json"
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum="application/json-patch+json";"application/merge-patch+json";"application/strategic-merge-patch+json"
+	// +kubebuilder:default="application/strategic-merge-patch+json"
+	PatchType types.PatchType `json:"patchType,omitempty"`
+
+	// Priority determines the order in which the patches of the policies matching an object are applied, lower priorities first. Policies with the same priority are applied by name.
+	// The patches of the policies are applied before the patches defined by the annotations of the object.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=0
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// GetOperations returns the operations on which the patch is injected, or the default ones
+func (r *InjectionPolicySpec) GetOperations() []InjectionOperation {
+	if len(r.Match.Operations) == 0 {
+		return []InjectionOperation{CreateInjectionOperation}
+	}
+	return r.Match.Operations
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// InjectionPolicy is the Schema for the injectionpolicies API
+type InjectionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec InjectionPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// InjectionPolicyList contains a list of InjectionPolicy
+type InjectionPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InjectionPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InjectionPolicy{}, &InjectionPolicyList{})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"text/template"
+
+	utilstemplate "github.com/redhat-cop/operator-utils/pkg/util/templates"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var injectionpolicylog = logf.Log.WithName("injectionpolicy-resource")
+
+func (r *InjectionPolicy) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookRestConfig = mgr.GetConfig()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-injectionpolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=injectionpolicies,verbs=create;update,versions=v1alpha1,name=vinjectionpolicy.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &InjectionPolicy{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *InjectionPolicy) ValidateCreate() error {
+	injectionpolicylog.Info("validate create", "name", r.Name)
+
+	return r.validatePolicy()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *InjectionPolicy) ValidateUpdate(old runtime.Object) error {
+	injectionpolicylog.Info("validate update", "name", r.Name)
+
+	return r.validatePolicy()
+}
+
+// validatePolicy verifies that the template can be parsed and the selectors are valid, so that errors are reported at admission time instead of when objects are admitted
+func (r *InjectionPolicy) validatePolicy() error {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+	funcMap := utilstemplate.AdvancedTemplateFuncMap(webhookRestConfig, injectionpolicylog)
+	if _, err := template.New(r.Spec.Template).Funcs(funcMap).Parse(r.Spec.Template); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("template"), r.Spec.Template, "unable to parse template: "+err.Error()))
+	}
+	matchPath := specPath.Child("match")
+	if _, err := metav1.LabelSelectorAsSelector(r.Spec.Match.NamespaceSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(matchPath.Child("namespaceSelector"), r.Spec.Match.NamespaceSelector, err.Error()))
+	}
+	if _, err := metav1.LabelSelectorAsSelector(r.Spec.Match.ObjectSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(matchPath.Child("objectSelector"), r.Spec.Match.ObjectSelector, err.Error()))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("InjectionPolicy").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *InjectionPolicy) ValidateDelete() error {
+	injectionpolicylog.Info("validate delete", "name", r.Name)
+
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InjectLabel is the label that, by default, selects the objects whose admission requests are sent to the managed injection webhooks.
+// Webhooks can only select objects by label, so objects using the patch annotations must carry this label too.
+const InjectLabel = "redhat-cop.redhat.io/inject"
+
+// InjectionWebhookRule selects the admission requests sent to the injection webhook
+type InjectionWebhookRule struct {
+	// APIGroups are the api groups of the resources, "" is the core group and "*" all of the groups
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	APIGroups []string `json:"apiGroups"`
+
+	// APIVersions are the versions of the resources, "*" is all of the versions
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	APIVersions []string `json:"apiVersions"`
+
+	// Resources are the plural names of the resources, "*" is all of the resources
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Resources []string `json:"resources"`
+
+	// Operations are the admission operations sent to the webhook
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default={"CREATE"}
+	// +listType=set
+	Operations []InjectionOperation `json:"operations,omitempty"`
+}
+
+// GetOperations returns the operations sent to the webhook, or the default ones
+func (r *InjectionWebhookRule) GetOperations() []InjectionOperation {
+	if len(r.Operations) == 0 {
+		return []InjectionOperation{CreateInjectionOperation}
+	}
+	return r.Operations
+}
+
+// InjectionWebhookSpec defines the desired state of InjectionWebhook
+type InjectionWebhookSpec struct {
+	// Rules select the admission requests sent to the injection webhook
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Rules []InjectionWebhookRule `json:"rules"`
+
+	// ObjectSelector selects the objects whose admission requests are sent to the injection webhook. Defaults to the objects with the redhat-cop.redhat.io/inject label.
+	// Set it to {} to select all of the objects, for example when injection policies target objects that don't carry the label.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default={"matchExpressions": {{"key": "redhat-cop.redhat.io/inject", "operator": "Exists"}}}
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+
+	// NamespaceSelector selects the namespaces whose objects are sent to the injection webhook. When not set, all of the namespaces are selected.
+	// The namespace of the operator and the kube-system, kube-public and kube-node-lease namespaces are always excluded.
+	// +kubebuilder:validation:Optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// FailurePolicy determines what happens to the admission requests when the injection webhook is unavailable
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Fail;Ignore
+	// +kubebuilder:default=Fail
+	FailurePolicy *admissionregistrationv1.FailurePolicyType `json:"failurePolicy,omitempty"`
+
+	// TimeoutSeconds is the timeout of the calls to the injection webhook, between 1 and 30 seconds
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=30
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+}
+
+// InjectionWebhookStatus defines the observed state of InjectionWebhook
+type InjectionWebhookStatus struct {
+	// ReconcileStatus this is the general status of the main reconciler
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// MutatingWebhookConfigurationName is the name of the MutatingWebhookConfiguration managed for this object
+	// +kubebuilder:validation:Optional
+	MutatingWebhookConfigurationName string `json:"mutatingWebhookConfigurationName,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// InjectionWebhook is the Schema for the injectionwebhooks API.
+// The operator manages a MutatingWebhookConfiguration that sends the selected admission requests to its creation time injection endpoint.
+type InjectionWebhook struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   InjectionWebhookSpec   `json:"spec,omitempty"`
+	Status InjectionWebhookStatus `json:"status,omitempty"`
+}
+
+// GetConditions returns the conditions of the InjectionWebhook
+func (r *InjectionWebhook) GetConditions() []metav1.Condition {
+	return r.Status.Conditions
+}
+
+// SetConditions sets the conditions of the InjectionWebhook
+func (r *InjectionWebhook) SetConditions(conditions []metav1.Condition) {
+	r.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// InjectionWebhookList contains a list of InjectionWebhook
+type InjectionWebhookList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []InjectionWebhook `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&InjectionWebhook{}, &InjectionWebhookList{})
+}
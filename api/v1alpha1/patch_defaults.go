@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultServiceAccountName is the service account of the Patches that don't reference one, when the operator doesn't configure a different default
+const DefaultServiceAccountName = "default"
+
+// PatchDefaults are the operator-level defaults that the defaulting webhooks materialize in the Patches and ClusterPatches
+// +kubebuilder:object:generate:=false
+type PatchDefaults struct {
+	// PatchType is the type of the patches that don't define one
+	PatchType types.PatchType
+	// ServiceAccountName is the service account of the Patches that don't reference one
+	ServiceAccountName string
+	// NamespaceServiceAccountNames overrides ServiceAccountName for the Patches of the given namespaces
+	NamespaceServiceAccountNames map[string]string
+}
+
+var (
+	patchDefaults = PatchDefaults{
+		PatchType:          types.StrategicMergePatchType,
+		ServiceAccountName: DefaultServiceAccountName,
+	}
+	patchDefaultsLock sync.RWMutex
+)
+
+// SetPatchDefaults sets the defaults used by the defaulting webhooks, invalid defaults are rejected
+func SetPatchDefaults(defaults PatchDefaults) error {
+	if err := defaults.Validate(); err != nil {
+		return err
+	}
+	patchDefaultsLock.Lock()
+	defer patchDefaultsLock.Unlock()
+	patchDefaults = defaults
+	return nil
+}
+
+// GetPatchDefaults returns the defaults used by the defaulting webhooks
+func GetPatchDefaults() PatchDefaults {
+	patchDefaultsLock.RLock()
+	defer patchDefaultsLock.RUnlock()
+	return patchDefaults
+}
+
+// Validate checks that the patch type is supported and that the service accounts are valid names
+func (d *PatchDefaults) Validate() error {
+	if !isSupportedPatchType(d.PatchType) {
+		return errors.New("unsupported default patch type " + string(d.PatchType))
+	}
+	if errs := validation.IsDNS1123Subdomain(d.ServiceAccountName); len(errs) > 0 {
+		return errors.New("invalid default service account " + d.ServiceAccountName + ": " + errs[0])
+	}
+	for namespace, serviceAccountName := range d.NamespaceServiceAccountNames {
+		if errs := validation.IsDNS1123Subdomain(serviceAccountName); len(errs) > 0 {
+			return errors.New("invalid default service account " + serviceAccountName + " of namespace " + namespace + ": " + errs[0])
+		}
+	}
+	return nil
+}
+
+// GetServiceAccountName returns the default service account of the Patches of the namespace
+func (d *PatchDefaults) GetServiceAccountName(namespace string) string {
+	if serviceAccountName, ok := d.NamespaceServiceAccountNames[namespace]; ok {
+		return serviceAccountName
+	}
+	return d.ServiceAccountName
+}
+
+// defaultPatchDefinitions sets the default patch type on the patches that don't define one
+func defaultPatchDefinitions(patches map[string]PatchDefinition, defaults *PatchDefaults) {
+	for patchName, patch := range patches {
+		if patch.PatchType == "" {
+			patch.PatchType = defaults.PatchType
+			patches[patchName] = patch
+		}
+	}
+}
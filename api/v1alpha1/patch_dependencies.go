@@ -0,0 +1,81 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// SortPatchesByDependencies returns the names of the patches ordered so that every patch comes after the patches it depends on.
+// Dependencies on patches that are not defined are ignored. If the dependencies form a cycle an error describing it is returned.
+// The order is deterministic, patches that don't depend on each other are sorted by name.
+func SortPatchesByDependencies(patches map[string]PatchDefinition) ([]string, error) {
+	patchNames := []string{}
+	for patchName := range patches {
+		patchNames = append(patchNames, patchName)
+	}
+	sort.Strings(patchNames)
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	sorted := []string{}
+	// path holds the patches being visited, it is used to describe cycles
+	path := []string{}
+	var visit func(patchName string) error
+	visit = func(patchName string) error {
+		switch state[patchName] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := []string{}
+			for i := range path {
+				if path[i] == patchName {
+					cycle = append(cycle, path[i:]...)
+					break
+				}
+			}
+			return errors.New("dependency cycle: " + strings.Join(append(cycle, patchName), " -> "))
+		}
+		state[patchName] = visiting
+		path = append(path, patchName)
+		dependencies := append([]string{}, patches[patchName].DependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if _, ok := patches[dependency]; !ok {
+				continue
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[patchName] = visited
+		sorted = append(sorted, patchName)
+		return nil
+	}
+	for _, patchName := range patchNames {
+		if err := visit(patchName); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
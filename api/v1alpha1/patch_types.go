@@ -17,9 +17,13 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"time"
+
 	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const PatchControllerFinalizerName = "patch-controller"
@@ -34,12 +38,244 @@ type PatchSpec struct {
 
 	// Patches is a list of patches that should be enforced at runtime.
 	// +kubebuilder:validation:Required
-	Patches map[string]utilsv1alpha1.PatchSpec `json:"patches,omitempty"`
+	Patches map[string]PatchDefinition `json:"patches,omitempty"`
 
-	// ServiceAccountRef is the service account to be used to run the controllers associated with this configuration
-	// +kubebuilder:validation:Required
-	// +kubebuilder:default={"name": "default"}
+	// ServiceAccountRef is the service account to be used to run the controllers associated with this configuration.
+	// When not set, the defaulting webhook sets the default service account configured in the operator for the namespace, which is "default" unless configured otherwise.
+	// +kubebuilder:validation:Optional
 	ServiceAccountRef corev1.LocalObjectReference `json:"serviceAccountRef,omitempty"`
+
+	// DryRun, when true, prevents the patches from being enforced. Instead, for each target, the rendered patch and the changes it would cause are computed and written to the ConfigMap referenced by .status.previewConfigMapRef
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=false
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// DeletionPolicy determines what happens to the targets of a patch when the Patch is deleted
+type DeletionPolicy string
+
+const (
+	// RetainDeletionPolicy leaves the targets as they are
+	RetainDeletionPolicy DeletionPolicy = "Retain"
+	// RevertDeletionPolicy restores the values the targets had before the patch was applied
+	RevertDeletionPolicy DeletionPolicy = "Revert"
+)
+
+// PatchDefinition describes a patch to be enforced at runtime and how it should be managed
+type PatchDefinition struct {
+	utilsv1alpha1.PatchSpec `json:",inline"`
+
+	// DeletionPolicy determines what happens to the targets when the Patch is deleted.
+	// Retain leaves the targets as they are, Revert restores the values of the fields touched by the patch to what they were before the patch was first applied.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Retain;Revert
+	// +kubebuilder:default=Retain
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// DependsOn lists the names of the patches, defined in the same object, that must be successfully applied before this patch is enforced.
+	// Until then the patch is reported in .status.blockedPatches.
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// DriftPolicy determines how repeated reapplications of the patch to the same target, caused by other actors reverting it, are handled.
+	// When not set, drift is reported with the default window and threshold.
+	// +kubebuilder:validation:Optional
+	DriftPolicy *DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// FieldManager is the name of the field manager owning the fields set by the patch when the patch type is application/apply-patch+yaml. Defaults to patch-operator.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:MaxLength=128
+	FieldManager string `json:"fieldManager,omitempty"`
+
+	// Force, when the patch type is application/apply-patch+yaml, makes the patch take ownership of the fields currently owned by other field managers instead of failing with a conflict.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=false
+	Force bool `json:"force,omitempty"`
+}
+
+// DefaultFieldManager is the field manager of the changes made by the patch operator
+const DefaultFieldManager = "patch-operator"
+
+// GetFieldManager returns the field manager of the fields set by the patch
+func (pd *PatchDefinition) GetFieldManager() string {
+	if pd.PatchType == types.ApplyPatchType && pd.FieldManager != "" {
+		return pd.FieldManager
+	}
+	return DefaultFieldManager
+}
+
+// DriftAction is the action taken when a patch keeps being reverted on a target
+type DriftAction string
+
+const (
+	// WarnDriftAction reports the drift in status, metrics and events
+	WarnDriftAction DriftAction = "Warn"
+	// SuspendDriftAction reports the drift and suspends the enforcement of the patch
+	SuspendDriftAction DriftAction = "Suspend"
+)
+
+const (
+	// DefaultDriftWindow is the default period over which reapplications are counted
+	DefaultDriftWindow = 10 * time.Minute
+	// DefaultDriftThreshold is the default number of reapplications within the window after which a target is considered contended
+	DefaultDriftThreshold = 5
+)
+
+// DriftPolicy determines how repeated reapplications of a patch are handled
+type DriftPolicy struct {
+	// Window is the period over which the reapplications of the patch to a target are counted
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default="10m"
+	Window *metav1.Duration `json:"window,omitempty"`
+
+	// Threshold is the number of reapplications to the same target within the window after which the target is considered contended
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=5
+	Threshold int `json:"threshold,omitempty"`
+
+	// Action is taken when the threshold is reached on a target. Warn emits a Warning event, Suspend also stops enforcing the patch on all of its targets.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Warn;Suspend
+	// +kubebuilder:default=Warn
+	Action DriftAction `json:"action,omitempty"`
+
+	// SuspensionDuration is how long the enforcement is suspended when the action is Suspend, after which it is resumed. When not set, the enforcement is suspended until the object is updated.
+	// +kubebuilder:validation:Optional
+	SuspensionDuration *metav1.Duration `json:"suspensionDuration,omitempty"`
+}
+
+// GetWindow returns the drift window, or the default one
+func (dp *DriftPolicy) GetWindow() time.Duration {
+	if dp == nil || dp.Window == nil || dp.Window.Duration <= 0 {
+		return DefaultDriftWindow
+	}
+	return dp.Window.Duration
+}
+
+// GetThreshold returns the drift threshold, or the default one
+func (dp *DriftPolicy) GetThreshold() int {
+	if dp == nil || dp.Threshold <= 0 {
+		return DefaultDriftThreshold
+	}
+	return dp.Threshold
+}
+
+// GetAction returns the drift action, or the default one
+func (dp *DriftPolicy) GetAction() DriftAction {
+	if dp == nil || dp.Action == "" {
+		return WarnDriftAction
+	}
+	return dp.Action
+}
+
+// PatchSuspension describes why and until when the enforcement of a patch is suspended
+type PatchSuspension struct {
+	// Reason describes why the enforcement was suspended
+	Reason string `json:"reason"`
+
+	// Since is the time at which the enforcement was suspended
+	Since metav1.Time `json:"since"`
+
+	// Until is the time at which the enforcement will be resumed, when not set the enforcement is resumed when the object is updated
+	// +kubebuilder:validation:Optional
+	Until *metav1.Time `json:"until,omitempty"`
+
+	// ObservedGeneration is the generation of the object when the enforcement was suspended
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// IsActive returns whether the enforcement is still suspended
+func (ps *PatchSuspension) IsActive(generation int64, now time.Time) bool {
+	if ps == nil {
+		return false
+	}
+	if ps.Until != nil {
+		return now.Before(ps.Until.Time)
+	}
+	return ps.ObservedGeneration == generation
+}
+
+// GetPatchSpecs returns the patches in the format expected by the enforcing reconciler
+func GetPatchSpecs(patches map[string]PatchDefinition) map[string]utilsv1alpha1.PatchSpec {
+	patchSpecs := map[string]utilsv1alpha1.PatchSpec{}
+	for key, patch := range patches {
+		patchSpecs[key] = patch.PatchSpec
+	}
+	return patchSpecs
+}
+
+// PatchObject is implemented by the kinds that define patches to be enforced at runtime, Patch and ClusterPatch
+// +kubebuilder:object:generate=false
+type PatchObject interface {
+	client.Object
+	GetPatches() map[string]PatchDefinition
+	GetServiceAccountName() string
+	GetServiceAccountNamespace() string
+	IsDryRun() bool
+	GetPatchStatus() *PatchStatus
+}
+
+// PatchTargetsStatus reports the enforcement status of a patch on the objects selected by its target reference
+type PatchTargetsStatus struct {
+	// Matched is the number of objects currently selected by the target reference
+	Matched int `json:"matched"`
+
+	// Applied is the number of targets on which the last application of the patch succeeded
+	Applied int `json:"applied"`
+
+	// Failed is the number of targets on which the last application of the patch failed
+	Failed int `json:"failed"`
+
+	// PatchHash is the hash of the current definition of the patch
+	// +kubebuilder:validation:Optional
+	PatchHash string `json:"patchHash,omitempty"`
+
+	// Targets contains the status of the individual targets, failed targets first. For very large selections the list is truncated, the counters always refer to all of the targets.
+	// +kubebuilder:validation:Optional
+	// +listType=atomic
+	Targets []PatchTargetStatus `json:"targets,omitempty"`
+
+	// Truncated is true when Targets does not list all of the matched targets
+	// +kubebuilder:validation:Optional
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Suspension is set when the enforcement of the patch has been suspended because of drift
+	// +kubebuilder:validation:Optional
+	Suspension *PatchSuspension `json:"suspension,omitempty"`
+}
+
+// PatchTargetStatus reports the enforcement status of a patch on a single target
+type PatchTargetStatus struct {
+	// +kubebuilder:validation:Optional
+	Namespace string `json:"namespace,omitempty"`
+
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:Optional
+	UID types.UID `json:"uid,omitempty"`
+
+	// LastAppliedTime is the last time the patch was successfully applied to this target
+	// +kubebuilder:validation:Optional
+	LastAppliedTime *metav1.Time `json:"lastAppliedTime,omitempty"`
+
+	// AppliedPatchHash is the hash of the definition of the patch that was last successfully applied to this target
+	// +kubebuilder:validation:Optional
+	AppliedPatchHash string `json:"appliedPatchHash,omitempty"`
+
+	// Error is the error of the last application of the patch, empty if it succeeded
+	// +kubebuilder:validation:Optional
+	Error string `json:"error,omitempty"`
+
+	// Reapplications is the number of times, within the drift window, the patch had to be applied again because the target was changed by another actor
+	// +kubebuilder:validation:Optional
+	Reapplications int `json:"reapplications,omitempty"`
+
+	// ConflictingFieldManager is the field manager that last changed the target before the patch was applied again
+	// +kubebuilder:validation:Optional
+	ConflictingFieldManager string `json:"conflictingFieldManager,omitempty"`
 }
 
 // PatchStatus defines the observed state of Patch
@@ -53,6 +289,27 @@ type PatchStatus struct {
 	//PatchStatuses contains the reconcile status for each of the managed patch
 	// +kubebuilder:validation:Optional
 	PatchStatuses map[string]utilsv1alpha1.ConditionMap `json:"patchStatuses,omitempty"`
+
+	// BlockedPatches contains the patches that are not enforced, with the reason, because the patches they depend on have not been successfully applied yet or because their enforcement has been suspended
+	// +kubebuilder:validation:Optional
+	BlockedPatches map[string]string `json:"blockedPatches,omitempty"`
+
+	// TargetStatuses contains, for each of the managed patches, the status of the individual targets
+	// +kubebuilder:validation:Optional
+	TargetStatuses map[string]PatchTargetsStatus `json:"targetStatuses,omitempty"`
+
+	// ServiceAccountTokenExpirationTimestamp is the time at which the service account token used by the enforcing controllers expires
+	// +kubebuilder:validation:Optional
+	ServiceAccountTokenExpirationTimestamp *metav1.Time `json:"serviceAccountTokenExpirationTimestamp,omitempty"`
+
+	// ServiceAccountTokenRotationTimestamp is the time at which the service account token will be renewed
+	// +kubebuilder:validation:Optional
+	ServiceAccountTokenRotationTimestamp *metav1.Time `json:"serviceAccountTokenRotationTimestamp,omitempty"`
+
+	// PreviewConfigMapRef references the ConfigMap containing the preview of the patches when .spec.dryRun is true.
+	// The ConfigMap is in the namespace of the service account.
+	// +kubebuilder:validation:Optional
+	PreviewConfigMapRef *corev1.LocalObjectReference `json:"previewConfigMapRef,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -67,6 +324,35 @@ type Patch struct {
 	Status PatchStatus `json:"status,omitempty"`
 }
 
+// GetPatches returns the patches defined by the Patch
+func (r *Patch) GetPatches() map[string]PatchDefinition {
+	return r.Spec.Patches
+}
+
+// GetServiceAccountName returns the name of the service account used to enforce the patches
+func (r *Patch) GetServiceAccountName() string {
+	// the service account is set by the defaulting webhook, unless webhooks are disabled
+	if r.Spec.ServiceAccountRef.Name == "" {
+		return DefaultServiceAccountName
+	}
+	return r.Spec.ServiceAccountRef.Name
+}
+
+// GetServiceAccountNamespace returns the namespace of the service account used to enforce the patches, which is always the namespace of the Patch
+func (r *Patch) GetServiceAccountNamespace() string {
+	return r.GetNamespace()
+}
+
+// IsDryRun returns whether the patches should only be previewed
+func (r *Patch) IsDryRun() bool {
+	return r.Spec.DryRun
+}
+
+// GetPatchStatus returns the status of the Patch
+func (r *Patch) GetPatchStatus() *PatchStatus {
+	return &r.Status
+}
+
 //+kubebuilder:object:root=true
 
 // PatchList contains a list of Patch
@@ -17,41 +17,114 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
 	"reflect"
+	"sort"
+	"text/template"
 
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/discoveryclient"
+	utilstemplate "github.com/redhat-cop/operator-utils/pkg/util/templates"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/jsonpath"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 // log is for logging in this package.
 var patchlog = logf.Log.WithName("patch-resource")
 
+// webhookRestConfig is used by the validating webhook to check the referenced types and to build the template function map
+var webhookRestConfig *rest.Config
+
+// supportedPatchTypes are the patch types that can be enforced at runtime
+var supportedPatchTypes = []types.PatchType{types.JSONPatchType, types.MergePatchType, types.StrategicMergePatchType, types.ApplyPatchType}
+
 func (r *Patch) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookRestConfig = mgr.GetConfig()
+	// registered before the builder, which then skips the defaulting webhook of webhook.Defaulter
+	mgr.GetWebhookServer().Register(patchDefaultingWebhookPath, &webhook.Admission{Handler: &patchDefaulter{}})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
 }
 
-//+kubebuilder:webhook:path=/mutate-redhatcop-redhat-io-v1alpha1-patch,mutating=true,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=patches,verbs=create,versions=v1alpha1,name=mpatch.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/mutate-redhatcop-redhat-io-v1alpha1-patch,mutating=true,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=patches,verbs=create;update,versions=v1alpha1,name=mpatch.kb.io,admissionReviewVersions=v1
+
+const patchDefaultingWebhookPath = "/mutate-redhatcop-redhat-io-v1alpha1-patch"
 
 var _ webhook.Defaulter = &Patch{}
 
-// Default implements webhook.Defaulter so a webhook will be registered for the type
+// Default implements webhook.Defaulter, it sets the defaults that don't depend on the operation.
+// The patch types are materialized from the defaults configured in the operator, so that the stored object shows what is enforced.
 func (r *Patch) Default() {
 	patchlog.Info("default", "name", r.Name)
 	if !controllerutil.ContainsFinalizer(r, PatchControllerFinalizerName) {
 		controllerutil.AddFinalizer(r, PatchControllerFinalizerName)
 	}
+	defaults := GetPatchDefaults()
+	defaultPatchDefinitions(r.Spec.Patches, &defaults)
+}
+
+// defaultServiceAccountRef materializes the default service account of the namespace when none is referenced
+func (r *Patch) defaultServiceAccountRef() {
+	if r.Spec.ServiceAccountRef.Name == "" {
+		defaults := GetPatchDefaults()
+		r.Spec.ServiceAccountRef.Name = defaults.GetServiceAccountName(r.Namespace)
+	}
+}
+
+// patchDefaulter is the defaulting webhook of the Patches. Unlike webhook.Defaulter it receives the admission request, because the service account is immutable:
+// it is defaulted on creation only, on updates that omit it the one of the stored object is kept, as the default may have changed since the creation.
+type patchDefaulter struct {
+	decoder *admission.Decoder
 }
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+var _ admission.DecoderInjector = &patchDefaulter{}
+
+func (d *patchDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+func (d *patchDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	patch := &Patch{}
+	if err := d.decoder.Decode(req, patch); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	switch req.Operation {
+	case admissionv1.Create:
+		patch.defaultServiceAccountRef()
+	case admissionv1.Update:
+		if patch.Spec.ServiceAccountRef.Name == "" {
+			old := &Patch{}
+			if err := d.decoder.DecodeRaw(req.OldObject, old); err != nil {
+				return admission.Errored(http.StatusBadRequest, err)
+			}
+			patch.Spec.ServiceAccountRef = old.Spec.ServiceAccountRef
+		}
+	}
+	patch.Default()
+	marshalled, err := json.Marshal(patch)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshalled)
+}
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-patch,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=patches,verbs=update,versions=v1alpha1,name=vpatch.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-patch,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=patches,verbs=create;update,versions=v1alpha1,name=vpatch.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &Patch{}
 
@@ -59,18 +132,153 @@ var _ webhook.Validator = &Patch{}
 func (r *Patch) ValidateCreate() error {
 	patchlog.Info("validate create", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil
+	return r.validatePatches()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *Patch) ValidateUpdate(old runtime.Object) error {
 	patchlog.Info("validate update", "name", r.Name)
 
-	if !reflect.DeepEqual(r.Spec.ServiceAccountRef, old.(*Patch).Spec.ServiceAccountRef) {
-		return errors.New(".spec.serviceAccountRef is immutable after creation")
+	oldPatch := old.(*Patch)
+	if !reflect.DeepEqual(r.Spec.ServiceAccountRef, oldPatch.Spec.ServiceAccountRef) {
+		return errors.New(".spec.serviceAccountRef is immutable after creation, it cannot be changed from " + oldPatch.Spec.ServiceAccountRef.Name + " to " + r.Spec.ServiceAccountRef.Name)
 	}
-	return nil
+	// the patches are only validated again when they change, so that the Patch can still be updated, and its finalizer removed, once its targets are no longer defined or allowed
+	if r.GetDeletionTimestamp() != nil || reflect.DeepEqual(r.Spec.Patches, oldPatch.Spec.Patches) {
+		return nil
+	}
+	return r.validatePatches()
+}
+
+// validatePatches verifies that the patches can be processed at runtime, so that errors are reported at admission time instead of reconcile time
+func (r *Patch) validatePatches() error {
+	allErrs := validatePatchDefinitions(r.Spec.Patches, field.NewPath("spec", "patches"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Patch").GroupKind(), r.Name, allErrs)
+}
+
+func validatePatchDefinitions(patches map[string]PatchDefinition, patchesPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	// sort the keys so that errors are always reported in the same order
+	patchNames := []string{}
+	for patchName := range patches {
+		patchNames = append(patchNames, patchName)
+	}
+	sort.Strings(patchNames)
+	for _, patchName := range patchNames {
+		allErrs = append(allErrs, validatePatchSpec(patches[patchName].PatchSpec, patchesPath.Key(patchName))...)
+		allErrs = append(allErrs, validateDependencies(patchName, patches, patchesPath.Key(patchName).Child("dependsOn"))...)
+		allErrs = append(allErrs, validateApplyOptions(patches[patchName], patchesPath.Key(patchName))...)
+	}
+	if _, err := SortPatchesByDependencies(patches); err != nil {
+		allErrs = append(allErrs, field.Forbidden(patchesPath, err.Error()))
+	}
+	return allErrs
+}
+
+// validateDependencies checks that a patch only depends on patches defined in the same object, cycles are detected separately
+func validateDependencies(patchName string, patches map[string]PatchDefinition, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, dependency := range patches[patchName].DependsOn {
+		if _, ok := patches[dependency]; !ok {
+			allErrs = append(allErrs, field.NotFound(path.Index(i), dependency))
+		}
+	}
+	return allErrs
+}
+
+// validateApplyOptions checks that the server-side apply options are only set on patches of type application/apply-patch+yaml
+func validateApplyOptions(patch PatchDefinition, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if patch.PatchType == types.ApplyPatchType {
+		return allErrs
+	}
+	if patch.FieldManager != "" {
+		allErrs = append(allErrs, field.Forbidden(path.Child("fieldManager"), "only supported with patch type "+string(types.ApplyPatchType)))
+	}
+	if patch.Force {
+		allErrs = append(allErrs, field.Forbidden(path.Child("force"), "only supported with patch type "+string(types.ApplyPatchType)))
+	}
+	return allErrs
+}
+
+func validatePatchSpec(patch utilsv1alpha1.PatchSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if patch.PatchType != "" && !isSupportedPatchType(patch.PatchType) {
+		allErrs = append(allErrs, field.NotSupported(path.Child("patchType"), patch.PatchType, patchTypesAsStrings(supportedPatchTypes)))
+	}
+	// the functions are only bound to the rest config when they are called, so templates are parsed with the same function names that the enforcing controllers use even without one
+	funcMap := utilstemplate.AdvancedTemplateFuncMap(webhookRestConfig, patchlog)
+	if _, err := template.New(patch.PatchTemplate).Funcs(funcMap).Parse(patch.PatchTemplate); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("patchTemplate"), patch.PatchTemplate, "unable to parse template: "+err.Error()))
+	}
+	targetPath := path.Child("targetObjectRef")
+	allErrs = append(allErrs, validateGVK(patch.TargetObjectRef.APIVersion, patch.TargetObjectRef.Kind, targetPath)...)
+	if patch.TargetObjectRef.APIVersion != "" && patch.TargetObjectRef.Kind != "" {
+		if gvk := schema.FromAPIVersionAndKind(patch.TargetObjectRef.APIVersion, patch.TargetObjectRef.Kind); !IsAllowedTarget(gvk) {
+			allErrs = append(allErrs, field.Forbidden(targetPath, "type "+gvk.String()+" is not an allowed target of the operator"))
+		}
+	}
+	for i, sourceObjectRef := range patch.SourceObjectRefs {
+		sourcePath := path.Child("sourceObjectRefs").Index(i)
+		allErrs = append(allErrs, validateGVK(sourceObjectRef.APIVersion, sourceObjectRef.Kind, sourcePath)...)
+		if sourceObjectRef.FieldPath != "" {
+			if err := jsonpath.New("fieldPath").Parse("{" + sourceObjectRef.FieldPath + "}"); err != nil {
+				allErrs = append(allErrs, field.Invalid(sourcePath.Child("fieldPath"), sourceObjectRef.FieldPath, "invalid jsonpath expression: "+err.Error()))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateGVK checks that the referenced type is known to the api server
+func validateGVK(apiVersion string, kind string, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if apiVersion == "" {
+		allErrs = append(allErrs, field.Required(path.Child("apiVersion"), ""))
+	}
+	if kind == "" {
+		allErrs = append(allErrs, field.Required(path.Child("kind"), ""))
+	}
+	if len(allErrs) > 0 || webhookRestConfig == nil {
+		return allErrs
+	}
+	gvk := schema.FromAPIVersionAndKind(apiVersion, kind)
+	ctx := context.WithValue(context.TODO(), "restConfig", webhookRestConfig)
+	ctx = logf.IntoContext(ctx, patchlog)
+	_, found, err := discoveryclient.GetAPIResourceForGVK(ctx, gvk)
+	if apierrors.IsServiceUnavailable(err) {
+		// the group version is served by an unavailable aggregated API, the patch is accepted and applied once the API is back
+		patchlog.Info("unable to verify type, its group version is unavailable", "GVK", gvk.String(), "error", err.Error())
+		return allErrs
+	}
+	if err != nil {
+		allErrs = append(allErrs, field.InternalError(path, errors.New("unable to verify type "+gvk.String()+": "+err.Error())))
+		return allErrs
+	}
+	if !found {
+		allErrs = append(allErrs, field.Invalid(path, apiVersion+"/"+kind, "type "+gvk.String()+" is not defined in this cluster"))
+	}
+	return allErrs
+}
+
+func isSupportedPatchType(patchType types.PatchType) bool {
+	for _, supportedPatchType := range supportedPatchTypes {
+		if patchType == supportedPatchType {
+			return true
+		}
+	}
+	return false
+}
+
+func patchTypesAsStrings(patchTypes []types.PatchType) []string {
+	result := []string{}
+	for _, patchType := range patchTypes {
+		result = append(result, string(patchType))
+	}
+	return result
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
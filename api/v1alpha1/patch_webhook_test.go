@@ -0,0 +1,351 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestValidatePatchSpecTemplateWithoutRestConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		patchTemplate string
+		expectedValid bool
+	}{
+		{
+			name:          "template using the lookup function",
+			patchTemplate: `metadata: {annotations: {uid: "{{ (lookup "v1" "Namespace" "" "default").metadata.uid }}"}}`,
+			expectedValid: true,
+		},
+		{
+			name:          "template using sprig functions",
+			patchTemplate: `metadata: {annotations: {name: "{{ (index . 0).metadata.name | upper | b64enc }}"}}`,
+			expectedValid: true,
+		},
+		{
+			name:          "template using an unknown function",
+			patchTemplate: `metadata: {annotations: {name: "{{ unknown (index . 0).metadata.name }}"}}`,
+		},
+		{
+			name:          "template using a function removed for security reasons",
+			patchTemplate: `metadata: {annotations: {home: "{{ env "HOME" }}"}}`,
+		},
+	}
+	restConfig := webhookRestConfig
+	webhookRestConfig = nil
+	defer func() { webhookRestConfig = restConfig }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := utilsv1alpha1.PatchSpec{
+				PatchTemplate: tt.patchTemplate,
+				TargetObjectRef: utilsv1alpha1.TargetObjectReference{
+					APIVersion: "v1",
+					Kind:       "ConfigMap",
+					Name:       "test",
+					Namespace:  "default",
+				},
+			}
+			templateErrors := field.ErrorList{}
+			for _, err := range validatePatchSpec(patch, field.NewPath("spec", "patches").Key("test")) {
+				if err.Field == "spec.patches[test].patchTemplate" {
+					templateErrors = append(templateErrors, err)
+				}
+			}
+			if tt.expectedValid && len(templateErrors) > 0 {
+				t.Errorf("expected the template to be valid, got %v", templateErrors.ToAggregate())
+			}
+			if !tt.expectedValid && len(templateErrors) == 0 {
+				t.Errorf("expected the template to be invalid")
+			}
+		})
+	}
+}
+
+func TestPatchDefaulterServiceAccountRef(t *testing.T) {
+	defaults := GetPatchDefaults()
+	defer SetPatchDefaults(defaults)
+	err := SetPatchDefaults(PatchDefaults{PatchType: defaults.PatchType, ServiceAccountName: "patcher"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defaulter := &patchDefaulter{}
+	defaulter.InjectDecoder(decoder)
+	newPatch := func(serviceAccountName string) *Patch {
+		return &Patch{
+			TypeMeta:   metav1.TypeMeta{APIVersion: GroupVersion.String(), Kind: "Patch"},
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       PatchSpec{ServiceAccountRef: corev1.LocalObjectReference{Name: serviceAccountName}},
+		}
+	}
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		patch     *Patch
+		old       *Patch
+		expected  string
+	}{
+		{
+			name:      "create without service account",
+			operation: admissionv1.Create,
+			patch:     newPatch(""),
+			expected:  "patcher",
+		},
+		{
+			name:      "create with service account",
+			operation: admissionv1.Create,
+			patch:     newPatch("custom"),
+			expected:  "custom",
+		},
+		{
+			name:      "update without service account keeps the stored one",
+			operation: admissionv1.Update,
+			patch:     newPatch(""),
+			old:       newPatch("default"),
+			expected:  "default",
+		},
+		{
+			name:      "update without service account of an object stored without one",
+			operation: admissionv1.Update,
+			patch:     newPatch(""),
+			old:       newPatch(""),
+			expected:  "",
+		},
+		{
+			name:      "update with service account",
+			operation: admissionv1.Update,
+			patch:     newPatch("custom"),
+			old:       newPatch("default"),
+			expected:  "custom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.patch)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: tt.operation,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+			if tt.old != nil {
+				oldRaw, err := json.Marshal(tt.old)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				req.OldObject = runtime.RawExtension{Raw: oldRaw}
+			}
+			response := defaulter.Handle(context.TODO(), req)
+			if !response.Allowed {
+				t.Fatalf("expected the request to be allowed, got %v", response.Result)
+			}
+			operations, err := json.Marshal(response.Patches)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			decodedPatch, err := jsonpatch.DecodePatch(operations)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			patched, err := decodedPatch.Apply(raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defaulted := &Patch{}
+			if err := json.Unmarshal(patched, defaulted); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if defaulted.Spec.ServiceAccountRef.Name != tt.expected {
+				t.Errorf("expected service account %q, got %q", tt.expected, defaulted.Spec.ServiceAccountRef.Name)
+			}
+			if len(defaulted.Finalizers) != 1 || defaulted.Finalizers[0] != PatchControllerFinalizerName {
+				t.Errorf("expected the finalizer to be set, got %v", defaulted.Finalizers)
+			}
+		})
+	}
+}
+
+// newTestPatchDefinitions returns a single patch adding a label to the ConfigMaps of the default namespace
+func newTestPatchDefinitions(label string) map[string]PatchDefinition {
+	patch := PatchDefinition{}
+	patch.PatchTemplate = `metadata: {labels: {` + label + `: "true"}}`
+	patch.PatchType = "application/merge-patch+json"
+	patch.TargetObjectRef = utilsv1alpha1.TargetObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default"}
+	return map[string]PatchDefinition{"label": patch}
+}
+
+// disallowConfigMaps restricts the allowed targets so that the ConfigMaps are not allowed, it returns the function restoring them
+func disallowConfigMaps() func() {
+	restConfig := webhookRestConfig
+	webhookRestConfig = nil
+	SetAllowedTargets([]KindSelector{{Kind: "Secret"}})
+	return func() {
+		webhookRestConfig = restConfig
+		SetAllowedTargets(nil)
+	}
+}
+
+func TestPatchValidateUpdate(t *testing.T) {
+	defer disallowConfigMaps()()
+	newPatch := func(serviceAccountName string, label string, deleted bool) *Patch {
+		patch := &Patch{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec: PatchSpec{
+				ServiceAccountRef: corev1.LocalObjectReference{Name: serviceAccountName},
+				Patches:           newTestPatchDefinitions(label),
+			},
+		}
+		if deleted {
+			patch.DeletionTimestamp = &metav1.Time{}
+		}
+		return patch
+	}
+	tests := []struct {
+		name          string
+		patch         *Patch
+		old           *Patch
+		expectedError string
+	}{
+		{
+			name:  "finalizer removal of a deleted patch with a disallowed target",
+			patch: newPatch("default", "a", true),
+			old:   newPatch("default", "a", true),
+		},
+		{
+			name:  "patches changed while deleted",
+			patch: newPatch("default", "b", true),
+			old:   newPatch("default", "a", true),
+		},
+		{
+			name:  "unchanged patches with a disallowed target",
+			patch: newPatch("default", "a", false),
+			old:   newPatch("default", "a", false),
+		},
+		{
+			name:          "changed patches with a disallowed target",
+			patch:         newPatch("default", "b", false),
+			old:           newPatch("default", "a", false),
+			expectedError: "is not an allowed target of the operator",
+		},
+		{
+			name:          "service account changed",
+			patch:         newPatch("custom", "a", false),
+			old:           newPatch("default", "a", false),
+			expectedError: "it cannot be changed from default to custom",
+		},
+		{
+			name:          "service account changed while deleted",
+			patch:         newPatch("custom", "a", true),
+			old:           newPatch("default", "a", true),
+			expectedError: "it cannot be changed from default to custom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.patch.ValidateUpdate(tt.old)
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestClusterPatchValidateUpdate(t *testing.T) {
+	defer disallowConfigMaps()()
+	newClusterPatch := func(serviceAccountNamespace string, label string, deleted bool) *ClusterPatch {
+		clusterPatch := &ClusterPatch{
+			ObjectMeta: metav1.ObjectMeta{Name: "test"},
+			Spec: ClusterPatchSpec{
+				ServiceAccountRef: ServiceAccountReference{Name: "patcher", Namespace: serviceAccountNamespace},
+				Patches:           newTestPatchDefinitions(label),
+			},
+		}
+		if deleted {
+			clusterPatch.DeletionTimestamp = &metav1.Time{}
+		}
+		return clusterPatch
+	}
+	tests := []struct {
+		name          string
+		clusterPatch  *ClusterPatch
+		old           *ClusterPatch
+		expectedError string
+	}{
+		{
+			name:         "finalizer removal of a deleted cluster patch with a disallowed target",
+			clusterPatch: newClusterPatch("default", "a", true),
+			old:          newClusterPatch("default", "a", true),
+		},
+		{
+			name:         "unchanged patches with a disallowed target",
+			clusterPatch: newClusterPatch("default", "a", false),
+			old:          newClusterPatch("default", "a", false),
+		},
+		{
+			name:          "changed patches with a disallowed target",
+			clusterPatch:  newClusterPatch("default", "b", false),
+			old:           newClusterPatch("default", "a", false),
+			expectedError: "is not an allowed target of the operator",
+		},
+		{
+			name:          "service account changed",
+			clusterPatch:  newClusterPatch("other", "a", false),
+			old:           newClusterPatch("default", "a", false),
+			expectedError: "it cannot be changed from default/patcher to other/patcher",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.clusterPatch.ValidateUpdate(tt.old)
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
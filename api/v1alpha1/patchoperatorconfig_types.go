@@ -0,0 +1,181 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PatchOperatorConfigName is the name of the PatchOperatorConfig object of the operator, objects with other names are ignored
+const PatchOperatorConfigName = "patch-operator"
+
+// MaxConcurrentReconcilesLimit is the highest number of Patches, and of ClusterPatches, that can be reconciled concurrently
+const MaxConcurrentReconcilesLimit = 16
+
+// the conditions reporting the health of the subsystems of the operator
+const (
+	// ConfigurationAppliedCondition reports whether the spec of the PatchOperatorConfig is valid and has been applied
+	ConfigurationAppliedCondition = "ConfigurationApplied"
+	// ModelsLoadedCondition reports whether the OpenAPI models needed to apply strategic merge patches have been loaded
+	ModelsLoadedCondition = "ModelsLoaded"
+	// GroupVersionsAvailableCondition reports whether the OpenAPI documents of all of the group versions of the cluster could be loaded.
+	// On Patches and ClusterPatches it reports whether the documents of the group versions targeted by their strategic merge patches of custom resources are available.
+	GroupVersionsAvailableCondition = "GroupVersionsAvailable"
+	// WebhooksEnabledCondition reports whether the webhooks, including the creation time injection, are served by the operator
+	WebhooksEnabledCondition = "WebhooksEnabled"
+)
+
+// the reasons of the conditions
+const (
+	ConfigurationAppliedReason      = "ConfigurationApplied"
+	InvalidConfigurationReason      = "InvalidConfiguration"
+	ModelsLoadedReason              = "ModelsLoaded"
+	ModelsNotLoadedReason           = "ModelsNotLoaded"
+	AllGroupVersionsAvailableReason = "AllGroupVersionsAvailable"
+	GroupVersionsUnavailableReason  = "GroupVersionsUnavailable"
+	WebhooksEnabledReason           = "WebhooksEnabled"
+	WebhooksDisabledReason          = "WebhooksDisabled"
+)
+
+// PatchOperatorConfigSpec defines the desired state of PatchOperatorConfig.
+// The settings are applied while the operator runs, the settings that are not set keep the value given by the flags and environment variables of the operator.
+type PatchOperatorConfigSpec struct {
+	// ServiceAccountTokenExpirationDuration is the requested lifetime of the service account tokens used by the enforcing controllers, it overrides the SERVICE_ACCOUNT_TOKEN_EXPIRATION_DURATION environment variable.
+	// The new duration applies from the next rotation of each token, it must be at least 10m.
+	// +kubebuilder:validation:Optional
+	ServiceAccountTokenExpirationDuration *metav1.Duration `json:"serviceAccountTokenExpirationDuration,omitempty"`
+
+	// DefaultPatchType is the patch type set by the defaulting webhooks on the patches that don't define one, it overrides the --default-patch-type flag and the defaults ConfigMap.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum="application/json-patch+json";"application/merge-patch+json";"application/strategic-merge-patch+json";"application/apply-patch+yaml"
+	DefaultPatchType types.PatchType `json:"defaultPatchType,omitempty"`
+
+	// InjectFailOpen admits the objects on which the creation time patches cannot be injected unchanged, instead of rejecting them. It overrides the --inject-fail-open flag.
+	// +kubebuilder:validation:Optional
+	InjectFailOpen *bool `json:"injectFailOpen,omitempty"`
+
+	// AllowedTargets restricts the kinds that can be patched, by the enforcing controllers and by the creation time injection. When empty all kinds can be patched.
+	// +kubebuilder:validation:Optional
+	// +listType=atomic
+	AllowedTargets []KindSelector `json:"allowedTargets,omitempty"`
+
+	// MaxConcurrentReconciles is the maximum number of Patches, and of ClusterPatches, reconciled concurrently. Defaults to 1.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=16
+	MaxConcurrentReconciles *int32 `json:"maxConcurrentReconciles,omitempty"`
+
+	// LogLevel is the verbosity of the logs, one of debug, info, error or an integer > 0 for increasingly verbose debug logs. It overrides the --zap-log-level flag.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^(debug|info|error|[1-9][0-9]*)$`
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+// EffectiveSettings are the settings the operator is running with, combining the PatchOperatorConfig with the flags and environment variables of the operator
+type EffectiveSettings struct {
+	// ServiceAccountTokenExpirationDuration is the requested lifetime of the service account tokens used by the enforcing controllers
+	ServiceAccountTokenExpirationDuration metav1.Duration `json:"serviceAccountTokenExpirationDuration"`
+
+	// DefaultPatchType is the patch type set by the defaulting webhooks on the patches that don't define one
+	DefaultPatchType types.PatchType `json:"defaultPatchType"`
+
+	// InjectFailOpen is whether the objects on which the creation time patches cannot be injected are admitted unchanged
+	InjectFailOpen bool `json:"injectFailOpen"`
+
+	// AllowedTargets are the kinds that can be patched, all kinds when empty
+	// +kubebuilder:validation:Optional
+	// +listType=atomic
+	AllowedTargets []KindSelector `json:"allowedTargets,omitempty"`
+
+	// MaxConcurrentReconciles is the maximum number of Patches, and of ClusterPatches, reconciled concurrently
+	MaxConcurrentReconciles int32 `json:"maxConcurrentReconciles"`
+
+	// LogLevel is the verbosity of the logs
+	LogLevel string `json:"logLevel"`
+
+	// WebhooksEnabled is whether the operator serves the webhooks, it is set by the ENABLE_WEBHOOKS environment variable and cannot be changed at runtime
+	WebhooksEnabled bool `json:"webhooksEnabled"`
+}
+
+// UnavailableGroupVersion is a group version whose OpenAPI document could not be loaded
+type UnavailableGroupVersion struct {
+	// GroupVersion is the group version, in the group/version format
+	// +kubebuilder:validation:Required
+	GroupVersion string `json:"groupVersion"`
+
+	// Message is the error returned when loading the document
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+}
+
+// PatchOperatorConfigStatus defines the observed state of PatchOperatorConfig
+type PatchOperatorConfigStatus struct {
+	// Conditions report the health of the operator
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// EffectiveSettings are the settings the operator is running with
+	// +kubebuilder:validation:Optional
+	EffectiveSettings *EffectiveSettings `json:"effectiveSettings,omitempty"`
+
+	// UnavailableGroupVersions are the group versions whose OpenAPI document could not be loaded, usually because the aggregated API serving them is unavailable.
+	// Strategic merge patches cannot be applied to their kinds, the other kinds are not affected.
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=groupVersion
+	UnavailableGroupVersions []UnavailableGroupVersion `json:"unavailableGroupVersions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// PatchOperatorConfig is the Schema for the patchoperatorconfigs API.
+// The operator creates a single PatchOperatorConfig named patch-operator, whose spec configures the operator at runtime and whose status reports the effective settings and the health of the operator.
+type PatchOperatorConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PatchOperatorConfigSpec   `json:"spec,omitempty"`
+	Status PatchOperatorConfigStatus `json:"status,omitempty"`
+}
+
+// GetConditions returns the conditions of the PatchOperatorConfig
+func (r *PatchOperatorConfig) GetConditions() []metav1.Condition {
+	return r.Status.Conditions
+}
+
+// SetConditions sets the conditions of the PatchOperatorConfig
+func (r *PatchOperatorConfig) SetConditions(conditions []metav1.Condition) {
+	r.Status.Conditions = conditions
+}
+
+//+kubebuilder:object:root=true
+
+// PatchOperatorConfigList contains a list of PatchOperatorConfig
+type PatchOperatorConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PatchOperatorConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PatchOperatorConfig{}, &PatchOperatorConfigList{})
+}
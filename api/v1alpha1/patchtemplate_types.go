@@ -0,0 +1,88 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ParamTemplateFunction is the name of the template function returning the value of a parameter of a PatchTemplate
+const ParamTemplateFunction = "param"
+
+// PatchTemplateSpec defines a reusable creation time patch
+type PatchTemplateSpec struct {
+	// Template is a go template that is rendered against the object being admitted, like the template of the redhat-cop.redhat.io/patch annotation.
+	// The values of the parameters are returned by the param function, for example {{ param "image" }}.
+	// +kubebuilder:validation:Required
+	Template string `json:"template"`
+
+	// PatchType is the type of patch to be applied, one of "application/json-patch+json","application/merge-patch+json","application/strategic-merge-patch+json"
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum="application/json-patch+json";"application/merge-patch+json";"application/strategic-merge-patch+json"
+	// +kubebuilder:default="application/strategic-merge-patch+json"
+	PatchType types.PatchType `json:"patchType,omitempty"`
+
+	// Parameters are the parameters accepted by the template, their values are passed with the redhat-cop.redhat.io/patch-template-parameters annotation
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=name
+	Parameters []PatchTemplateParameter `json:"parameters,omitempty"`
+}
+
+// PatchTemplateParameter describes a parameter of a PatchTemplate
+type PatchTemplateParameter struct {
+	// Name of the parameter
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Description of the parameter
+	// +kubebuilder:validation:Optional
+	Description string `json:"description,omitempty"`
+
+	// Default is the value of the parameter when none is passed
+	// +kubebuilder:validation:Optional
+	Default string `json:"default,omitempty"`
+
+	// Required, when true, makes the injection fail if no value is passed for the parameter
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=false
+	Required bool `json:"required,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PatchTemplate is the Schema for the patchtemplates API
+type PatchTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec PatchTemplateSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PatchTemplateList contains a list of PatchTemplate
+type PatchTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PatchTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PatchTemplate{}, &PatchTemplateList{})
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"text/template"
+
+	utilstemplate "github.com/redhat-cop/operator-utils/pkg/util/templates"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var patchtemplatelog = logf.Log.WithName("patchtemplate-resource")
+
+func (r *PatchTemplate) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookRestConfig = mgr.GetConfig()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-patchtemplate,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=patchtemplates,verbs=create;update,versions=v1alpha1,name=vpatchtemplate.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &PatchTemplate{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *PatchTemplate) ValidateCreate() error {
+	patchtemplatelog.Info("validate create", "name", r.Name)
+
+	return r.validateTemplate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *PatchTemplate) ValidateUpdate(old runtime.Object) error {
+	patchtemplatelog.Info("validate update", "name", r.Name)
+
+	return r.validateTemplate()
+}
+
+func (r *PatchTemplate) validateTemplate() error {
+	allErrs := validatePatchTemplateSpec(&r.Spec, field.NewPath("spec"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("PatchTemplate").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *PatchTemplate) ValidateDelete() error {
+	patchtemplatelog.Info("validate delete", "name", r.Name)
+
+	return nil
+}
+
+// validatePatchTemplateSpec verifies that the template can be parsed and that the parameters are well defined, so that errors are reported at admission time instead of when the template is used
+func validatePatchTemplateSpec(spec *PatchTemplateSpec, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	funcMap := utilstemplate.AdvancedTemplateFuncMap(webhookRestConfig, patchtemplatelog)
+	funcMap[ParamTemplateFunction] = func(string) (string, error) { return "", nil }
+	if _, err := template.New(spec.Template).Funcs(funcMap).Parse(spec.Template); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("template"), spec.Template, "unable to parse template: "+err.Error()))
+	}
+	for i, parameter := range spec.Parameters {
+		if parameter.Required && parameter.Default != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("parameters").Index(i).Child("default"), "a required parameter cannot have a default value"))
+		}
+	}
+	return allErrs
+}
@@ -23,10 +23,480 @@ package v1alpha1
 
 import (
 	apiv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterPatch) DeepCopyInto(out *ClusterPatch) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterPatch.
+func (in *ClusterPatch) DeepCopy() *ClusterPatch {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterPatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterPatch) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterPatchList) DeepCopyInto(out *ClusterPatchList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterPatch, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterPatchList.
+func (in *ClusterPatchList) DeepCopy() *ClusterPatchList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterPatchList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterPatchList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterPatchSpec) DeepCopyInto(out *ClusterPatchSpec) {
+	*out = *in
+	if in.Patches != nil {
+		in, out := &in.Patches, &out.Patches
+		*out = make(map[string]PatchDefinition, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	out.ServiceAccountRef = in.ServiceAccountRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterPatchSpec.
+func (in *ClusterPatchSpec) DeepCopy() *ClusterPatchSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterPatchSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterPatchTemplate) DeepCopyInto(out *ClusterPatchTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterPatchTemplate.
+func (in *ClusterPatchTemplate) DeepCopy() *ClusterPatchTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterPatchTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterPatchTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterPatchTemplateList) DeepCopyInto(out *ClusterPatchTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterPatchTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterPatchTemplateList.
+func (in *ClusterPatchTemplateList) DeepCopy() *ClusterPatchTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterPatchTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterPatchTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftPolicy) DeepCopyInto(out *DriftPolicy) {
+	*out = *in
+	if in.Window != nil {
+		in, out := &in.Window, &out.Window
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.SuspensionDuration != nil {
+		in, out := &in.SuspensionDuration, &out.SuspensionDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftPolicy.
+func (in *DriftPolicy) DeepCopy() *DriftPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EffectiveSettings) DeepCopyInto(out *EffectiveSettings) {
+	*out = *in
+	out.ServiceAccountTokenExpirationDuration = in.ServiceAccountTokenExpirationDuration
+	if in.AllowedTargets != nil {
+		in, out := &in.AllowedTargets, &out.AllowedTargets
+		*out = make([]KindSelector, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EffectiveSettings.
+func (in *EffectiveSettings) DeepCopy() *EffectiveSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(EffectiveSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionPolicy) DeepCopyInto(out *InjectionPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionPolicy.
+func (in *InjectionPolicy) DeepCopy() *InjectionPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InjectionPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionPolicyList) DeepCopyInto(out *InjectionPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]InjectionPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionPolicyList.
+func (in *InjectionPolicyList) DeepCopy() *InjectionPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InjectionPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionPolicyMatch) DeepCopyInto(out *InjectionPolicyMatch) {
+	*out = *in
+	if in.Kinds != nil {
+		in, out := &in.Kinds, &out.Kinds
+		*out = make([]KindSelector, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ObjectSelector != nil {
+		in, out := &in.ObjectSelector, &out.ObjectSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Operations != nil {
+		in, out := &in.Operations, &out.Operations
+		*out = make([]InjectionOperation, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionPolicyMatch.
+func (in *InjectionPolicyMatch) DeepCopy() *InjectionPolicyMatch {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionPolicyMatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionPolicySpec) DeepCopyInto(out *InjectionPolicySpec) {
+	*out = *in
+	in.Match.DeepCopyInto(&out.Match)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionPolicySpec.
+func (in *InjectionPolicySpec) DeepCopy() *InjectionPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionWebhook) DeepCopyInto(out *InjectionWebhook) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionWebhook.
+func (in *InjectionWebhook) DeepCopy() *InjectionWebhook {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionWebhook)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InjectionWebhook) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionWebhookList) DeepCopyInto(out *InjectionWebhookList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]InjectionWebhook, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionWebhookList.
+func (in *InjectionWebhookList) DeepCopy() *InjectionWebhookList {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionWebhookList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *InjectionWebhookList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionWebhookRule) DeepCopyInto(out *InjectionWebhookRule) {
+	*out = *in
+	if in.APIGroups != nil {
+		in, out := &in.APIGroups, &out.APIGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.APIVersions != nil {
+		in, out := &in.APIVersions, &out.APIVersions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Operations != nil {
+		in, out := &in.Operations, &out.Operations
+		*out = make([]InjectionOperation, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionWebhookRule.
+func (in *InjectionWebhookRule) DeepCopy() *InjectionWebhookRule {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionWebhookRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionWebhookSpec) DeepCopyInto(out *InjectionWebhookSpec) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]InjectionWebhookRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ObjectSelector != nil {
+		in, out := &in.ObjectSelector, &out.ObjectSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FailurePolicy != nil {
+		in, out := &in.FailurePolicy, &out.FailurePolicy
+		*out = new(admissionregistrationv1.FailurePolicyType)
+		**out = **in
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionWebhookSpec.
+func (in *InjectionWebhookSpec) DeepCopy() *InjectionWebhookSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionWebhookSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InjectionWebhookStatus) DeepCopyInto(out *InjectionWebhookStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InjectionWebhookStatus.
+func (in *InjectionWebhookStatus) DeepCopy() *InjectionWebhookStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(InjectionWebhookStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KindSelector) DeepCopyInto(out *KindSelector) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KindSelector.
+func (in *KindSelector) DeepCopy() *KindSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(KindSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Patch) DeepCopyInto(out *Patch) {
 	*out = *in
@@ -54,6 +524,32 @@ func (in *Patch) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchDefinition) DeepCopyInto(out *PatchDefinition) {
+	*out = *in
+	in.PatchSpec.DeepCopyInto(&out.PatchSpec)
+	if in.DependsOn != nil {
+		in, out := &in.DependsOn, &out.DependsOn
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DriftPolicy != nil {
+		in, out := &in.DriftPolicy, &out.DriftPolicy
+		*out = new(DriftPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchDefinition.
+func (in *PatchDefinition) DeepCopy() *PatchDefinition {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchDefinition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PatchList) DeepCopyInto(out *PatchList) {
 	*out = *in
@@ -86,12 +582,138 @@ func (in *PatchList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchOperatorConfig) DeepCopyInto(out *PatchOperatorConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchOperatorConfig.
+func (in *PatchOperatorConfig) DeepCopy() *PatchOperatorConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchOperatorConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PatchOperatorConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchOperatorConfigList) DeepCopyInto(out *PatchOperatorConfigList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]PatchOperatorConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchOperatorConfigList.
+func (in *PatchOperatorConfigList) DeepCopy() *PatchOperatorConfigList {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchOperatorConfigList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PatchOperatorConfigList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchOperatorConfigSpec) DeepCopyInto(out *PatchOperatorConfigSpec) {
+	*out = *in
+	if in.ServiceAccountTokenExpirationDuration != nil {
+		in, out := &in.ServiceAccountTokenExpirationDuration, &out.ServiceAccountTokenExpirationDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.InjectFailOpen != nil {
+		in, out := &in.InjectFailOpen, &out.InjectFailOpen
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AllowedTargets != nil {
+		in, out := &in.AllowedTargets, &out.AllowedTargets
+		*out = make([]KindSelector, len(*in))
+		copy(*out, *in)
+	}
+	if in.MaxConcurrentReconciles != nil {
+		in, out := &in.MaxConcurrentReconciles, &out.MaxConcurrentReconciles
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchOperatorConfigSpec.
+func (in *PatchOperatorConfigSpec) DeepCopy() *PatchOperatorConfigSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchOperatorConfigSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchOperatorConfigStatus) DeepCopyInto(out *PatchOperatorConfigStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.EffectiveSettings != nil {
+		in, out := &in.EffectiveSettings, &out.EffectiveSettings
+		*out = new(EffectiveSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.UnavailableGroupVersions != nil {
+		in, out := &in.UnavailableGroupVersions, &out.UnavailableGroupVersions
+		*out = make([]UnavailableGroupVersion, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchOperatorConfigStatus.
+func (in *PatchOperatorConfigStatus) DeepCopy() *PatchOperatorConfigStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchOperatorConfigStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PatchSpec) DeepCopyInto(out *PatchSpec) {
 	*out = *in
 	if in.Patches != nil {
 		in, out := &in.Patches, &out.Patches
-		*out = make(map[string]apiv1alpha1.PatchSpec, len(*in))
+		*out = make(map[string]PatchDefinition, len(*in))
 		for key, val := range *in {
 			(*out)[key] = *val.DeepCopy()
 		}
@@ -146,6 +768,33 @@ func (in *PatchStatus) DeepCopyInto(out *PatchStatus) {
 			(*out)[key] = outVal
 		}
 	}
+	if in.BlockedPatches != nil {
+		in, out := &in.BlockedPatches, &out.BlockedPatches
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.TargetStatuses != nil {
+		in, out := &in.TargetStatuses, &out.TargetStatuses
+		*out = make(map[string]PatchTargetsStatus, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.ServiceAccountTokenExpirationTimestamp != nil {
+		in, out := &in.ServiceAccountTokenExpirationTimestamp, &out.ServiceAccountTokenExpirationTimestamp
+		*out = (*in).DeepCopy()
+	}
+	if in.ServiceAccountTokenRotationTimestamp != nil {
+		in, out := &in.ServiceAccountTokenRotationTimestamp, &out.ServiceAccountTokenRotationTimestamp
+		*out = (*in).DeepCopy()
+	}
+	if in.PreviewConfigMapRef != nil {
+		in, out := &in.PreviewConfigMapRef, &out.PreviewConfigMapRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchStatus.
@@ -157,3 +806,192 @@ func (in *PatchStatus) DeepCopy() *PatchStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchSuspension) DeepCopyInto(out *PatchSuspension) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+	if in.Until != nil {
+		in, out := &in.Until, &out.Until
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchSuspension.
+func (in *PatchSuspension) DeepCopy() *PatchSuspension {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchSuspension)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTargetStatus) DeepCopyInto(out *PatchTargetStatus) {
+	*out = *in
+	if in.LastAppliedTime != nil {
+		in, out := &in.LastAppliedTime, &out.LastAppliedTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTargetStatus.
+func (in *PatchTargetStatus) DeepCopy() *PatchTargetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTargetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTargetsStatus) DeepCopyInto(out *PatchTargetsStatus) {
+	*out = *in
+	if in.Targets != nil {
+		in, out := &in.Targets, &out.Targets
+		*out = make([]PatchTargetStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Suspension != nil {
+		in, out := &in.Suspension, &out.Suspension
+		*out = new(PatchSuspension)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTargetsStatus.
+func (in *PatchTargetsStatus) DeepCopy() *PatchTargetsStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTargetsStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTemplate) DeepCopyInto(out *PatchTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTemplate.
+func (in *PatchTemplate) DeepCopy() *PatchTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PatchTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTemplateList) DeepCopyInto(out *PatchTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]PatchTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTemplateList.
+func (in *PatchTemplateList) DeepCopy() *PatchTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *PatchTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTemplateParameter) DeepCopyInto(out *PatchTemplateParameter) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTemplateParameter.
+func (in *PatchTemplateParameter) DeepCopy() *PatchTemplateParameter {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTemplateParameter)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PatchTemplateSpec) DeepCopyInto(out *PatchTemplateSpec) {
+	*out = *in
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = make([]PatchTemplateParameter, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PatchTemplateSpec.
+func (in *PatchTemplateSpec) DeepCopy() *PatchTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PatchTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceAccountReference) DeepCopyInto(out *ServiceAccountReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceAccountReference.
+func (in *ServiceAccountReference) DeepCopy() *ServiceAccountReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceAccountReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UnavailableGroupVersion) DeepCopyInto(out *UnavailableGroupVersion) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UnavailableGroupVersion.
+func (in *UnavailableGroupVersion) DeepCopy() *UnavailableGroupVersion {
+	if in == nil {
+		return nil
+	}
+	out := new(UnavailableGroupVersion)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -14,6 +14,15 @@ imagePullSecrets: []
 nameOverride: ""
 fullnameOverride: ""
 env: []
+# admit the objects on which the creation time patches cannot be injected unchanged, instead of rejecting them
+injectFailOpen: false
+# stamp the objects patched at creation time with the redhat-cop.redhat.io/patched-by annotation
+injectPatchedByAnnotation: false
+# the patch type and the service account set on the patches that don't define them, empty keeps the operator defaults
+defaultPatchType: ""
+defaultServiceAccount: ""
+# namespace/name of a ConfigMap overriding the defaults, see the readme
+defaultsConfigMap: ""
 podAnnotations: {}
 
 resources:
@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ClusterPatchReconciler reconciles a ClusterPatch object.
+// It runs its own enforcing controllers, but otherwise shares all of the logic of PatchReconciler.
+type ClusterPatchReconciler struct {
+	PatchReconciler
+}
+
+func NewClusterPatchReconciler(reconcilerBase util.ReconcilerBase, models *CustomResourceDefinitionReconciler) *ClusterPatchReconciler {
+	return &ClusterPatchReconciler{
+		PatchReconciler: PatchReconciler{
+			ReconcilerBase: reconcilerBase,
+			statusChanges:  newStatusChangeNotifier(statusChangeCoalescingPeriod),
+			Models:         models,
+		},
+	}
+}
+
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=clusterpatches,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=clusterpatches/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=clusterpatches/finalizers,verbs=update
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ClusterPatchReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx).WithName(req.Name)
+	ctx = log.IntoContext(ctx, rlog)
+	instance := &redhatcopv1alpha1.ClusterPatch{}
+	err := r.GetClient().Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Return and don't requeue
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	return r.reconcilePatchObject(ctx, instance)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterPatchReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.Add(r.statusChanges)
+	if err != nil {
+		return err
+	}
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
+		For(&redhatcopv1alpha1.ClusterPatch{}).
+		Watches(&source.Channel{Source: r.getStatusChanges()}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Channel{Source: allowedTargetsChanges["ClusterPatch"]}, handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+			return r.listRequests(&redhatcopv1alpha1.ClusterPatchList{}, nil)
+		}))
+	if r.Models != nil {
+		controllerBuilder = controllerBuilder.Watches(&source.Channel{Source: r.Models.StatusChanges()}, handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+			return r.listRequests(&redhatcopv1alpha1.ClusterPatchList{}, isModelDependent)
+		}))
+	}
+	return controllerBuilder.
+		WithOptions(controller.Options{MaxConcurrentReconciles: redhatcopv1alpha1.MaxConcurrentReconcilesLimit}).
+		Complete(r)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// getConfigMapName returns the name of a ConfigMap owned by the instance.
+// The ConfigMaps live in the namespace of the service account, ClusterPatches use their own prefix so that they don't collide with the ones of the Patches in that namespace.
+func getConfigMapName(instance redhatcopv1alpha1.PatchObject, suffix string) string {
+	return instance.GetName() + "-" + strings.ToLower(getPatchObjectKind(instance)) + suffix
+}
+
+// getOwnedConfigMap returns the ConfigMap with the given name and namespace, if it does not exist a new one owned by owner is returned.
+// The api reader is used so that we don't cache all the ConfigMaps of the cluster.
+func (r *PatchReconciler) getOwnedConfigMap(ctx context.Context, owner client.Object, namespace string, name string) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	err := r.GetAPIReader().Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, configMap)
+	if err == nil {
+		return configMap, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	configMap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	err = controllerutil.SetControllerReference(owner, configMap, r.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// createOrUpdateConfigMap persists a ConfigMap returned by getOwnedConfigMap
+func (r *PatchReconciler) createOrUpdateConfigMap(ctx context.Context, configMap *corev1.ConfigMap) error {
+	if configMap.GetResourceVersion() == "" {
+		return r.GetClient().Create(ctx, configMap)
+	}
+	return r.GetClient().Update(ctx, configMap)
+}
+
+// deleteConfigMapIfExists deletes the ConfigMap with the given name and namespace
+func (r *PatchReconciler) deleteConfigMapIfExists(ctx context.Context, namespace string, name string) error {
+	err := r.GetClient().Delete(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -18,82 +18,511 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/redhat-cop/operator-utils/pkg/util/discoveryclient"
 	apiextension "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	openapiclient "k8s.io/client-go/openapi"
 	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	openapi "k8s.io/kube-openapi/pkg/util/proto"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/builder"
-	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
-	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
+// defaultOpenAPIRefreshDebounce is how long the CRD events are collected before the affected OpenAPI documents are fetched
+const defaultOpenAPIRefreshDebounce = 2 * time.Second
+
+// the backoff between the attempts to load the models at startup
+const (
+	initialModelLoadBackoff = time.Second
+	maxModelLoadBackoff     = 2 * time.Minute
+)
+
+// unavailableGroupVersionRetryPeriod is how often the documents of the unavailable group versions are fetched again
+const unavailableGroupVersionRetryPeriod = time.Minute
+
+// the backoff between the refreshes of the group versions not listed by the /openapi/v3 endpoint, the api server publishes the document of a new CRD with a delay.
+// After the last retry the group version is considered removed.
+const (
+	initialMissingGroupVersionBackoff = time.Second
+	maxMissingGroupVersionRetries     = 6
+)
+
+// missingModelTTL is how long GetModel remembers that a GVK has no model, instead of fetching its group version on every lookup
+const missingModelTTL = 10 * time.Second
+
+// errModelsNotLoaded is returned while the models are being loaded at startup
+var errModelsNotLoaded = errors.New("the OpenAPI models needed to apply strategic merge patches are not loaded yet, retry later")
+
+// groupVersionUnavailableError is returned for the kinds of a group version whose OpenAPI document could not be loaded, usually because the aggregated API serving it is unavailable
+type groupVersionUnavailableError struct {
+	groupVersion schema.GroupVersion
+	message      string
+}
+
+func (e *groupVersionUnavailableError) Error() string {
+	return "the OpenAPI document of group version " + e.groupVersion.String() + " is unavailable, retry later: " + e.message
+}
+
+// openAPIRefreshRequest is the only request processed by the reconciler, the group versions to refresh are collected by the event handler
+var openAPIRefreshRequest = reconcile.Request{
+	NamespacedName: types.NamespacedName{
+		Name: "openapi-refresh",
+	},
+}
+
 func NewCustomResourceDefinitionReconciler(restConfig *rest.Config) *CustomResourceDefinitionReconciler {
 	customResourceDefinitionReconciler := CustomResourceDefinitionReconciler{
-		restConfig: restConfig,
-		modelLock:  sync.Mutex{},
-	}
-	ctx := context.TODO()
-	ctx = log.IntoContext(ctx, ctrl.Log.WithName("NewCustomResourceDefinitionReconciler"))
-	err := customResourceDefinitionReconciler.loadModels(ctx)
-	if err != nil {
-		panic(err)
+		restConfig:               restConfig,
+		debounce:                 defaultOpenAPIRefreshDebounce,
+		modelLock:                sync.Mutex{},
+		models:                   map[schema.GroupVersionKind]openapi.Schema{},
+		unavailableGroupVersions: map[schema.GroupVersion]string{},
+		missingModels:            map[schema.GroupVersionKind]time.Time{},
+		pendingLock:              sync.Mutex{},
+		pendingGroupVersions:     map[schema.GroupVersion]bool{},
+		missingGroupVersions:     map[schema.GroupVersion]int{},
+		refreshes:                workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "openapi-refresh"),
 	}
 	return &customResourceDefinitionReconciler
 }
 
-// CustomResourceDefinitionReconciler reconciles a CustomResourceDefinition object
+// CustomResourceDefinitionReconciler keeps the OpenAPI models of the types of the cluster, which are needed to compute strategic merge patches.
+// The models are fetched per group version from the OpenAPI v3 endpoint, a CRD event only refreshes the group versions of that CRD.
+// On clusters that don't serve OpenAPI v3 the whole OpenAPI v2 document is loaded instead.
+// The models are loaded in the background when the manager starts, until then GetModel returns errModelsNotLoaded.
+// The models are loaded and refreshed on every replica, as the webhooks are served by all of them, so the refreshes are not run by a leader elected controller.
+// The group versions whose document cannot be loaded, typically served by an unavailable aggregated API, are recorded as unavailable and fetched again periodically,
+// only strategic merge patches of their kinds fail in the meantime.
 type CustomResourceDefinitionReconciler struct {
-	restConfig    *rest.Config
-	modelLock     sync.Mutex
-	openapiModels openapi.Models
+	restConfig *rest.Config
+	debounce   time.Duration
+	modelLock  sync.Mutex
+	// models are the top level models indexed by GVK
+	models map[schema.GroupVersionKind]openapi.Schema
+	// unavailableGroupVersions are the group versions whose document could not be loaded, with the error
+	unavailableGroupVersions map[schema.GroupVersion]string
+	// missingModels are the GVKs without a model after a refresh of their group version, with the time of the refresh
+	missingModels map[schema.GroupVersionKind]time.Time
+	loaded        atomic.Bool
+	openAPIV2     atomic.Bool
+	// pendingGroupVersions are the group versions of the CRDs changed since the last refresh
+	pendingLock          sync.Mutex
+	pendingGroupVersions map[schema.GroupVersion]bool
+	// missingGroupVersions are the group versions not listed by the /openapi/v3 endpoint when they were refreshed, with the number of refreshes
+	missingGroupVersions map[schema.GroupVersion]int
+	// refreshes queues the refreshes of the pending group versions, it is processed by the modelLoader once the models are loaded
+	refreshes workqueue.RateLimitingInterface
+	// statusChanges signal to each of the watching controllers that the models have been loaded or that the set of unavailable group versions changed
+	statusChangesLock sync.Mutex
+	statusChanges     []chan event.GenericEvent
+}
+
+// GetModel returns the OpenAPI model of the GVK, if the model is not known the group version is fetched, as the CRD may have just been created.
+// A GVK still without a model after the fetch is not fetched again for missingModelTTL.
+func (r *CustomResourceDefinitionReconciler) GetModel(ctx context.Context, gvk schema.GroupVersionKind) (openapi.Schema, error) {
+	if !r.loaded.Load() {
+		return nil, errModelsNotLoaded
+	}
+	model, unavailable := r.getModel(gvk)
+	if model != nil {
+		return model, nil
+	}
+	// the unavailable group versions are fetched again by the reconciler, not on every lookup
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	if r.isMissingModel(gvk, time.Now()) {
+		return nil, nil
+	}
+	missing, err := r.refreshGroupVersions(ctx, []schema.GroupVersion{gvk.GroupVersion()})
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		// the document of a new CRD may not be published yet, the reconciler fetches it again with a backoff
+		r.addPendingGroupVersions(missing...)
+		r.triggerRetry()
+	}
+	model, unavailable = r.getModel(gvk)
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	if model == nil {
+		r.setMissingModel(gvk, time.Now())
+	}
+	return model, nil
+}
+
+// isMissingModel returns whether the GVK had no model after a refresh of its group version less than missingModelTTL ago
+func (r *CustomResourceDefinitionReconciler) isMissingModel(gvk schema.GroupVersionKind, now time.Time) bool {
+	r.modelLock.Lock()
+	defer r.modelLock.Unlock()
+	refreshed, ok := r.missingModels[gvk]
+	if !ok {
+		return false
+	}
+	if now.Sub(refreshed) >= missingModelTTL {
+		delete(r.missingModels, gvk)
+		return false
+	}
+	return true
+}
+
+// setMissingModel records that the GVK has no model after a refresh of its group version
+func (r *CustomResourceDefinitionReconciler) setMissingModel(gvk schema.GroupVersionKind, now time.Time) {
+	r.modelLock.Lock()
+	defer r.modelLock.Unlock()
+	r.missingModels[gvk] = now
 }
 
-func (r *CustomResourceDefinitionReconciler) GetModels() openapi.Models {
+// getModel returns the model of the GVK, or the error of its group version if it is unavailable
+func (r *CustomResourceDefinitionReconciler) getModel(gvk schema.GroupVersionKind) (openapi.Schema, error) {
 	r.modelLock.Lock()
 	defer r.modelLock.Unlock()
-	return r.openapiModels
+	if model, ok := r.models[gvk]; ok {
+		return model, nil
+	}
+	if message, ok := r.unavailableGroupVersions[gvk.GroupVersion()]; ok {
+		return nil, &groupVersionUnavailableError{groupVersion: gvk.GroupVersion(), message: message}
+	}
+	return nil, nil
 }
 
-func (r *CustomResourceDefinitionReconciler) setModels(openapiModels openapi.Models) {
+// GetUnavailableGroupVersions returns the group versions whose document could not be loaded, with the error
+func (r *CustomResourceDefinitionReconciler) GetUnavailableGroupVersions() map[schema.GroupVersion]string {
 	r.modelLock.Lock()
 	defer r.modelLock.Unlock()
-	r.openapiModels = openapiModels
+	unavailableGroupVersions := map[schema.GroupVersion]string{}
+	for groupVersion, message := range r.unavailableGroupVersions {
+		unavailableGroupVersions[groupVersion] = message
+	}
+	return unavailableGroupVersions
+}
+
+// StatusChanges returns a new channel signaling that the models have been loaded or that the set of unavailable group versions changed, each watching controller needs its own
+func (r *CustomResourceDefinitionReconciler) StatusChanges() <-chan event.GenericEvent {
+	r.statusChangesLock.Lock()
+	defer r.statusChangesLock.Unlock()
+	statusChanges := make(chan event.GenericEvent, 1)
+	r.statusChanges = append(r.statusChanges, statusChanges)
+	return statusChanges
+}
+
+// IsLoaded returns whether the models have been loaded
+func (r *CustomResourceDefinitionReconciler) IsLoaded() bool {
+	return r.loaded.Load()
+}
+
+// triggerRetry schedules a refresh of the pending group versions, unless one is already scheduled
+func (r *CustomResourceDefinitionReconciler) triggerRetry() {
+	r.refreshes.Add(openAPIRefreshRequest)
+}
+
+// notifyStatusChange signals a status change, unless one is already pending
+func (r *CustomResourceDefinitionReconciler) notifyStatusChange() {
+	r.statusChangesLock.Lock()
+	defer r.statusChangesLock.Unlock()
+	for _, statusChanges := range r.statusChanges {
+		select {
+		case statusChanges <- event.GenericEvent{Object: &apiextension.CustomResourceDefinition{}}:
+		default:
+			// a change is already signaled
+		}
+	}
+}
+
+// setModels replaces the models of the group versions, when groupVersions is nil all the models are replaced.
+// The models of the unavailable group versions are kept, an outdated model is better than none, and the group versions are recorded as unavailable.
+func (r *CustomResourceDefinitionReconciler) setModels(groupVersions []schema.GroupVersion, models map[schema.GroupVersionKind]openapi.Schema, unavailableGroupVersions map[schema.GroupVersion]string) {
+	r.modelLock.Lock()
+	defer r.modelLock.Unlock()
+	previouslyUnavailable := r.unavailableGroupVersions
+	if groupVersions == nil {
+		for gvk, model := range r.models {
+			if _, ok := unavailableGroupVersions[gvk.GroupVersion()]; ok {
+				models[gvk] = model
+			}
+		}
+		r.models = models
+		r.unavailableGroupVersions = unavailableGroupVersions
+		r.missingModels = map[schema.GroupVersionKind]time.Time{}
+	} else {
+		refreshed := map[schema.GroupVersion]bool{}
+		for _, groupVersion := range groupVersions {
+			if _, ok := unavailableGroupVersions[groupVersion]; !ok {
+				refreshed[groupVersion] = true
+			}
+		}
+		for gvk := range r.models {
+			if refreshed[gvk.GroupVersion()] {
+				delete(r.models, gvk)
+			}
+		}
+		for gvk := range models {
+			delete(r.missingModels, gvk)
+		}
+		for gvk, model := range models {
+			r.models[gvk] = model
+		}
+		r.unavailableGroupVersions = map[schema.GroupVersion]string{}
+		for groupVersion, message := range previouslyUnavailable {
+			if !refreshed[groupVersion] {
+				r.unavailableGroupVersions[groupVersion] = message
+			}
+		}
+		for groupVersion, message := range unavailableGroupVersions {
+			r.unavailableGroupVersions[groupVersion] = message
+		}
+	}
+	if recordGroupVersionAvailability(previouslyUnavailable, r.unavailableGroupVersions) {
+		r.notifyStatusChange()
+	}
+}
+
+// addPendingGroupVersions records the group versions to be refreshed by the next reconcile
+func (r *CustomResourceDefinitionReconciler) addPendingGroupVersions(groupVersions ...schema.GroupVersion) {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+	for _, groupVersion := range groupVersions {
+		r.pendingGroupVersions[groupVersion] = true
+	}
+}
+
+// getMissingGroupVersionsRetry records the refreshes of the group versions not listed by the /openapi/v3 endpoint and returns the delay before the next one, 0 when no retry is needed.
+// The group versions listed again are forgotten, the ones still missing after maxMissingGroupVersionRetries are considered removed.
+func (r *CustomResourceDefinitionReconciler) getMissingGroupVersionsRetry(groupVersions []schema.GroupVersion, missing []schema.GroupVersion) time.Duration {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+	isMissing := map[schema.GroupVersion]bool{}
+	for _, groupVersion := range missing {
+		isMissing[groupVersion] = true
+	}
+	for _, groupVersion := range groupVersions {
+		if !isMissing[groupVersion] {
+			delete(r.missingGroupVersions, groupVersion)
+		}
+	}
+	var delay time.Duration
+	for _, groupVersion := range missing {
+		attempts := r.missingGroupVersions[groupVersion] + 1
+		if attempts > maxMissingGroupVersionRetries {
+			delete(r.missingGroupVersions, groupVersion)
+			continue
+		}
+		r.missingGroupVersions[groupVersion] = attempts
+		r.pendingGroupVersions[groupVersion] = true
+		groupVersionDelay := initialMissingGroupVersionBackoff << (attempts - 1)
+		if delay == 0 || groupVersionDelay < delay {
+			delay = groupVersionDelay
+		}
+	}
+	return delay
+}
+
+// takePendingGroupVersions returns the group versions to be refreshed and clears them
+func (r *CustomResourceDefinitionReconciler) takePendingGroupVersions() []schema.GroupVersion {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+	groupVersions := []schema.GroupVersion{}
+	for groupVersion := range r.pendingGroupVersions {
+		groupVersions = append(groupVersions, groupVersion)
+	}
+	r.pendingGroupVersions = map[schema.GroupVersion]bool{}
+	return groupVersions
 }
 
 //+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
 
-// Reconcile is part of the main kubernetes reconciliation loop which aims to
-// move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the CustomResourceDefinition object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
-//
-// For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+// Reconcile refreshes the models of the group versions of the CRDs changed since the last refresh, it is called by the modelLoader on every replica.
+// If the refresh fails the group versions are refreshed again by the retry, the unavailable group versions are refreshed periodically until they are available
+// and the group versions whose document is not published yet are refreshed with a backoff.
 func (r *CustomResourceDefinitionReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	rlog := log.FromContext(ctx)
-	err := r.loadModels(ctx)
+	if !r.loaded.Load() {
+		// the group versions are loaded by the initial load, the retries are triggered when it completes
+		return ctrl.Result{}, nil
+	}
+	groupVersions := r.takePendingGroupVersions()
+	if len(groupVersions) == 0 {
+		return ctrl.Result{}, nil
+	}
+	rlog.V(1).Info("refreshing models", "groupVersions", groupVersions)
+	missing, err := r.refreshGroupVersions(ctx, groupVersions)
 	if err != nil {
-		rlog.Error(err, "unable to load models")
+		rlog.Error(err, "unable to refresh models", "groupVersions", groupVersions)
+		r.addPendingGroupVersions(groupVersions...)
 		return ctrl.Result{}, err
 	}
-
-	return ctrl.Result{}, nil
+	if len(missing) > 0 {
+		rlog.V(1).Info("group versions not listed by the openapi v3 endpoint", "groupVersions", missing)
+	}
+	requeueAfter := r.getMissingGroupVersionsRetry(groupVersions, missing)
+	if unavailableGroupVersions := r.GetUnavailableGroupVersions(); len(unavailableGroupVersions) > 0 {
+		for groupVersion := range unavailableGroupVersions {
+			r.addPendingGroupVersions(groupVersion)
+		}
+		if requeueAfter == 0 || unavailableGroupVersionRetryPeriod < requeueAfter {
+			requeueAfter = unavailableGroupVersionRetryPeriod
+		}
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
+// loadModels loads the models of all the group versions of the cluster.
+// The group versions whose document cannot be fetched or parsed are skipped, so that a broken aggregated API doesn't prevent the operator from starting.
 func (r *CustomResourceDefinitionReconciler) loadModels(ctx context.Context) error {
 	rlog := log.FromContext(ctx)
 	ctx = context.WithValue(ctx, "restConfig", r.restConfig)
 
+	client, err := discoveryclient.GetDiscoveryClient(ctx)
+	if err != nil {
+		rlog.Error(err, "unable to get discovery client")
+		return err
+	}
+	paths, err := client.OpenAPIV3().Paths()
+	if apierrors.IsNotFound(err) {
+		rlog.Info("OpenAPI v3 is not served, falling back to OpenAPI v2")
+		r.openAPIV2.Store(true)
+		return r.loadModelsV2(ctx)
+	}
+	if err != nil {
+		rlog.Error(err, "unable to list openapi v3 paths")
+		return err
+	}
+	models := map[schema.GroupVersionKind]openapi.Schema{}
+	unavailableGroupVersions := map[schema.GroupVersion]string{}
+	for path, groupVersionDocument := range paths {
+		groupVersion, ok := getPathGroupVersion(path)
+		if !ok {
+			continue
+		}
+		groupVersionModels, err := getGroupVersionModels(groupVersion, groupVersionDocument)
+		if err != nil {
+			rlog.Error(err, "unable to load models, skipping", "groupVersion", groupVersion)
+			unavailableGroupVersions[groupVersion] = err.Error()
+			continue
+		}
+		for gvk, model := range groupVersionModels {
+			models[gvk] = model
+		}
+	}
+	r.setModels(nil, models, unavailableGroupVersions)
+	return nil
+}
+
+// ModelsLoadedCheck is a readiness check reporting whether the models have been loaded
+func (r *CustomResourceDefinitionReconciler) ModelsLoadedCheck(_ *http.Request) error {
+	if !r.loaded.Load() {
+		return errModelsNotLoaded
+	}
+	return nil
+}
+
+// modelLoader loads the models when the manager starts, retrying with a backoff until it succeeds, so that an unavailable API server doesn't prevent the operator from starting.
+// Then it processes the refreshes of the group versions of the changed CRDs and the retries of the unavailable and not yet published group versions.
+// It runs on every replica, as the webhooks are served by all of them.
+type modelLoader struct {
+	reconciler *CustomResourceDefinitionReconciler
+}
+
+var _ manager.LeaderElectionRunnable = &modelLoader{}
+
+func (l *modelLoader) NeedLeaderElection() bool {
+	return false
+}
+
+func (l *modelLoader) Start(ctx context.Context) error {
+	rlog := ctrl.Log.WithName("openapi-model-loader")
+	ctx = log.IntoContext(ctx, rlog)
+	go func() {
+		<-ctx.Done()
+		l.reconciler.refreshes.ShutDown()
+	}()
+	if !l.load(ctx) {
+		return nil
+	}
+	for l.processNextRefresh(ctx) {
+	}
+	return nil
+}
+
+// load loads the models, retrying with a backoff until it succeeds, it returns false if the context is done first
+func (l *modelLoader) load(ctx context.Context) bool {
+	rlog := log.FromContext(ctx)
+	backoff := wait.Backoff{
+		Duration: initialModelLoadBackoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      maxModelLoadBackoff,
+	}
+	for {
+		err := l.reconciler.loadModels(ctx)
+		if err == nil {
+			l.reconciler.loaded.Store(true)
+			l.reconciler.notifyStatusChange()
+			unavailableGroupVersions := l.reconciler.GetUnavailableGroupVersions()
+			rlog.Info("models loaded", "unavailableGroupVersions", len(unavailableGroupVersions))
+			if len(unavailableGroupVersions) > 0 {
+				for groupVersion := range unavailableGroupVersions {
+					l.reconciler.addPendingGroupVersions(groupVersion)
+				}
+				l.reconciler.triggerRetry()
+			}
+			return true
+		}
+		delay := backoff.Step()
+		rlog.Error(err, "unable to load models, retrying", "after", delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// processNextRefresh refreshes the pending group versions when a refresh is queued, the refresh is requeued with a backoff when it fails
+// and after the delay requested by the reconciler otherwise. It returns false when the queue is shut down.
+func (l *modelLoader) processNextRefresh(ctx context.Context) bool {
+	item, shutdown := l.reconciler.refreshes.Get()
+	if shutdown {
+		return false
+	}
+	defer l.reconciler.refreshes.Done(item)
+	result, err := l.reconciler.Reconcile(ctx, item.(reconcile.Request))
+	switch {
+	case err != nil:
+		l.reconciler.refreshes.AddRateLimited(item)
+	case result.RequeueAfter > 0:
+		l.reconciler.refreshes.Forget(item)
+		l.reconciler.refreshes.AddAfter(item, result.RequeueAfter)
+	default:
+		l.reconciler.refreshes.Forget(item)
+	}
+	return true
+}
+
+// loadModelsV2 loads the models from the OpenAPI v2 document, which contains all the group versions
+func (r *CustomResourceDefinitionReconciler) loadModelsV2(ctx context.Context) error {
+	rlog := log.FromContext(ctx)
+	ctx = context.WithValue(ctx, "restConfig", r.restConfig)
+
 	client, err := discoveryclient.GetDiscoveryClient(ctx)
 	if err != nil {
 		rlog.Error(err, "unable to get discovery client")
@@ -111,23 +540,114 @@ func (r *CustomResourceDefinitionReconciler) loadModels(ctx context.Context) err
 		return err
 	}
 
-	r.setModels(openapiModels)
+	r.setModels(nil, indexModels(openapiModels, nil), map[schema.GroupVersion]string{})
 	return nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// refreshGroupVersions fetches the documents of the group versions, the models of the group versions that are not listed by the /openapi/v3 endpoint are removed
+// and these group versions are returned, as they may have been removed or their document may not be published yet.
+// The group versions whose document cannot be loaded are recorded as unavailable, the other ones are refreshed anyway.
+func (r *CustomResourceDefinitionReconciler) refreshGroupVersions(ctx context.Context, groupVersions []schema.GroupVersion) ([]schema.GroupVersion, error) {
+	if r.openAPIV2.Load() {
+		return nil, r.loadModelsV2(ctx)
+	}
+	rlog := log.FromContext(ctx)
+	ctx = context.WithValue(ctx, "restConfig", r.restConfig)
+
+	client, err := discoveryclient.GetDiscoveryClient(ctx)
+	if err != nil {
+		rlog.Error(err, "unable to get discovery client")
+		return nil, err
+	}
+	paths, err := client.OpenAPIV3().Paths()
+	if err != nil {
+		rlog.Error(err, "unable to list openapi v3 paths")
+		return nil, err
+	}
+	models := map[schema.GroupVersionKind]openapi.Schema{}
+	unavailableGroupVersions := map[schema.GroupVersion]string{}
+	missing := []schema.GroupVersion{}
+	for _, groupVersion := range groupVersions {
+		groupVersionDocument, ok := paths[getOpenAPIV3Path(groupVersion)]
+		if !ok {
+			missing = append(missing, groupVersion)
+			continue
+		}
+		groupVersionModels, err := getGroupVersionModels(groupVersion, groupVersionDocument)
+		if err != nil {
+			rlog.Error(err, "unable to load models", "groupVersion", groupVersion)
+			unavailableGroupVersions[groupVersion] = err.Error()
+			continue
+		}
+		for gvk, model := range groupVersionModels {
+			models[gvk] = model
+		}
+	}
+	r.setModels(groupVersions, models, unavailableGroupVersions)
+	return missing, nil
+}
+
+// getGroupVersionModels fetches and parses the OpenAPI v3 document of the group version
+func getGroupVersionModels(groupVersion schema.GroupVersion, groupVersionDocument openapiclient.GroupVersion) (map[schema.GroupVersionKind]openapi.Schema, error) {
+	doc, err := groupVersionDocument.Schema()
+	if err != nil {
+		return nil, err
+	}
+	flattenAllOf(doc)
+	openapiModels, err := openapi.NewOpenAPIV3Data(doc)
+	if err != nil {
+		return nil, err
+	}
+	return indexModels(openapiModels, &groupVersion), nil
+}
+
+// getPathGroupVersion returns the group version of a path listed by the /openapi/v3 endpoint, the paths of non resource endpoints, such as version, are ignored
+func getPathGroupVersion(path string) (schema.GroupVersion, bool) {
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "api":
+		return schema.GroupVersion{Version: parts[1]}, true
+	case len(parts) == 3 && parts[0] == "apis":
+		return schema.GroupVersion{Group: parts[1], Version: parts[2]}, true
+	default:
+		return schema.GroupVersion{}, false
+	}
+}
+
+// enqueueRefresh records the group versions of the CRDs and schedules a refresh.
+// The request is only added once per debounce period, so a burst of CRD events, for example when an operator is installed, results in a single refresh.
+func (r *CustomResourceDefinitionReconciler) enqueueRefresh(objects ...interface{}) {
+	crds := []*apiextension.CustomResourceDefinition{}
+	for _, object := range objects {
+		if tombstone, ok := object.(toolscache.DeletedFinalStateUnknown); ok {
+			object = tombstone.Obj
+		}
+		if crd, ok := object.(*apiextension.CustomResourceDefinition); ok {
+			crds = append(crds, crd)
+		}
+	}
+	r.addPendingGroupVersions(getCRDGroupVersions(crds...)...)
+	r.refreshes.AddAfter(openAPIRefreshRequest, r.debounce)
+}
+
+// SetupWithManager sets up the loading of the models with the Manager.
+// The CRD events are handled by an event handler of the informer, so that the models are refreshed by every replica, the webhooks being served by all of them.
 func (r *CustomResourceDefinitionReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).Named("openapi-watcher").
-		For(&apiextension.CustomResourceDefinition{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
-			return false
-		}))).
-		Watches(&source.Kind{Type: &apiextension.CustomResourceDefinition{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
-			return []reconcile.Request{{
-				NamespacedName: types.NamespacedName{
-					Namespace: "alwaysthesame",
-					Name:      "alwaysthesame",
-				},
-			}}
-		})).
-		Complete(r)
+	informer, err := mgr.GetCache().GetInformer(context.TODO(), &apiextension.CustomResourceDefinition{})
+	if err != nil {
+		return err
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(object interface{}) {
+			r.enqueueRefresh(object)
+		},
+		UpdateFunc: func(oldObject, newObject interface{}) {
+			// versions removed by the update must be refreshed too
+			r.enqueueRefresh(oldObject, newObject)
+		},
+		DeleteFunc: func(object interface{}) {
+			r.enqueueRefresh(object)
+		},
+	})
+	return mgr.Add(&modelLoader{reconciler: r})
 }
@@ -0,0 +1,131 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	apiextension "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+)
+
+func TestGetMissingGroupVersionsRetry(t *testing.T) {
+	r := NewCustomResourceDefinitionReconciler(nil)
+	widgets := schema.GroupVersion{Group: "example.com", Version: "v1"}
+	gadgets := schema.GroupVersion{Group: "example.com", Version: "v2"}
+	expectedDelays := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
+	for i, expected := range expectedDelays {
+		groupVersions := r.takePendingGroupVersions()
+		if i == 0 {
+			groupVersions = []schema.GroupVersion{widgets}
+		}
+		if len(groupVersions) != 1 || groupVersions[0] != widgets {
+			t.Fatalf("attempt %d: expected %s to be pending, got %v", i+1, widgets, groupVersions)
+		}
+		delay := r.getMissingGroupVersionsRetry(groupVersions, []schema.GroupVersion{widgets})
+		if delay != expected {
+			t.Errorf("attempt %d: expected delay %s, got %s", i+1, expected, delay)
+		}
+	}
+	// after the last retry the group version is considered removed
+	if delay := r.getMissingGroupVersionsRetry(r.takePendingGroupVersions(), []schema.GroupVersion{widgets}); delay != 0 {
+		t.Errorf("expected no more retries, got %s", delay)
+	}
+	if pending := r.takePendingGroupVersions(); len(pending) != 0 {
+		t.Errorf("expected no pending group versions, got %v", pending)
+	}
+
+	// a group version listed again is forgotten, the shortest delay is returned
+	r.getMissingGroupVersionsRetry([]schema.GroupVersion{gadgets}, []schema.GroupVersion{gadgets})
+	r.getMissingGroupVersionsRetry([]schema.GroupVersion{gadgets}, []schema.GroupVersion{gadgets})
+	if delay := r.getMissingGroupVersionsRetry([]schema.GroupVersion{widgets, gadgets}, []schema.GroupVersion{widgets, gadgets}); delay != time.Second {
+		t.Errorf("expected the delay of the first retry of %s, got %s", widgets, delay)
+	}
+	if delay := r.getMissingGroupVersionsRetry([]schema.GroupVersion{gadgets}, nil); delay != 0 {
+		t.Errorf("expected no retry, got %s", delay)
+	}
+	if delay := r.getMissingGroupVersionsRetry([]schema.GroupVersion{gadgets}, []schema.GroupVersion{gadgets}); delay != time.Second {
+		t.Errorf("expected the retries of %s to start over, got %s", gadgets, delay)
+	}
+}
+
+func TestMissingModels(t *testing.T) {
+	r := NewCustomResourceDefinitionReconciler(nil)
+	widget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	now := time.Now()
+	if r.isMissingModel(widget, now) {
+		t.Fatalf("expected no missing model before a refresh")
+	}
+	r.setMissingModel(widget, now)
+	if !r.isMissingModel(widget, now.Add(missingModelTTL/2)) {
+		t.Errorf("expected the missing model to be remembered")
+	}
+	if r.isMissingModel(widget, now.Add(missingModelTTL)) {
+		t.Errorf("expected the missing model to expire")
+	}
+	r.setMissingModel(widget, now)
+	r.setModels([]schema.GroupVersion{widget.GroupVersion()}, map[schema.GroupVersionKind]openapi.Schema{widget: &openapi.Kind{}}, map[schema.GroupVersion]string{})
+	if r.isMissingModel(widget, now) {
+		t.Errorf("expected the missing model to be forgotten once its model is loaded")
+	}
+	model, unavailable := r.getModel(widget)
+	if model == nil || unavailable != nil {
+		t.Errorf("expected the model to be found, got %v, %v", model, unavailable)
+	}
+}
+
+func TestEnqueueRefresh(t *testing.T) {
+	r := NewCustomResourceDefinitionReconciler(nil)
+	r.debounce = 0
+	newCRD := func(group string, versions ...string) *apiextension.CustomResourceDefinition {
+		crd := &apiextension.CustomResourceDefinition{Spec: apiextension.CustomResourceDefinitionSpec{Group: group}}
+		for _, version := range versions {
+			crd.Spec.Versions = append(crd.Spec.Versions, apiextension.CustomResourceDefinitionVersion{Name: version})
+		}
+		return crd
+	}
+	// the versions of both the old and new CRDs of an update are refreshed, and the deleted CRDs may only be known by a tombstone
+	r.enqueueRefresh(newCRD("example.com", "v1"), newCRD("example.com", "v2"))
+	r.enqueueRefresh(toolscache.DeletedFinalStateUnknown{Key: "gadgets.example.org", Obj: newCRD("example.org", "v1beta1")})
+	pending := r.takePendingGroupVersions()
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].String() < pending[j].String()
+	})
+	expected := []schema.GroupVersion{{Group: "example.com", Version: "v1"}, {Group: "example.com", Version: "v2"}, {Group: "example.org", Version: "v1beta1"}}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Fatalf("expected %v to be pending, got %v", expected, pending)
+	}
+
+	// the refreshes are queued once and processed by the model loader until the queue is shut down
+	loader := &modelLoader{reconciler: r}
+	if r.refreshes.Len() != 1 {
+		t.Fatalf("expected a single queued refresh, got %d", r.refreshes.Len())
+	}
+	if !loader.processNextRefresh(context.TODO()) {
+		t.Fatalf("expected the queued refresh to be processed")
+	}
+	r.refreshes.ShutDown()
+	if loader.processNextRefresh(context.TODO()) {
+		t.Errorf("expected no refresh to be processed once the queue is shut down")
+	}
+}
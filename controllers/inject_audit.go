@@ -0,0 +1,109 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patchedByAnnotation records the hash of the templates of the patches injected in the object and when they were injected
+const patchedByAnnotation string = "redhat-cop.redhat.io/patched-by"
+
+// the keys of the audit annotations of the injection responses, the api server prefixes them with the name of the webhook
+const (
+	patchesAuditAnnotation        = "patches"
+	patchTypesAuditAnnotation     = "patch-types"
+	patchHashAuditAnnotation      = "patch-hash"
+	lookupsAuditAnnotation        = "lookups"
+	injectionErrorAuditAnnotation = "injection-error"
+)
+
+// patchedBy is the value of the patched-by annotation
+type patchedBy struct {
+	TemplateHash string `json:"templateHash"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// getLookupDescription returns the lookup call as it would appear in a template
+func getLookupDescription(apiversion string, kind string, namespace string, name string) string {
+	return "lookup " + strconv.Quote(apiversion) + " " + strconv.Quote(kind) + " " + strconv.Quote(namespace) + " " + strconv.Quote(name)
+}
+
+// getTemplateHash returns a hash of the templates of the patches, unlike the patch hash it doesn't depend on the result of the lookups
+func getTemplateHash(patches []injectedPatch) string {
+	hash := sha256.New()
+	for i := range patches {
+		if i > 0 {
+			hash.Write([]byte("\n"))
+		}
+		hash.Write([]byte(patches[i].key + "\n" + string(patches[i].patchType) + "\n"))
+		hash.Write([]byte(patches[i].template))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// getPatchedBy returns the value of the patched-by annotation for the injected patches.
+// current is the value the object already has, it is kept when the patches didn't change the object and their templates are the same, so that re-injecting patches on updates doesn't turn every update into a change.
+func getPatchedBy(patches []injectedPatch, current string, changed bool) (string, error) {
+	templateHash := getTemplateHash(patches)
+	if !changed && current != "" {
+		currentPatchedBy := patchedBy{}
+		if err := json.Unmarshal([]byte(current), &currentPatchedBy); err == nil && currentPatchedBy.TemplateHash == templateHash {
+			return current, nil
+		}
+	}
+	value, err := json.Marshal(patchedBy{
+		TemplateHash: templateHash,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// getAuditAnnotations returns the audit annotations describing the injected patches: their keys and types in the order in which they were applied, their hash and the lookups performed by their templates
+func getAuditAnnotations(patches []injectedPatch, patchHash string) map[string]string {
+	keys := []string{}
+	patchTypes := []string{}
+	lookups := []string{}
+	seen := map[string]bool{}
+	for i := range patches {
+		keys = append(keys, patches[i].key)
+		patchTypes = append(patchTypes, string(patches[i].patchType))
+		for _, lookup := range patches[i].lookups {
+			if !seen[lookup] {
+				seen[lookup] = true
+				lookups = append(lookups, lookup)
+			}
+		}
+	}
+	annotations := map[string]string{
+		patchesAuditAnnotation:    strings.Join(keys, ","),
+		patchTypesAuditAnnotation: strings.Join(patchTypes, ","),
+		patchHashAuditAnnotation:  patchHash,
+	}
+	if len(lookups) > 0 {
+		annotations[lookupsAuditAnnotation] = strings.Join(lookups, "; ")
+	}
+	return annotations
+}
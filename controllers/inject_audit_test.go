@@ -0,0 +1,201 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetAuditAnnotations(t *testing.T) {
+	lookup := getLookupDescription("v1", "ConfigMap", "default", "settings")
+	otherLookup := getLookupDescription("v1", "Secret", "default", "credentials")
+	tests := []struct {
+		name     string
+		patches  []injectedPatch
+		expected map[string]string
+	}{
+		{
+			name:    "no patches",
+			patches: []injectedPatch{},
+			expected: map[string]string{
+				patchesAuditAnnotation:    "",
+				patchTypesAuditAnnotation: "",
+				patchHashAuditAnnotation:  "hash",
+			},
+		},
+		{
+			name: "patches without lookups",
+			patches: []injectedPatch{
+				{key: "InjectionPolicy/a", patchType: strategicMergePatch},
+				{key: patchKey, patchType: jsonPatch},
+			},
+			expected: map[string]string{
+				patchesAuditAnnotation:    "InjectionPolicy/a," + patchKey,
+				patchTypesAuditAnnotation: string(strategicMergePatch) + "," + string(jsonPatch),
+				patchHashAuditAnnotation:  "hash",
+			},
+		},
+		{
+			name: "lookups are deduplicated in order",
+			patches: []injectedPatch{
+				{key: patchKey, patchType: mergePatch, lookups: []string{lookup, otherLookup, lookup}},
+				{key: patchKey + ".1", patchType: mergePatch, lookups: []string{otherLookup}},
+			},
+			expected: map[string]string{
+				patchesAuditAnnotation:    patchKey + "," + patchKey + ".1",
+				patchTypesAuditAnnotation: string(mergePatch) + "," + string(mergePatch),
+				patchHashAuditAnnotation:  "hash",
+				lookupsAuditAnnotation:    `lookup "v1" "ConfigMap" "default" "settings"; lookup "v1" "Secret" "default" "credentials"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := getAuditAnnotations(tt.patches, "hash")
+			if !reflect.DeepEqual(annotations, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, annotations)
+			}
+		})
+	}
+}
+
+func TestGetTemplateHash(t *testing.T) {
+	base := []injectedPatch{
+		{key: patchKey, patchType: strategicMergePatch, template: "metadata:\n  labels:\n    a: b\n"},
+		{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n"},
+	}
+	hash := getTemplateHash(base)
+	if len(hash) != 64 {
+		t.Fatalf("expected a hex encoded sha256, got %q", hash)
+	}
+	same := []injectedPatch{
+		{key: patchKey, patchType: strategicMergePatch, template: "metadata:\n  labels:\n    a: b\n", rendered: []byte(`{"metadata":{"labels":{"a":"b"}}}`)},
+		{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n", lookups: []string{getLookupDescription("v1", "ConfigMap", "default", "settings")}},
+	}
+	if getTemplateHash(same) != hash {
+		t.Errorf("expected the hash not to depend on the rendered patches and the lookups")
+	}
+	tests := []struct {
+		name    string
+		patches []injectedPatch
+	}{
+		{
+			name: "different template",
+			patches: []injectedPatch{
+				{key: patchKey, patchType: strategicMergePatch, template: "metadata:\n  labels:\n    a: c\n"},
+				{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n"},
+			},
+		},
+		{
+			name: "different key",
+			patches: []injectedPatch{
+				{key: patchKey + ".1", patchType: strategicMergePatch, template: "metadata:\n  labels:\n    a: b\n"},
+				{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n"},
+			},
+		},
+		{
+			name: "different patch type",
+			patches: []injectedPatch{
+				{key: patchKey, patchType: mergePatch, template: "metadata:\n  labels:\n    a: b\n"},
+				{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n"},
+			},
+		},
+		{
+			name: "different order",
+			patches: []injectedPatch{
+				{key: "InjectionPolicy/a", patchType: mergePatch, template: "data:\n  a: b\n"},
+				{key: patchKey, patchType: strategicMergePatch, template: "metadata:\n  labels:\n    a: b\n"},
+			},
+		},
+		{
+			name:    "fewer patches",
+			patches: base[:1],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if getTemplateHash(tt.patches) == hash {
+				t.Errorf("expected a different hash")
+			}
+		})
+	}
+}
+
+func TestGetPatchedBy(t *testing.T) {
+	patches := []injectedPatch{{key: patchKey, patchType: mergePatch, template: "data:\n  a: b\n"}}
+	current := `{"templateHash":"` + getTemplateHash(patches) + `","timestamp":"2000-01-01T00:00:00Z"}`
+	tests := []struct {
+		name     string
+		current  string
+		changed  bool
+		expected string
+	}{
+		{
+			name:    "not stamped yet",
+			changed: true,
+		},
+		{
+			name:    "not stamped yet and unchanged",
+			changed: false,
+		},
+		{
+			name:     "same templates, object unchanged",
+			current:  current,
+			expected: current,
+		},
+		{
+			name:    "same templates, object changed",
+			current: current,
+			changed: true,
+		},
+		{
+			name:    "templates changed",
+			current: `{"templateHash":"other","timestamp":"2000-01-01T00:00:00Z"}`,
+		},
+		{
+			name:    "invalid current value",
+			current: "invalid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := getPatchedBy(patches, tt.current, tt.changed)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expected != "" {
+				if value != tt.expected {
+					t.Errorf("expected %s to be kept, got %s", tt.expected, value)
+				}
+				return
+			}
+			parsed := patchedBy{}
+			if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+				t.Fatalf("unable to parse %q: %v", value, err)
+			}
+			if parsed.TemplateHash != getTemplateHash(patches) {
+				t.Errorf("expected template hash %s, got %s", getTemplateHash(patches), parsed.TemplateHash)
+			}
+			if timestamp, err := time.Parse(time.RFC3339, parsed.Timestamp); err != nil || timestamp.Year() == 2000 {
+				t.Errorf("expected a new RFC3339 timestamp, got %q", parsed.Timestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// allowed values one of "keep", "remove", "replace-with-hash". Default "keep"
+const patchCleanupAnnotation string = "redhat-cop.redhat.io/patch-cleanup"
+
+type PatchCleanup string
+
+const (
+	keepPatchCleanup            PatchCleanup = "keep"
+	removePatchCleanup          PatchCleanup = "remove"
+	replaceWithHashPatchCleanup PatchCleanup = "replace-with-hash"
+)
+
+// patchMarkerPrefix prefixes the hash that replaces the template of a patch annotation
+const patchMarkerPrefix = "sha256:"
+
+// patchMarkerRegexp matches the values of the patch annotations whose template has been replaced by its hash
+var patchMarkerRegexp = regexp.MustCompile("^" + patchMarkerPrefix + "[0-9a-f]{64}$")
+
+// getPatchCleanup returns what to do with the patch annotations once the patches are injected
+func getPatchCleanup(annotations map[string]string) (PatchCleanup, error) {
+	cleanup := PatchCleanup(annotations[patchCleanupAnnotation])
+	switch cleanup {
+	case "":
+		return keepPatchCleanup, nil
+	case keepPatchCleanup, removePatchCleanup, replaceWithHashPatchCleanup:
+		return cleanup, nil
+	default:
+		return "", errors.New("unsupported value of annotation " + patchCleanupAnnotation + ": " + string(cleanup))
+	}
+}
+
+// getPatchMarker returns the value replacing the template of a patch annotation, it only changes when the template changes
+func getPatchMarker(template string) string {
+	hash := sha256.Sum256([]byte(template))
+	return patchMarkerPrefix + hex.EncodeToString(hash[:])
+}
+
+// isPatchMarker returns whether the value of a patch annotation is the hash of a template that has been cleaned up
+func isPatchMarker(value string) bool {
+	return patchMarkerRegexp.MatchString(value)
+}
+
+// cleanupPatchAnnotations removes or replaces with their hash the templates of the patch annotations of the object, the patches defined by policies and templates are ignored.
+// Returns whether the object changed.
+func cleanupPatchAnnotations(obj *unstructured.Unstructured, patches []injectedPatch, cleanup PatchCleanup) bool {
+	if cleanup == keepPatchCleanup {
+		return false
+	}
+	annotations := obj.GetAnnotations()
+	changed := false
+	for i := range patches {
+		if patches[i].key != patchKey && !strings.HasPrefix(patches[i].key, patchKey+".") {
+			continue
+		}
+		if _, ok := annotations[patches[i].key]; !ok {
+			continue
+		}
+		switch cleanup {
+		case removePatchCleanup:
+			delete(annotations, patches[i].key)
+		case replaceWithHashPatchCleanup:
+			annotations[patches[i].key] = getPatchMarker(patches[i].template)
+		}
+		changed = true
+	}
+	if changed {
+		obj.SetAnnotations(annotations)
+	}
+	return changed
+}
+
+// cleanupResponse returns the response admitting the object without injecting any patch, the patch annotations it carries are cleaned up anyway.
+// This happens for example when a GitOps tool applies the object again after the patch has been injected.
+func cleanupResponse(original []byte, obj *unstructured.Unstructured, patches []injectedPatch, cleanup PatchCleanup, reason string) admission.Response {
+	cleaned := obj.DeepCopy()
+	if !cleanupPatchAnnotations(cleaned, patches, cleanup) {
+		return admission.Allowed(reason)
+	}
+	patched, err := cleaned.MarshalJSON()
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to marshal", "object", cleaned)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(original, patched)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCleanupPatchAnnotations(t *testing.T) {
+	template := "metadata:\n  labels:\n    a: b\n"
+	numberedTemplate := "data:\n  a: b\n"
+	annotations := map[string]string{
+		patchKey:                       template,
+		patchKey + ".1":                numberedTemplate,
+		patchTypeAnnotation + ".1":     string(mergePatch),
+		patchTemplateRefAnnotation:     "default/template",
+		patchCleanupAnnotation:         "remove",
+		"example.com/other-annotation": "value",
+	}
+	patches := []injectedPatch{
+		{key: "InjectionPolicy/a", template: "data:\n  b: c\n"},
+		{key: patchTemplateRefAnnotation, template: "data:\n  c: d\n"},
+		{key: patchKey, template: template},
+		{key: patchKey + ".1", template: numberedTemplate},
+		// not carried by the object, for example when the object is re-applied without it
+		{key: patchKey + ".2", template: "data:\n  d: e\n"},
+	}
+	untouched := map[string]string{
+		patchTypeAnnotation + ".1":     string(mergePatch),
+		patchTemplateRefAnnotation:     "default/template",
+		patchCleanupAnnotation:         "remove",
+		"example.com/other-annotation": "value",
+	}
+	tests := []struct {
+		name            string
+		cleanup         PatchCleanup
+		patches         []injectedPatch
+		expectedChanged bool
+		expected        map[string]string
+	}{
+		{
+			name:            "keep",
+			cleanup:         keepPatchCleanup,
+			patches:         patches,
+			expectedChanged: false,
+			expected:        annotations,
+		},
+		{
+			name:            "remove",
+			cleanup:         removePatchCleanup,
+			patches:         patches,
+			expectedChanged: true,
+			expected:        untouched,
+		},
+		{
+			name:            "replace with hash",
+			cleanup:         replaceWithHashPatchCleanup,
+			patches:         patches,
+			expectedChanged: true,
+			expected: mergeAnnotations(untouched, map[string]string{
+				patchKey:        getPatchMarker(template),
+				patchKey + ".1": getPatchMarker(numberedTemplate),
+			}),
+		},
+		{
+			name:            "only patches defined by policies and templates",
+			cleanup:         removePatchCleanup,
+			patches:         patches[:2],
+			expectedChanged: false,
+			expected:        annotations,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{}
+			obj.SetAnnotations(mergeAnnotations(annotations, nil))
+			changed := cleanupPatchAnnotations(obj, tt.patches, tt.cleanup)
+			if changed != tt.expectedChanged {
+				t.Errorf("expected changed %t, got %t", tt.expectedChanged, changed)
+			}
+			if !reflect.DeepEqual(obj.GetAnnotations(), tt.expected) {
+				t.Errorf("expected annotations %v, got %v", tt.expected, obj.GetAnnotations())
+			}
+		})
+	}
+}
+
+func TestPatchMarker(t *testing.T) {
+	marker := getPatchMarker("data:\n  a: b\n")
+	if !isPatchMarker(marker) {
+		t.Errorf("expected %q to be a patch marker", marker)
+	}
+	if marker != getPatchMarker("data:\n  a: b\n") {
+		t.Errorf("expected the marker to be stable")
+	}
+	if marker == getPatchMarker("data:\n  a: c\n") {
+		t.Errorf("expected the marker to change with the template")
+	}
+	for _, value := range []string{"data:\n  a: b\n", patchMarkerPrefix, marker[:len(marker)-1], marker + "0", "sha512:" + marker[len(patchMarkerPrefix):]} {
+		if isPatchMarker(value) {
+			t.Errorf("expected %q not to be a patch marker", value)
+		}
+	}
+}
+
+func TestGetPatchCleanup(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    PatchCleanup
+		expectedErr bool
+	}{
+		{value: "", expected: keepPatchCleanup},
+		{value: "keep", expected: keepPatchCleanup},
+		{value: "remove", expected: removePatchCleanup},
+		{value: "replace-with-hash", expected: replaceWithHashPatchCleanup},
+		{value: "Remove", expectedErr: true},
+		{value: "hash", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tt.value != "" {
+				annotations[patchCleanupAnnotation] = tt.value
+			}
+			cleanup, err := getPatchCleanup(annotations)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cleanup != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, cleanup)
+			}
+		})
+	}
+}
+
+// mergeAnnotations returns a copy of the annotations with the overrides applied
+func mergeAnnotations(annotations map[string]string, overrides map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// the stages of the rendering of a template
+const (
+	parseStage   = "parse"
+	executeStage = "execute"
+	convertStage = "convert"
+)
+
+// patchInjectionFailedReason is the reason of the events recorded when a patch could not be injected
+const patchInjectionFailedReason = "PatchInjectionFailed"
+
+// modelsNotLoadedRetryAfterSeconds is suggested to the clients whose requests are rejected because the models are not loaded yet or their group version is unavailable
+const modelsNotLoadedRetryAfterSeconds = 5
+
+var (
+	// text/template errors look like: template: <name>:<line>[:<column>]: [executing "<name>" at <<expression>>: ]<reason>
+	templateErrorRegexp = regexp.MustCompile(`(?s)^template: [^:]*:(\d+)(?::(\d+))?: (?:executing "[^"]*" at <(.*?)>: )?(.*)$`)
+	// yaml errors look like: yaml: line <line>: <reason>
+	yamlErrorRegexp = regexp.MustCompile(`(?s)^(?:error converting YAML to JSON: )?yaml: line (\d+): (.*)$`)
+)
+
+// templateError is an error rendering the template of an injected patch, it locates the error in the template
+type templateError struct {
+	// key identifies the patch, see injectedPatch
+	key string
+	// stage is the rendering step that failed, one of parse, execute, convert
+	stage string
+	// line and column of the error, 0 when unknown. Convert errors refer to the lines of the rendered patch.
+	line   int
+	column int
+	// expression is the template expression that failed, for example a lookup call
+	expression string
+	reason     string
+	err        error
+}
+
+// newTemplateError parses the error returned by the passed rendering stage of the template of the patch
+func newTemplateError(key string, stage string, err error) *templateError {
+	te := &templateError{
+		key:    key,
+		stage:  stage,
+		reason: err.Error(),
+		err:    err,
+	}
+	if matches := templateErrorRegexp.FindStringSubmatch(err.Error()); matches != nil {
+		te.line, _ = strconv.Atoi(matches[1])
+		te.column, _ = strconv.Atoi(matches[2])
+		te.expression = matches[3]
+		te.reason = matches[4]
+	} else if matches := yamlErrorRegexp.FindStringSubmatch(err.Error()); matches != nil {
+		te.line, _ = strconv.Atoi(matches[1])
+		te.reason = matches[2]
+	}
+	return te
+}
+
+// location returns the position of the error, as in "line 3, column 12"
+func (e *templateError) location() string {
+	location := []string{}
+	if e.line > 0 {
+		line := "line " + strconv.Itoa(e.line)
+		if e.stage == convertStage {
+			line += " of the rendered patch"
+		}
+		location = append(location, line)
+	}
+	if e.column > 0 {
+		location = append(location, "column "+strconv.Itoa(e.column))
+	}
+	return strings.Join(location, ", ")
+}
+
+// description returns the error without the patch key
+func (e *templateError) description() string {
+	message := "unable to " + e.stage + " template"
+	if location := e.location(); location != "" {
+		message += " at " + location
+	}
+	if e.expression != "" {
+		message += " evaluating " + e.expression
+	}
+	return message + ": " + e.reason
+}
+
+func (e *templateError) Error() string {
+	return e.key + ": " + e.description()
+}
+
+func (e *templateError) Unwrap() error {
+	return e.err
+}
+
+// field returns the path of the annotation holding the template, empty when the patch is not defined by an annotation
+func (e *templateError) field() string {
+	if strings.HasPrefix(e.key, patchKey) || e.key == patchTemplateRefAnnotation {
+		return "metadata.annotations[" + e.key + "]"
+	}
+	return ""
+}
+
+// injectionErrorResponse returns the response rejecting the admission request because the patch could not be injected.
+// Template errors are reported as invalid objects, with the failing annotation as cause.
+func injectionErrorResponse(err error) admission.Response {
+	unavailable := &groupVersionUnavailableError{}
+	if errors.Is(err, errModelsNotLoaded) || errors.As(err, &unavailable) {
+		// the models are loaded shortly after startup and the unavailable group versions are fetched again periodically, clients retry requests rejected as service unavailable
+		return admission.Response{
+			AdmissionResponse: admissionv1.AdmissionResponse{
+				Allowed: false,
+				Result: &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Code:    http.StatusServiceUnavailable,
+					Reason:  metav1.StatusReasonServiceUnavailable,
+					Message: err.Error(),
+					Details: &metav1.StatusDetails{
+						RetryAfterSeconds: modelsNotLoadedRetryAfterSeconds,
+					},
+				},
+			},
+		}
+	}
+	te := &templateError{}
+	if !errors.As(err, &te) {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.Response{
+		AdmissionResponse: admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusUnprocessableEntity,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: te.Error(),
+				Details: &metav1.StatusDetails{
+					Causes: []metav1.StatusCause{{
+						Type:    metav1.CauseTypeFieldValueInvalid,
+						Field:   te.field(),
+						Message: te.description(),
+					}},
+				},
+			},
+		},
+	}
+}
+
+// injectionFailed returns the response to the admission request on which a patch could not be injected.
+// In fail open mode the object is admitted unchanged with a warning and an event is recorded in its namespace, otherwise the request is rejected.
+func (a *PatchInjector) injectionFailed(ctx context.Context, req *admission.Request, obj *unstructured.Unstructured, err error) admission.Response {
+	if !a.getOptions().FailOpen {
+		return injectionErrorResponse(err)
+	}
+	log.FromContext(ctx).Info("admitting object without patches", "kind", req.Kind, "namespace", req.Namespace, "name", req.Name, "error", err.Error())
+	if a.recorder != nil {
+		// on creation the object may have neither a name, when it is generated, nor a namespace, when it is taken from the request.
+		// The name is the prefix of the name of the events, so the trailing dash of generated names is removed.
+		involvedObject := obj.DeepCopy()
+		if involvedObject.GetName() == "" {
+			involvedObject.SetName(strings.TrimRight(involvedObject.GetGenerateName(), "-"))
+		}
+		if involvedObject.GetNamespace() == "" {
+			involvedObject.SetNamespace(req.Namespace)
+		}
+		a.recorder.Event(involvedObject, corev1.EventTypeWarning, patchInjectionFailedReason, "patch not injected: "+err.Error())
+	}
+	response := admission.Allowed("patch not injected").WithWarnings("patch not injected: " + err.Error())
+	response.AuditAnnotations = map[string]string{injectionErrorAuditAnnotation: err.Error()}
+	return response
+}
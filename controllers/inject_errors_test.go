@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestNewTemplateError(t *testing.T) {
+	failingLookup := func(apiversion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+		return nil, errors.New("configmaps \"" + name + "\" is forbidden")
+	}
+	tests := []struct {
+		name               string
+		key                string
+		template           string
+		expectedStage      string
+		expectedLine       int
+		expectedColumn     int
+		expectedExpression string
+		expectedReason     string
+		expectedField      string
+		expectedError      string
+	}{
+		{
+			name:           "parse error",
+			key:            patchKey,
+			template:       "metadata:\n  labels:\n    a: {{ .Object.metadata.name \n",
+			expectedStage:  parseStage,
+			expectedLine:   4,
+			expectedReason: "unclosed action started at " + patchKey + ":3",
+			expectedField:  "metadata.annotations[" + patchKey + "]",
+			expectedError:  patchKey + ": unable to parse template at line 4: unclosed action started at " + patchKey + ":3",
+		},
+		{
+			name:           "parse error of an undefined function",
+			key:            patchKey + ".1",
+			template:       "metadata:\n  labels:\n    a: {{ undefined }}\n",
+			expectedStage:  parseStage,
+			expectedLine:   3,
+			expectedReason: `function "undefined" not defined`,
+			expectedField:  "metadata.annotations[" + patchKey + ".1]",
+			expectedError:  patchKey + ".1: unable to parse template at line 3: function \"undefined\" not defined",
+		},
+		{
+			name:               "execute error",
+			key:                patchKey,
+			template:           "metadata:\n  labels:\n    a: {{ index .Object.metadata.labels 1 }}\n",
+			expectedStage:      executeStage,
+			expectedLine:       3,
+			expectedColumn:     10,
+			expectedExpression: "index .Object.metadata.labels 1",
+			expectedReason:     "error calling index: value has type int; should be string",
+			expectedField:      "metadata.annotations[" + patchKey + "]",
+		},
+		{
+			name:               "execute error of a lookup",
+			key:                "InjectionPolicy/test",
+			template:           "data:\n  a: {{ (lookup \"v1\" \"ConfigMap\" \"default\" \"secret\").data.a }}\n",
+			expectedStage:      executeStage,
+			expectedLine:       2,
+			expectedColumn:     9,
+			expectedExpression: `lookup "v1" "ConfigMap" "default" "secret"`,
+			expectedReason:     `error calling lookup: configmaps "secret" is forbidden`,
+			expectedField:      "",
+			expectedError:      `InjectionPolicy/test: unable to execute template at line 2, column 9 evaluating lookup "v1" "ConfigMap" "default" "secret": error calling lookup: configmaps "secret" is forbidden`,
+		},
+		{
+			name:           "convert error",
+			key:            patchTemplateRefAnnotation,
+			template:       "metadata:\n  labels:\n    a: b\n   c: d\n",
+			expectedStage:  convertStage,
+			expectedLine:   3,
+			expectedReason: "did not find expected key",
+			expectedField:  "metadata.annotations[" + patchTemplateRefAnnotation + "]",
+			expectedError:  patchTemplateRefAnnotation + ": unable to convert template at line 3 of the rendered patch: did not find expected key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := &injectedPatch{
+				key:       tt.key,
+				template:  tt.template,
+				patchType: mergePatch,
+			}
+			funcs := template.FuncMap{"lookup": failingLookup}
+			_, err := renderAndInjectPatch([]byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"test","labels":{"a":"b"}}}`), patch, funcs, nil)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			te := &templateError{}
+			if !errors.As(err, &te) {
+				t.Fatalf("expected a template error, got %v", err)
+			}
+			if te.stage != tt.expectedStage {
+				t.Errorf("expected stage %s, got %s", tt.expectedStage, te.stage)
+			}
+			if te.line != tt.expectedLine || te.column != tt.expectedColumn {
+				t.Errorf("expected line %d column %d, got line %d column %d", tt.expectedLine, tt.expectedColumn, te.line, te.column)
+			}
+			if te.expression != tt.expectedExpression {
+				t.Errorf("expected expression %q, got %q", tt.expectedExpression, te.expression)
+			}
+			if !strings.HasPrefix(te.reason, tt.expectedReason) {
+				t.Errorf("expected reason %q, got %q", tt.expectedReason, te.reason)
+			}
+			if te.field() != tt.expectedField {
+				t.Errorf("expected field %q, got %q", tt.expectedField, te.field())
+			}
+			if tt.expectedError != "" && te.Error() != tt.expectedError {
+				t.Errorf("expected error %q, got %q", tt.expectedError, te.Error())
+			}
+			if errors.Unwrap(te) == nil {
+				t.Errorf("expected the original error to be wrapped")
+			}
+		})
+	}
+}
+
+func TestNewTemplateErrorUnknownFormat(t *testing.T) {
+	err := errors.New("something else went wrong")
+	te := newTemplateError(patchKey, executeStage, err)
+	if te.line != 0 || te.column != 0 || te.expression != "" {
+		t.Errorf("expected no location, got line %d column %d expression %q", te.line, te.column, te.expression)
+	}
+	if te.reason != err.Error() {
+		t.Errorf("expected reason %q, got %q", err.Error(), te.reason)
+	}
+	if te.Error() != patchKey+": unable to execute template: something else went wrong" {
+		t.Errorf("unexpected error %q", te.Error())
+	}
+}
@@ -3,19 +3,30 @@ package controllers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
-	"github.com/redhat-cop/operator-utils/pkg/util/discoveryclient"
 	utilstemplate "github.com/redhat-cop/operator-utils/pkg/util/templates"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
 	v1authn "k8s.io/api/authentication/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/cache"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -28,6 +39,7 @@ const patchKey string = "redhat-cop.redhat.io/patch"
 type PatchType string
 
 // allowed values one of "application/json-patch+json"'"application/merge-patch+json","application/strategic-merge-patch+json".  Default "application/strategic-merge-patch+json"
+// patches defined by numbered annotations, redhat-cop.redhat.io/patch.<n>, have their type in redhat-cop.redhat.io/patch-type.<n>
 const patchTypeAnnotation string = "redhat-cop.redhat.io/patch-type"
 
 const (
@@ -36,6 +48,20 @@ const (
 	strategicMergePatch PatchType = "application/strategic-merge-patch+json"
 )
 
+// allowed values one of "create", "update", "always". Default "create"
+const patchOnAnnotation string = "redhat-cop.redhat.io/patch-on"
+
+// patchHashAnnotation records the hash of the last injected patch, when the patch can be injected on updates
+const patchHashAnnotation string = "redhat-cop.redhat.io/patch-hash"
+
+type PatchOn string
+
+const (
+	createPatchOn PatchOn = "create"
+	updatePatchOn PatchOn = "update"
+	alwaysPatchOn PatchOn = "always"
+)
+
 var createTimePatchLog = logf.Log.WithName("create-time-patch-webhook")
 
 // podAnnotator annotates Pods
@@ -45,16 +71,59 @@ type PatchInjector struct {
 	restConfig *rest.Config
 	decoder    *admission.Decoder
 	crr        *CustomResourceDefinitionReconciler
+	recorder   record.EventRecorder
+	// impersonations caches the rest configs and clients impersonating the users issuing the admission requests
+	impersonations *cache.LRUExpireCache
+	// options can be changed at runtime by the PatchOperatorConfig
+	optionsLock sync.RWMutex
+	options     PatchInjectorOptions
 }
 
-func NewPatchInjector(client client.Client, restConfig *rest.Config, customResourceDefinitionReconciler *CustomResourceDefinitionReconciler) *PatchInjector {
+// PatchInjectorOptions configure the behavior of the creation time injection
+// +kubebuilder:object:generate:=false
+type PatchInjectorOptions struct {
+	// FailOpen admits the objects on which the patches cannot be injected unchanged, instead of rejecting them
+	FailOpen bool
+	// PatchedByAnnotation stamps the patched objects with the redhat-cop.redhat.io/patched-by annotation
+	PatchedByAnnotation bool
+}
+
+func NewPatchInjector(client client.Client, restConfig *rest.Config, customResourceDefinitionReconciler *CustomResourceDefinitionReconciler, recorder record.EventRecorder, options PatchInjectorOptions) *PatchInjector {
 	return &PatchInjector{
-		client:     client,
-		restConfig: restConfig,
-		crr:        customResourceDefinitionReconciler,
+		client:         client,
+		restConfig:     restConfig,
+		crr:            customResourceDefinitionReconciler,
+		recorder:       recorder,
+		impersonations: cache.NewLRUExpireCache(impersonationCacheSize),
+		options:        options,
 	}
 }
 
+// SetupWithManager registers the informers of the objects read at admission time, so they are served by the manager's cache from its start
+func (a *PatchInjector) SetupWithManager(mgr ctrl.Manager) error {
+	for _, obj := range []client.Object{&redhatcopv1alpha1.InjectionPolicy{}, &corev1.Namespace{}} {
+		_, err := mgr.GetCache().GetInformer(context.TODO(), obj)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOptions returns the options currently in effect
+func (a *PatchInjector) getOptions() PatchInjectorOptions {
+	a.optionsLock.RLock()
+	defer a.optionsLock.RUnlock()
+	return a.options
+}
+
+// SetFailOpen changes the behavior of the injection when a patch cannot be injected, it applies to the admission requests received from now on
+func (a *PatchInjector) SetFailOpen(failOpen bool) {
+	a.optionsLock.Lock()
+	defer a.optionsLock.Unlock()
+	a.options.FailOpen = failOpen
+}
+
 // podAnnotator adds an annotation to every incoming pods.
 func (a *PatchInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
 	ctx = context.WithValue(ctx, "restConfig", a.restConfig)
@@ -66,119 +135,377 @@ func (a *PatchInjector) Handle(ctx context.Context, req admission.Request) admis
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	for key := range obj.GetAnnotations() {
-		if key == patchKey {
-			//compute the template
+	// the patches of the matching injection policies are applied first
+	patches, err := a.getPolicyPatches(ctx, &req, obj)
+	if err != nil {
+		return a.injectionFailed(ctx, &req, obj, err)
+	}
 
-			templ, err := template.New(obj.GetAnnotations()[patchKey]).Funcs(a.advancedTemplateFuncMapWithImpersonation(ctx, &req.UserInfo)).Parse(obj.GetAnnotations()[patchKey])
+	annotationPatches, err := getInjectedPatches(obj.GetAnnotations())
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	cleanup, err := getPatchCleanup(obj.GetAnnotations())
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if _, ok := obj.GetAnnotations()[patchTemplateRefAnnotation]; ok || len(annotationPatches) > 0 {
+		patchOn := PatchOn(obj.GetAnnotations()[patchOnAnnotation])
+		inject, err := shouldInject(patchOn, req.Operation)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if inject {
+			// the patch defined by the referenced template is applied before the annotations, so that they can refine it
+			referencedPatch, err := a.getReferencedPatch(ctx, &req.UserInfo, obj.GetAnnotations())
 			if err != nil {
-				createTimePatchLog.Error(err, "unable to parse ", "template", obj.GetAnnotations()[patchKey])
-				return admission.Errored(http.StatusInternalServerError, err)
+				if a.getOptions().FailOpen {
+					return a.injectionFailed(ctx, &req, obj, err)
+				}
+				return admission.Errored(getErrorCode(err), err)
 			}
+			if referencedPatch != nil {
+				annotationPatches = append([]injectedPatch{*referencedPatch}, annotationPatches...)
+			}
+			for i := range annotationPatches {
+				annotationPatches[i].onUpdate = patchOn == updatePatchOn || patchOn == alwaysPatchOn
+			}
+			patches = append(patches, annotationPatches...)
+		}
+	}
+	if len(patches) == 0 {
+		return cleanupResponse(req.Object.Raw, obj, annotationPatches, cleanup, "no changes")
+	}
+	if !redhatcopv1alpha1.IsAllowedTarget(obj.GroupVersionKind()) {
+		return a.injectionFailed(ctx, &req, obj, errors.New("kind "+obj.GroupVersionKind().String()+" is not an allowed target of the operator"))
+	}
 
-			var b bytes.Buffer
-			err = templ.Execute(&b, obj)
-			if err != nil {
-				createTimePatchLog.Error(err, "unable to process ", "template ", templ, "parameters", obj)
-				return admission.Errored(http.StatusInternalServerError, err)
+	// the templates are first all rendered against the admitted object, their hash identifies the injected patches.
+	// json patches may not be idempotent, so on updates they are not applied at all if the rendered patches didn't change since the last injection.
+	// The other patches are always injected again, so that they are restored when the update reverts them.
+	renderedPatches := make([]injectedPatch, len(patches))
+	copy(renderedPatches, patches)
+	for i := range renderedPatches {
+		err = a.renderPatch(ctx, &req.UserInfo, obj, &renderedPatches[i])
+		if err != nil {
+			recordInjection(renderedPatches[i].patchType, injectionError)
+			return a.injectionFailed(ctx, &req, obj, getInjectedPatchError(&renderedPatches[i], err))
+		}
+	}
+	patchHash := getInjectedPatchHash(renderedPatches)
+	if req.Operation == admissionv1.Update && obj.GetAnnotations()[patchHashAnnotation] == patchHash && hasJSONPatch(patches) {
+		for i := range patches {
+			recordInjection(patches[i].patchType, injectionUnchanged)
+		}
+		return cleanupResponse(req.Object.Raw, obj, annotationPatches, cleanup, "patch already injected")
+	}
+
+	// the patches are applied in sequence, each template receives the object as patched by the previous ones
+	patchedObject := req.Object.Raw
+	results := []string{}
+	for i := range patches {
+		previousObject := patchedObject
+		patchedObject, err = a.injectPatch(ctx, &req.UserInfo, previousObject, &patches[i])
+		if err != nil {
+			recordInjection(patches[i].patchType, injectionError)
+			return a.injectionFailed(ctx, &req, obj, getInjectedPatchError(&patches[i], err))
+		}
+		if jsonpatch.Equal(previousObject, patchedObject) {
+			results = append(results, injectionUnchanged)
+		} else {
+			results = append(results, injectionPatched)
+		}
+	}
+	for i := range patches {
+		recordInjection(patches[i].patchType, results[i])
+	}
+	return a.injectionResponse(req.Object.Raw, patchedObject, patches, patchHash, cleanup)
+}
+
+// getInjectedPatchError prefixes the error with the key of the patch, template errors already identify the patch
+func getInjectedPatchError(patch *injectedPatch, err error) error {
+	te := &templateError{}
+	if errors.As(err, &te) {
+		return err
+	}
+	return fmt.Errorf("%s: %w", patch.key, err)
+}
+
+// injectedPatch is a patch defined by an injection policy, a referenced template or the annotations of the object being admitted
+type injectedPatch struct {
+	// key is the annotation holding the patch template
+	key       string
+	template  string
+	patchType PatchType
+	// order is the number suffixed to the annotation, -1 for the unnumbered patch
+	order int
+	// parameters are the values of the parameters of a referenced template, returned by the param template function
+	parameters map[string]string
+	// onUpdate is whether the patch is injected on updates too
+	onUpdate bool
+	// rendered is the result of the template, as json
+	rendered []byte
+	// lookups are the lookups performed by the template, see getLookupDescription
+	lookups []string
+}
+
+// getInjectedPatches returns the patches defined by the annotations in the order in which they are applied:
+// redhat-cop.redhat.io/patch first, then the redhat-cop.redhat.io/patch.<n> annotations by increasing n.
+// The type of each patch is defined by the matching redhat-cop.redhat.io/patch-type or redhat-cop.redhat.io/patch-type.<n> annotation.
+func getInjectedPatches(annotations map[string]string) ([]injectedPatch, error) {
+	patches := []injectedPatch{}
+	for key, value := range annotations {
+		// the template of the patch has been replaced by its hash after a previous injection, see cleanupPatchAnnotations
+		if isPatchMarker(value) {
+			continue
+		}
+		patch := injectedPatch{
+			key:      key,
+			template: value,
+			order:    -1,
+		}
+		patchTypeKey := patchTypeAnnotation
+		if key != patchKey {
+			suffix := strings.TrimPrefix(key, patchKey+".")
+			if suffix == key {
+				continue
+			}
+			order, err := strconv.Atoi(suffix)
+			if err != nil || order < 0 {
+				return nil, errors.New("invalid patch annotation " + key + ", the suffix must be a non-negative integer")
 			}
+			patch.order = order
+			patchTypeKey = patchTypeAnnotation + "." + suffix
+		}
+		patch.patchType = strategicMergePatch
+		if patchType, ok := annotations[patchTypeKey]; ok {
+			patch.patchType = PatchType(patchType)
+		}
+		patches = append(patches, patch)
+	}
+	sort.Slice(patches, func(i, j int) bool {
+		if patches[i].order != patches[j].order {
+			return patches[i].order < patches[j].order
+		}
+		return patches[i].key < patches[j].key
+	})
+	return patches, nil
+}
+
+// injectPatch renders the template of the patch with the passed object as parameter and applies the result to the object.
+// The rendered patch is stored in the injected patch.
+func (a *PatchInjector) injectPatch(ctx context.Context, userInfo *v1authn.UserInfo, original []byte, patch *injectedPatch) ([]byte, error) {
+	funcs := a.advancedTemplateFuncMapWithImpersonation(ctx, userInfo)
+	return renderAndInjectPatch(original, patch, funcs, func(obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, error) {
+		return a.getPatchMeta(ctx, obj)
+	})
+}
+
+// renderPatch renders the template of the patch with the passed object as parameter, without applying it.
+// The rendered patch is stored in the injected patch.
+func (a *PatchInjector) renderPatch(ctx context.Context, userInfo *v1authn.UserInfo, obj *unstructured.Unstructured, patch *injectedPatch) error {
+	return renderInjectedPatch(obj, patch, a.advancedTemplateFuncMapWithImpersonation(ctx, userInfo))
+}
+
+// patchMetaGetter returns the strategic merge patch metadata of the kind of the object
+type patchMetaGetter func(obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, error)
+
+// renderAndInjectPatch renders the template of the patch with the passed functions and the object as parameter, then applies the result to the object.
+// It is shared by the webhook and the render command, which pass the functions and patch metadata of a cluster or of local objects.
+func renderAndInjectPatch(original []byte, patch *injectedPatch, funcs template.FuncMap, getPatchMeta patchMetaGetter) ([]byte, error) {
+	obj := &unstructured.Unstructured{}
+	err := obj.UnmarshalJSON(original)
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to unmarshal", "object", string(original))
+		return nil, err
+	}
+	err = renderInjectedPatch(obj, patch, funcs)
+	if err != nil {
+		return nil, err
+	}
+	return applyPatch(original, obj, patch.rendered, patch.patchType, getPatchMeta)
+}
 
-			bb, err := yaml.YAMLToJSON(b.Bytes())
+// renderInjectedPatch renders the template of the patch with the passed functions and the object as parameter, the result is stored in the patch as json
+func renderInjectedPatch(obj *unstructured.Unstructured, patch *injectedPatch, funcs template.FuncMap) error {
+	if patch.parameters != nil {
+		funcs[redhatcopv1alpha1.ParamTemplateFunction] = getParamFunction(patch.parameters)
+	}
+	// the lookups are recorded for the audit annotations
+	patch.lookups = nil
+	if lookup, ok := funcs["lookup"].(func(string, string, string, string) (map[string]interface{}, error)); ok {
+		funcs["lookup"] = func(apiversion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+			patch.lookups = append(patch.lookups, getLookupDescription(apiversion, kind, namespace, name))
+			return lookup(apiversion, kind, namespace, name)
+		}
+	}
+	// the template is named after the patch key, which is how the template errors refer to it
+	templ, err := template.New(patch.key).Funcs(funcs).Parse(patch.template)
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to parse ", "template", patch.template)
+		return newTemplateError(patch.key, parseStage, err)
+	}
 
+	var b bytes.Buffer
+	err = templ.Execute(&b, obj)
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to process ", "template ", patch.template, "parameters", obj)
+		return newTemplateError(patch.key, executeStage, err)
+	}
+
+	bb, err := yaml.YAMLToJSON(b.Bytes())
+
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to convert to json", "processed template", b.String())
+		return newTemplateError(patch.key, convertStage, err)
+	}
+	patch.rendered = bb
+	return nil
+}
+
+// applyPatch applies the json patch of the passed type to the object, original is the object as json
+func applyPatch(original []byte, obj *unstructured.Unstructured, bb []byte, patchType PatchType, getPatchMeta patchMetaGetter) ([]byte, error) {
+	switch patchType {
+	case jsonPatch:
+		{
+			decodedPatch, err := jsonpatch.DecodePatch(bb)
 			if err != nil {
-				createTimePatchLog.Error(err, "unable to convert to json", "processed template", b.String())
-				return admission.Errored(http.StatusInternalServerError, err)
-			}
-			patchType, ok := obj.GetAnnotations()[patchTypeAnnotation]
-			if !ok {
-				patchType = "application/strategic-merge-patch+json"
+				createTimePatchLog.Error(err, "unable to decode", "jsonpatch", string(bb))
+				return nil, err
 			}
 
-			switch PatchType(patchType) {
-			case jsonPatch:
-				{
-					patch, err := jsonpatch.DecodePatch(bb)
-					if err != nil {
-						createTimePatchLog.Error(err, "unable to decode", "jsonpatch", string(bb))
-						return admission.Errored(http.StatusInternalServerError, err)
-					}
-
-					patchedObject, err := patch.Apply(req.Object.Raw)
-					if err != nil {
-						createTimePatchLog.Error(err, "unable patch object", "original", req.Object.Raw, "patch", string(bb))
-						return admission.Errored(http.StatusInternalServerError, err)
-					}
-					return admission.PatchResponseFromRaw(req.Object.Raw, patchedObject)
-				}
-			case mergePatch:
-				{
-					patchedObject, err := jsonpatch.MergePatch(req.Object.Raw, bb)
-					if err != nil {
-						createTimePatchLog.Error(err, "unable patch object", "original", req.Object.Raw, "patch", string(bb))
-						return admission.Errored(http.StatusInternalServerError, err)
-					}
-					return admission.PatchResponseFromRaw(req.Object.Raw, patchedObject)
-				}
-			case strategicMergePatch:
-				{
-					patchMeta, err := a.getPatchMeta(ctx, obj)
-					if err != nil {
-						createTimePatchLog.Error(err, "unable to get patchMeta", "for object", obj)
-						return admission.Errored(http.StatusInternalServerError, err)
-					}
-					patchedObject, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(req.Object.Raw, bb, patchMeta)
-					if err != nil {
-						createTimePatchLog.Error(err, "unable to get patch", "object", obj, "with patch", bb, "patch type", patchType)
-						return admission.Errored(http.StatusInternalServerError, err)
-					}
-					return admission.PatchResponseFromRaw(req.Object.Raw, patchedObject)
-				}
-			default:
-				{
-					err := errors.New("unsupported patch type" + patchType)
-					return admission.Errored(http.StatusInternalServerError, err)
-				}
+			patchedObject, err := decodedPatch.Apply(original)
+			if err != nil {
+				createTimePatchLog.Error(err, "unable patch object", "original", original, "patch", string(bb))
+				return nil, err
+			}
+			return patchedObject, nil
+		}
+	case mergePatch:
+		{
+			patchedObject, err := jsonpatch.MergePatch(original, bb)
+			if err != nil {
+				createTimePatchLog.Error(err, "unable patch object", "original", original, "patch", string(bb))
+				return nil, err
+			}
+			return patchedObject, nil
+		}
+	case strategicMergePatch:
+		{
+			patchMeta, err := getPatchMeta(obj)
+			if err != nil {
+				createTimePatchLog.Error(err, "unable to get patchMeta", "for object", obj)
+				return nil, err
+			}
+			patchedObject, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(original, bb, patchMeta)
+			if err != nil {
+				createTimePatchLog.Error(err, "unable to get patch", "object", obj, "with patch", bb, "patch type", patchType)
+				return nil, err
 			}
+			return patchedObject, nil
+		}
+	default:
+		{
+			return nil, errors.New("unsupported patch type " + string(patchType))
 		}
 	}
-	return admission.Allowed("no changes")
 }
 
-func getModelName(apiresource *metav1.APIResource) string {
-	var group, version string
-	if apiresource.Group == "" {
-		group = "io.k8s.api.core"
-	} else {
-		if !strings.Contains(apiresource.Group, ".") {
-			group = "io.k8s.api." + apiresource.Group
-		} else {
-			group = apiresource.Group
+// shouldInject returns whether the patch must be injected for the operation of the admission request
+func shouldInject(patchOn PatchOn, operation admissionv1.Operation) (bool, error) {
+	switch patchOn {
+	case "", createPatchOn:
+		return operation == admissionv1.Create, nil
+	case updatePatchOn:
+		return operation == admissionv1.Update, nil
+	case alwaysPatchOn:
+		return operation == admissionv1.Create || operation == admissionv1.Update, nil
+	default:
+		return false, errors.New("unsupported value of annotation " + patchOnAnnotation + ": " + string(patchOn))
+	}
+}
+
+// hasJSONPatch returns whether any of the patches is a json patch
+func hasJSONPatch(patches []injectedPatch) bool {
+	for i := range patches {
+		if patches[i].patchType == jsonPatch {
+			return true
 		}
 	}
+	return false
+}
 
-	if apiresource.Version == "" {
-		version = "v1"
-	} else {
-		version = apiresource.Version
+// getInjectedPatchHash returns a hash of the rendered patches, it changes when the templates or the result of their lookups change
+func getInjectedPatchHash(patches []injectedPatch) string {
+	hash := sha256.New()
+	for i := range patches {
+		if i > 0 {
+			hash.Write([]byte("\n"))
+		}
+		hash.Write([]byte(string(patches[i].patchType) + "\n"))
+		hash.Write(patches[i].rendered)
 	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
 
-	return group + "." + version + "." + apiresource.Kind
+// injectionResponse returns the response patching the original object, with audit annotations describing the injected patches.
+// When any of the patches can be injected again on updates the hash of the patches is recorded in the patched object, and when configured the object is stamped with the patched-by annotation.
+// The patched-by annotation is only refreshed when the patches changed the object or their templates changed.
+// The patch annotations are then cleaned up as requested by the object.
+func (a *PatchInjector) injectionResponse(original []byte, patched []byte, patches []injectedPatch, patchHash string, cleanup PatchCleanup) admission.Response {
+	annotations := map[string]string{}
+	for i := range patches {
+		if patches[i].onUpdate {
+			annotations[patchHashAnnotation] = patchHash
+		}
+	}
+	stampPatchedBy := a.getOptions().PatchedByAnnotation
+	if len(annotations) > 0 || stampPatchedBy || cleanup != keepPatchCleanup {
+		patchedObj := &unstructured.Unstructured{}
+		err := patchedObj.UnmarshalJSON(patched)
+		if err != nil {
+			createTimePatchLog.Error(err, "unable to unmarshal", "patched object", string(patched))
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		objAnnotations := patchedObj.GetAnnotations()
+		if objAnnotations == nil {
+			objAnnotations = map[string]string{}
+		}
+		if stampPatchedBy {
+			value, err := getPatchedBy(patches, objAnnotations[patchedByAnnotation], !jsonpatch.Equal(original, patched))
+			if err != nil {
+				createTimePatchLog.Error(err, "unable to compute", "annotation", patchedByAnnotation)
+				return admission.Errored(http.StatusInternalServerError, err)
+			}
+			annotations[patchedByAnnotation] = value
+		}
+		for key, value := range annotations {
+			objAnnotations[key] = value
+		}
+		patchedObj.SetAnnotations(objAnnotations)
+		cleanupPatchAnnotations(patchedObj, patches, cleanup)
+		patched, err = patchedObj.MarshalJSON()
+		if err != nil {
+			createTimePatchLog.Error(err, "unable to marshal", "patched object", patchedObj)
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+	}
+	response := admission.PatchResponseFromRaw(original, patched)
+	response.AuditAnnotations = getAuditAnnotations(patches, patchHash)
+	return response
 }
 
 func (a *PatchInjector) getPatchMeta(context context.Context, obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, error) {
 	log := log.FromContext(context)
-	resource, found, err := discoveryclient.GetAPIResourceForGVK(context, obj.GroupVersionKind())
+	openapiSchema, err := a.crr.GetModel(context, obj.GroupVersionKind())
 	if err != nil {
-		log.Error(err, "unable to find resource from", "GVK", obj.GroupVersionKind())
+		log.Error(err, "unable to get model of", "GVK", obj.GroupVersionKind())
 		return nil, err
 	}
-	if !found {
+	if openapiSchema == nil {
 		return nil, errors.New("GVK not found: " + obj.GroupVersionKind().String())
 	}
-	openapiModels := a.crr.GetModels()
-	log.V(1).Info("getPatchMeta", "getModelName(resource)", getModelName(resource))
-	openapiSchema := openapiModels.LookupModel(getModelName(resource))
-	return strategicpatch.NewPatchMetaFromOpenAPI(openapiSchema), nil
+	return newPatchMetaFromOpenAPI(openapiSchema), nil
 }
 
 // InjectDecoder injects the decoder.
@@ -188,7 +515,80 @@ func (a *PatchInjector) InjectDecoder(d *admission.Decoder) error {
 }
 
 func (a *PatchInjector) advancedTemplateFuncMapWithImpersonation(ctx context.Context, userInfo *v1authn.UserInfo) template.FuncMap {
-	rc := rest.CopyConfig(a.restConfig)
+	funcs := utilstemplate.AdvancedTemplateFuncMap(a.getImpersonatingRestConfig(userInfo), createTimePatchLog)
+	return funcs
+}
+
+// impersonationCacheSize and impersonationCacheTTL bound the impersonating rest configs and clients kept across admission requests
+const (
+	impersonationCacheSize = 256
+	impersonationCacheTTL  = 10 * time.Minute
+)
+
+// impersonation holds the rest config impersonating a user and the client built from it, which is created on first use
+type impersonation struct {
+	restConfig *rest.Config
+	clientLock sync.Mutex
+	client     client.Client
+}
+
+// getImpersonation returns the impersonation of the user issuing the admission request, it is built once per user and reused until it expires
+func (a *PatchInjector) getImpersonation(userInfo *v1authn.UserInfo) *impersonation {
+	key := getImpersonationKey(userInfo)
+	if cached, ok := a.impersonations.Get(key); ok {
+		return cached.(*impersonation)
+	}
+	imp := &impersonation{
+		restConfig: newImpersonatingRestConfig(a.restConfig, userInfo),
+	}
+	a.impersonations.Add(key, imp, impersonationCacheTTL)
+	return imp
+}
+
+// getImpersonatingRestConfig returns a rest config impersonating the user issuing the admission request
+func (a *PatchInjector) getImpersonatingRestConfig(userInfo *v1authn.UserInfo) *rest.Config {
+	return a.getImpersonation(userInfo).restConfig
+}
+
+// getImpersonatingClient returns a client impersonating the user issuing the admission request
+func (a *PatchInjector) getImpersonatingClient(userInfo *v1authn.UserInfo) (client.Client, error) {
+	imp := a.getImpersonation(userInfo)
+	imp.clientLock.Lock()
+	defer imp.clientLock.Unlock()
+	if imp.client == nil {
+		impersonatingClient, err := client.New(imp.restConfig, client.Options{Scheme: a.client.Scheme(), Mapper: a.client.RESTMapper()})
+		if err != nil {
+			return nil, err
+		}
+		imp.client = impersonatingClient
+	}
+	return imp.client, nil
+}
+
+// getImpersonationKey returns a key identifying the impersonated user, groups and extra values
+func getImpersonationKey(userInfo *v1authn.UserInfo) string {
+	extraKeys := make([]string, 0, len(userInfo.Extra))
+	for k := range userInfo.Extra {
+		extraKeys = append(extraKeys, k)
+	}
+	sort.Strings(extraKeys)
+	var b strings.Builder
+	b.WriteString(strconv.Quote(userInfo.Username))
+	for _, group := range userInfo.Groups {
+		b.WriteString("\ng:" + strconv.Quote(group))
+	}
+	for _, k := range extraKeys {
+		b.WriteString("\ne:" + strconv.Quote(k))
+		for _, v := range userInfo.Extra[k] {
+			b.WriteString("," + strconv.Quote(v))
+		}
+	}
+	return b.String()
+}
+
+// newImpersonatingRestConfig returns a copy of the rest config impersonating the user
+func newImpersonatingRestConfig(restConfig *rest.Config, userInfo *v1authn.UserInfo) *rest.Config {
+	rc := rest.CopyConfig(restConfig)
 	rc.Impersonate.UserName = userInfo.Username
 	rc.Impersonate.Groups = userInfo.Groups
 	extra := map[string][]string{}
@@ -196,6 +596,5 @@ func (a *PatchInjector) advancedTemplateFuncMapWithImpersonation(ctx context.Con
 		extra[k] = userInfo.Extra[k]
 	}
 	rc.Impersonate.Extra = extra
-	funcs := utilstemplate.AdvancedTemplateFuncMap(rc, createTimePatchLog)
-	return funcs
+	return rc
 }
@@ -0,0 +1,409 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1authn "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestGetInjectedPatches(t *testing.T) {
+	type expectedPatch struct {
+		key       string
+		template  string
+		patchType PatchType
+		order     int
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []expectedPatch
+		expectedErr bool
+	}{
+		{
+			name:        "no patch annotations",
+			annotations: map[string]string{"app": "test", patchOnAnnotation: "always"},
+			expected:    []expectedPatch{},
+		},
+		{
+			name:        "unnumbered patch defaults to strategic merge patch",
+			annotations: map[string]string{patchKey: "metadata: {}"},
+			expected:    []expectedPatch{{key: patchKey, template: "metadata: {}", patchType: strategicMergePatch, order: -1}},
+		},
+		{
+			name: "unnumbered patch with its type",
+			annotations: map[string]string{
+				patchKey:            `[{"op": "add", "path": "/metadata/labels/a", "value": "b"}]`,
+				patchTypeAnnotation: string(jsonPatch),
+			},
+			expected: []expectedPatch{{key: patchKey, template: `[{"op": "add", "path": "/metadata/labels/a", "value": "b"}]`, patchType: jsonPatch, order: -1}},
+		},
+		{
+			name: "numbered patches ordered by number after the unnumbered one, each with its own type",
+			annotations: map[string]string{
+				patchKey + ".10":           "ten",
+				patchKey + ".2":            "two",
+				patchKey:                   "unnumbered",
+				patchTypeAnnotation + ".2": string(mergePatch),
+				patchTypeAnnotation:        string(jsonPatch),
+			},
+			expected: []expectedPatch{
+				{key: patchKey, template: "unnumbered", patchType: jsonPatch, order: -1},
+				{key: patchKey + ".2", template: "two", patchType: mergePatch, order: 2},
+				{key: patchKey + ".10", template: "ten", patchType: strategicMergePatch, order: 10},
+			},
+		},
+		{
+			name: "other annotations of the operator ignored",
+			annotations: map[string]string{
+				patchKey:                   "unnumbered",
+				patchOnAnnotation:          "update",
+				patchHashAnnotation:        "0123",
+				patchCleanupAnnotation:     "remove",
+				patchTemplateRefAnnotation: "template",
+			},
+			expected: []expectedPatch{{key: patchKey, template: "unnumbered", patchType: strategicMergePatch, order: -1}},
+		},
+		{
+			name: "templates replaced by their hash ignored",
+			annotations: map[string]string{
+				patchKey:        getPatchMarker("unnumbered"),
+				patchKey + ".1": "one",
+			},
+			expected: []expectedPatch{{key: patchKey + ".1", template: "one", patchType: strategicMergePatch, order: 1}},
+		},
+		{
+			name:        "non numeric suffix",
+			annotations: map[string]string{patchKey + ".first": "first"},
+			expectedErr: true,
+		},
+		{
+			name:        "negative suffix",
+			annotations: map[string]string{patchKey + ".-1": "minus one"},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches, err := getInjectedPatches(tt.annotations)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", patches)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(patches) != len(tt.expected) {
+				t.Fatalf("expected %d patches, got %d: %+v", len(tt.expected), len(patches), patches)
+			}
+			for i, expected := range tt.expected {
+				actual := expectedPatch{key: patches[i].key, template: patches[i].template, patchType: patches[i].patchType, order: patches[i].order}
+				if actual != expected {
+					t.Errorf("expected patch %d to be %+v, got %+v", i, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestHasJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patches  []injectedPatch
+		expected bool
+	}{
+		{name: "no patches"},
+		{name: "merge patches only", patches: []injectedPatch{{patchType: mergePatch}, {patchType: strategicMergePatch}}},
+		{name: "one json patch", patches: []injectedPatch{{patchType: strategicMergePatch}, {patchType: jsonPatch}}, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := hasJSONPatch(tt.patches); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestShouldInject(t *testing.T) {
+	tests := []struct {
+		patchOn     PatchOn
+		operation   admissionv1.Operation
+		expected    bool
+		expectedErr bool
+	}{
+		{patchOn: "", operation: admissionv1.Create, expected: true},
+		{patchOn: "", operation: admissionv1.Update, expected: false},
+		{patchOn: createPatchOn, operation: admissionv1.Create, expected: true},
+		{patchOn: createPatchOn, operation: admissionv1.Update, expected: false},
+		{patchOn: updatePatchOn, operation: admissionv1.Create, expected: false},
+		{patchOn: updatePatchOn, operation: admissionv1.Update, expected: true},
+		{patchOn: alwaysPatchOn, operation: admissionv1.Create, expected: true},
+		{patchOn: alwaysPatchOn, operation: admissionv1.Update, expected: true},
+		{patchOn: alwaysPatchOn, operation: admissionv1.Delete, expected: false},
+		{patchOn: alwaysPatchOn, operation: admissionv1.Connect, expected: false},
+		{patchOn: "Always", operation: admissionv1.Create, expectedErr: true},
+		{patchOn: "never", operation: admissionv1.Update, expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.patchOn)+"/"+string(tt.operation), func(t *testing.T) {
+			inject, err := shouldInject(tt.patchOn, tt.operation)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if inject != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, inject)
+			}
+		})
+	}
+}
+
+func TestGetImpersonation(t *testing.T) {
+	injector := NewPatchInjector(nil, &rest.Config{Host: "https://example.com"}, nil, nil, PatchInjectorOptions{})
+	user := &v1authn.UserInfo{
+		Username: "alice",
+		Groups:   []string{"dev", "system:authenticated"},
+		Extra:    map[string]v1authn.ExtraValue{"scopes": {"a", "b"}},
+	}
+	config := injector.getImpersonatingRestConfig(user)
+	if config.Impersonate.UserName != "alice" || len(config.Impersonate.Groups) != 2 || len(config.Impersonate.Extra["scopes"]) != 2 {
+		t.Fatalf("unexpected impersonation config: %+v", config.Impersonate)
+	}
+	if injector.restConfig.Impersonate.UserName != "" {
+		t.Fatalf("the base rest config was modified")
+	}
+	sameUser := &v1authn.UserInfo{
+		Username: "alice",
+		Groups:   []string{"dev", "system:authenticated"},
+		Extra:    map[string]v1authn.ExtraValue{"scopes": {"a", "b"}},
+	}
+	if injector.getImpersonatingRestConfig(sameUser) != config {
+		t.Errorf("expected the impersonation of the same user to be reused")
+	}
+	others := []*v1authn.UserInfo{
+		{Username: "bob", Groups: user.Groups, Extra: user.Extra},
+		{Username: "alice", Groups: []string{"dev"}, Extra: user.Extra},
+		{Username: "alice", Groups: user.Groups, Extra: map[string]v1authn.ExtraValue{"scopes": {"a"}}},
+		{Username: "alice", Groups: user.Groups},
+	}
+	for _, other := range others {
+		if injector.getImpersonatingRestConfig(other) == config {
+			t.Errorf("expected a different impersonation for %+v", other)
+		}
+	}
+}
+
+// applyResponse applies the patches of an admission response to the object
+func applyResponse(t *testing.T, object []byte, response admission.Response) []byte {
+	if len(response.Patches) == 0 {
+		return object
+	}
+	operations, err := json.Marshal(response.Patches)
+	if err != nil {
+		t.Fatalf("unable to marshal the patches: %v", err)
+	}
+	patch, err := jsonpatch.DecodePatch(operations)
+	if err != nil {
+		t.Fatalf("unable to decode the patches: %v", err)
+	}
+	patched, err := patch.Apply(object)
+	if err != nil {
+		t.Fatalf("unable to apply the patches: %v", err)
+	}
+	return patched
+}
+
+// newTestPatchInjector returns a patch injector backed by a fake client
+func newTestPatchInjector(t *testing.T, options PatchInjectorOptions) *PatchInjector {
+	t.Helper()
+	testScheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(testScheme); err != nil {
+		t.Fatalf("unable to build the scheme: %v", err)
+	}
+	if err := redhatcopv1alpha1.AddToScheme(testScheme); err != nil {
+		t.Fatalf("unable to build the scheme: %v", err)
+	}
+	decoder, err := admission.NewDecoder(testScheme)
+	if err != nil {
+		t.Fatalf("unable to build the decoder: %v", err)
+	}
+	injector := NewPatchInjector(fake.NewClientBuilder().WithScheme(testScheme).Build(), &rest.Config{Host: "https://example.com"}, nil, nil, options)
+	if err := injector.InjectDecoder(decoder); err != nil {
+		t.Fatalf("unable to inject the decoder: %v", err)
+	}
+	return injector
+}
+
+// newTestConfigMapRequest returns the admission request of the test/test ConfigMap
+func newTestConfigMapRequest(operation admissionv1.Operation, object []byte) admission.Request {
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: operation,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Namespace: "test",
+		Name:      "test",
+		Object:    runtime.RawExtension{Raw: object},
+	}}
+}
+
+func TestHandleJSONPatchOnUpdate(t *testing.T) {
+	injector := newTestPatchInjector(t, PatchInjectorOptions{})
+	configMap := []byte(`{
+		"apiVersion": "v1",
+		"kind": "ConfigMap",
+		"metadata": {
+			"name": "test",
+			"namespace": "test",
+			"annotations": {
+				"redhat-cop.redhat.io/patch": "- op: remove\n  path: /data/foo\n",
+				"redhat-cop.redhat.io/patch-type": "application/json-patch+json",
+				"redhat-cop.redhat.io/patch-on": "always"
+			}
+		},
+		"data": {"foo": "bar", "baz": "qux"}
+	}`)
+
+	response := injector.Handle(context.TODO(), newTestConfigMapRequest(admissionv1.Create, configMap))
+	if !response.Allowed {
+		t.Fatalf("expected the creation to be allowed, got %+v", response.Result)
+	}
+	created := &unstructured.Unstructured{}
+	if err := created.UnmarshalJSON(applyResponse(t, configMap, response)); err != nil {
+		t.Fatalf("unable to unmarshal the created object: %v", err)
+	}
+	if _, found, _ := unstructured.NestedString(created.Object, "data", "foo"); found {
+		t.Fatalf("expected data.foo to be removed, got %+v", created.Object["data"])
+	}
+	if created.GetAnnotations()[patchHashAnnotation] == "" {
+		t.Fatalf("expected the patch hash to be recorded, got %+v", created.GetAnnotations())
+	}
+
+	// the updates following the injection don't apply the remove patch again, which would fail
+	unstructured.SetNestedField(created.Object, "quux", "data", "baz")
+	updated, err := created.MarshalJSON()
+	if err != nil {
+		t.Fatalf("unable to marshal the updated object: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		response = injector.Handle(context.TODO(), newTestConfigMapRequest(admissionv1.Update, updated))
+		if !response.Allowed {
+			t.Fatalf("expected update %d to be allowed, got %+v", i, response.Result)
+		}
+		if len(response.Patches) != 0 {
+			t.Fatalf("expected update %d not to be patched, got %+v", i, response.Patches)
+		}
+		updated = applyResponse(t, updated, response)
+	}
+}
+
+func TestHandlePatchedByOnUpdate(t *testing.T) {
+	injector := newTestPatchInjector(t, PatchInjectorOptions{PatchedByAnnotation: true})
+	configMap := []byte(`{
+		"apiVersion": "v1",
+		"kind": "ConfigMap",
+		"metadata": {
+			"name": "test",
+			"namespace": "test",
+			"annotations": {
+				"redhat-cop.redhat.io/patch": "data:\n  foo: patched\n",
+				"redhat-cop.redhat.io/patch-type": "application/merge-patch+json",
+				"redhat-cop.redhat.io/patch-on": "always"
+			}
+		},
+		"data": {"foo": "bar"}
+	}`)
+	response := injector.Handle(context.TODO(), newTestConfigMapRequest(admissionv1.Create, configMap))
+	if !response.Allowed {
+		t.Fatalf("expected the creation to be allowed, got %+v", response.Result)
+	}
+	created := &unstructured.Unstructured{}
+	if err := created.UnmarshalJSON(applyResponse(t, configMap, response)); err != nil {
+		t.Fatalf("unable to unmarshal the created object: %v", err)
+	}
+	stamped := patchedBy{}
+	if err := json.Unmarshal([]byte(created.GetAnnotations()[patchedByAnnotation]), &stamped); err != nil {
+		t.Fatalf("expected the created object to be stamped, got %+v", created.GetAnnotations())
+	}
+
+	// the timestamp is set in the past, so that a refresh is noticed
+	stamped.Timestamp = "2000-01-01T00:00:00Z"
+	previous, err := json.Marshal(stamped)
+	if err != nil {
+		t.Fatalf("unable to marshal the patched-by annotation: %v", err)
+	}
+	annotations := created.GetAnnotations()
+	annotations[patchedByAnnotation] = string(previous)
+	created.SetAnnotations(annotations)
+	getPatchedByOfUpdate := func(update func(*unstructured.Unstructured)) string {
+		t.Helper()
+		obj := created.DeepCopy()
+		update(obj)
+		object, err := obj.MarshalJSON()
+		if err != nil {
+			t.Fatalf("unable to marshal the updated object: %v", err)
+		}
+		response := injector.Handle(context.TODO(), newTestConfigMapRequest(admissionv1.Update, object))
+		if !response.Allowed {
+			t.Fatalf("expected the update to be allowed, got %+v", response.Result)
+		}
+		updated := &unstructured.Unstructured{}
+		if err := updated.UnmarshalJSON(applyResponse(t, object, response)); err != nil {
+			t.Fatalf("unable to unmarshal the updated object: %v", err)
+		}
+		return updated.GetAnnotations()[patchedByAnnotation]
+	}
+
+	// an update that the patch leaves untouched keeps the stamp
+	value := getPatchedByOfUpdate(func(obj *unstructured.Unstructured) {
+		unstructured.SetNestedField(obj.Object, "qux", "data", "baz")
+	})
+	if value != string(previous) {
+		t.Errorf("expected the patched-by annotation to be kept, got %s", value)
+	}
+
+	// an update reverted by the patch refreshes the stamp
+	value = getPatchedByOfUpdate(func(obj *unstructured.Unstructured) {
+		unstructured.SetNestedField(obj.Object, "bar", "data", "foo")
+	})
+	refreshed := patchedBy{}
+	if err := json.Unmarshal([]byte(value), &refreshed); err != nil {
+		t.Fatalf("unable to parse the patched-by annotation %q: %v", value, err)
+	}
+	if refreshed.TemplateHash != stamped.TemplateHash || refreshed.Timestamp == stamped.Timestamp {
+		t.Errorf("expected the patched-by annotation to be refreshed, got %s", value)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// getPolicyPatches returns the patches of the injection policies matching the admission request, in the order in which they are applied.
+// The policies and the namespaces are read from the manager's cache, see SetupWithManager.
+func (a *PatchInjector) getPolicyPatches(ctx context.Context, req *admission.Request, obj *unstructured.Unstructured) ([]injectedPatch, error) {
+	policies := &redhatcopv1alpha1.InjectionPolicyList{}
+	err := a.client.List(ctx, policies)
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to list injection policies")
+		return nil, err
+	}
+	matcher := &injectionPolicyMatcher{
+		client: a.client,
+		req:    req,
+		obj:    obj,
+	}
+	matchingPolicies := []redhatcopv1alpha1.InjectionPolicy{}
+	for i := range policies.Items {
+		matches, err := matcher.matches(ctx, &policies.Items[i])
+		if err != nil {
+			createTimePatchLog.Error(err, "unable to evaluate injection policy", "policy", policies.Items[i].Name)
+			return nil, err
+		}
+		if matches {
+			matchingPolicies = append(matchingPolicies, policies.Items[i])
+		}
+	}
+	sort.Slice(matchingPolicies, func(i, j int) bool {
+		if matchingPolicies[i].Spec.Priority != matchingPolicies[j].Spec.Priority {
+			return matchingPolicies[i].Spec.Priority < matchingPolicies[j].Spec.Priority
+		}
+		return matchingPolicies[i].Name < matchingPolicies[j].Name
+	})
+	patches := []injectedPatch{}
+	for _, policy := range matchingPolicies {
+		patchType := strategicMergePatch
+		if policy.Spec.PatchType != "" {
+			patchType = PatchType(policy.Spec.PatchType)
+		}
+		patches = append(patches, injectedPatch{
+			key:       "InjectionPolicy/" + policy.Name,
+			template:  policy.Spec.Template,
+			patchType: patchType,
+			order:     -1,
+			onUpdate:  hasOperation(policy.Spec.GetOperations(), redhatcopv1alpha1.UpdateInjectionOperation),
+		})
+	}
+	return patches, nil
+}
+
+// injectionPolicyMatcher evaluates injection policies against an admission request, the labels of the namespace of the object are read at most once
+type injectionPolicyMatcher struct {
+	client          client.Client
+	req             *admission.Request
+	obj             *unstructured.Unstructured
+	namespaceLabels labels.Set
+}
+
+func (m *injectionPolicyMatcher) matches(ctx context.Context, policy *redhatcopv1alpha1.InjectionPolicy) (bool, error) {
+	match := &policy.Spec.Match
+	if !hasOperation(policy.Spec.GetOperations(), redhatcopv1alpha1.InjectionOperation(m.req.Operation)) {
+		return false, nil
+	}
+	if !m.matchesKind(match.Kinds) {
+		return false, nil
+	}
+	objectSelector, err := metav1.LabelSelectorAsSelector(match.ObjectSelector)
+	if err != nil {
+		return false, err
+	}
+	if !objectSelector.Matches(labels.Set(m.obj.GetLabels())) {
+		return false, nil
+	}
+	if match.NamespaceSelector == nil {
+		return true, nil
+	}
+	namespaceSelector, err := metav1.LabelSelectorAsSelector(match.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+	namespaceLabels, selectable, err := m.getNamespaceLabels(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !selectable || namespaceSelector.Matches(namespaceLabels), nil
+}
+
+func (m *injectionPolicyMatcher) matchesKind(kinds []redhatcopv1alpha1.KindSelector) bool {
+	for _, kind := range kinds {
+		if kind.Matches(schema.GroupVersionKind(m.req.Kind)) {
+			return true
+		}
+	}
+	return false
+}
+
+// getNamespaceLabels returns the labels against which the namespace selector is evaluated: the labels of the namespace of the object, or of the object itself if it is a namespace.
+// Other cluster-scoped objects are not selectable by namespace, like for admission webhooks.
+func (m *injectionPolicyMatcher) getNamespaceLabels(ctx context.Context) (labels.Set, bool, error) {
+	if m.req.Namespace == "" {
+		if m.req.Kind.Group == "" && m.req.Kind.Kind == "Namespace" {
+			return labels.Set(m.obj.GetLabels()), true, nil
+		}
+		return nil, false, nil
+	}
+	if m.namespaceLabels == nil {
+		namespace := &corev1.Namespace{}
+		err := m.client.Get(ctx, client.ObjectKey{Name: m.req.Namespace}, namespace)
+		if err != nil {
+			return nil, false, err
+		}
+		m.namespaceLabels = labels.Set(namespace.GetLabels())
+	}
+	return m.namespaceLabels, true, nil
+}
+
+func hasOperation(operations []redhatcopv1alpha1.InjectionOperation, operation redhatcopv1alpha1.InjectionOperation) bool {
+	for _, candidate := range operations {
+		if candidate == operation {
+			return true
+		}
+	}
+	return false
+}
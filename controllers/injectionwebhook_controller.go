@@ -0,0 +1,209 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// injectPath is the path of the creation time injection endpoint
+	injectPath = "/inject"
+	// referenceWebhookPath is the path of the defaulting webhook of the Patch kind, the managed webhooks reuse its service and CA bundle, whichever way the operator was installed
+	referenceWebhookPath = "/mutate-redhatcop-redhat-io-v1alpha1-patch"
+	injectionWebhookName = "patch-operator-inject.redhatcop.redhat.io"
+)
+
+// InjectionWebhookReconciler reconciles an InjectionWebhook object
+type InjectionWebhookReconciler struct {
+	util.ReconcilerBase
+}
+
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=injectionwebhooks,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=injectionwebhooks/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=injectionwebhooks/finalizers,verbs=update
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *InjectionWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx).WithName(req.Name)
+	ctx = log.IntoContext(ctx, rlog)
+	instance := &redhatcopv1alpha1.InjectionWebhook{}
+	err := r.GetClient().Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			// Return and don't requeue
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	reference, err := r.getReferenceWebhook(ctx)
+	if err != nil {
+		rlog.Error(err, "unable to find the webhook of the operator")
+		return r.ManageError(ctx, instance, err)
+	}
+	mutatingWebhookConfiguration := getMutatingWebhookConfiguration(instance, reference)
+	err = r.CreateOrUpdateResource(ctx, instance, "", mutatingWebhookConfiguration)
+	if err != nil {
+		rlog.Error(err, "unable to create or update", "mutating webhook configuration", mutatingWebhookConfiguration.Name)
+		return r.ManageError(ctx, instance, err)
+	}
+	instance.Status.MutatingWebhookConfigurationName = mutatingWebhookConfiguration.Name
+	return r.ManageSuccess(ctx, instance)
+}
+
+// getReferenceWebhook returns the defaulting webhook of the Patch kind, which is configured by the installation of the operator
+func (r *InjectionWebhookReconciler) getReferenceWebhook(ctx context.Context) (*admissionregistrationv1.MutatingWebhook, error) {
+	mutatingWebhookConfigurations := &admissionregistrationv1.MutatingWebhookConfigurationList{}
+	err := r.GetClient().List(ctx, mutatingWebhookConfigurations)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mutatingWebhookConfigurations.Items {
+		if webhook, ok := findReferenceWebhook(&mutatingWebhookConfigurations.Items[i]); ok {
+			return webhook, nil
+		}
+	}
+	return nil, errors.New("no mutating webhook serving " + referenceWebhookPath + " found, the webhooks of the operator must be installed")
+}
+
+func findReferenceWebhook(mutatingWebhookConfiguration *admissionregistrationv1.MutatingWebhookConfiguration) (*admissionregistrationv1.MutatingWebhook, bool) {
+	for i := range mutatingWebhookConfiguration.Webhooks {
+		service := mutatingWebhookConfiguration.Webhooks[i].ClientConfig.Service
+		if service != nil && service.Path != nil && *service.Path == referenceWebhookPath {
+			return &mutatingWebhookConfiguration.Webhooks[i], true
+		}
+	}
+	return nil, false
+}
+
+// getMutatingWebhookConfiguration returns the configuration sending the admission requests selected by the instance to the injection endpoint
+func getMutatingWebhookConfiguration(instance *redhatcopv1alpha1.InjectionWebhook, reference *admissionregistrationv1.MutatingWebhook) *admissionregistrationv1.MutatingWebhookConfiguration {
+	path := injectPath
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	rules := []admissionregistrationv1.RuleWithOperations{}
+	for _, rule := range instance.Spec.Rules {
+		operations := []admissionregistrationv1.OperationType{}
+		for _, operation := range rule.GetOperations() {
+			operations = append(operations, admissionregistrationv1.OperationType(operation))
+		}
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   rule.APIGroups,
+				APIVersions: rule.APIVersions,
+				Resources:   rule.Resources,
+			},
+		})
+	}
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "patch-operator-inject-" + instance.Name,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:                    injectionWebhookName,
+			AdmissionReviewVersions: []string{"v1"},
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: reference.ClientConfig.Service.Namespace,
+					Name:      reference.ClientConfig.Service.Name,
+					Port:      reference.ClientConfig.Service.Port,
+					Path:      &path,
+				},
+				CABundle: reference.ClientConfig.CABundle,
+			},
+			Rules:             rules,
+			FailurePolicy:     instance.Spec.FailurePolicy,
+			NamespaceSelector: getInjectionNamespaceSelector(instance.Spec.NamespaceSelector, reference.ClientConfig.Service.Namespace),
+			ObjectSelector:    instance.Spec.ObjectSelector,
+			SideEffects:       &sideEffects,
+			TimeoutSeconds:    instance.Spec.TimeoutSeconds,
+		}},
+	}
+}
+
+// excludedNamespaces are the system namespaces never sent to the injection webhook. Label selectors cannot match name prefixes, so the kube-* namespaces are listed.
+var excludedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// getInjectionNamespaceSelector returns the selector of the instance restricted to exclude the namespace of the operator and the system namespaces,
+// so a broad rule cannot block the operator's own pods or the control plane when the injection webhook is unavailable
+func getInjectionNamespaceSelector(selector *metav1.LabelSelector, operatorNamespace string) *metav1.LabelSelector {
+	result := &metav1.LabelSelector{}
+	if selector != nil {
+		result = selector.DeepCopy()
+	}
+	values := append([]string{operatorNamespace}, excludedNamespaces...)
+	result.MatchExpressions = append(result.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      corev1.LabelMetadataName,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   values,
+	})
+	return result
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Changes to the webhook of the operator, such as the rotation of its CA bundle, are propagated to all of the managed webhooks.
+func (r *InjectionWebhookReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&redhatcopv1alpha1.InjectionWebhook{}).
+		Owns(&admissionregistrationv1.MutatingWebhookConfiguration{}).
+		Watches(&source.Kind{Type: &admissionregistrationv1.MutatingWebhookConfiguration{}}, handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
+			mutatingWebhookConfiguration, ok := o.(*admissionregistrationv1.MutatingWebhookConfiguration)
+			if !ok {
+				return nil
+			}
+			if _, ok := findReferenceWebhook(mutatingWebhookConfiguration); !ok {
+				return nil
+			}
+			injectionWebhooks := &redhatcopv1alpha1.InjectionWebhookList{}
+			err := r.GetClient().List(context.TODO(), injectionWebhooks)
+			if err != nil {
+				mgr.GetLogger().Error(err, "unable to list injection webhooks")
+				return nil
+			}
+			requests := []reconcile.Request{}
+			for i := range injectionWebhooks.Items {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: injectionWebhooks.Items[i].Name}})
+			}
+			return requests
+		})).
+		Complete(r)
+}
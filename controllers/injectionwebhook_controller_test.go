@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestGetMutatingWebhookConfigurationNamespaceSelector(t *testing.T) {
+	reference := &admissionregistrationv1.MutatingWebhook{
+		ClientConfig: admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Namespace: "patch-operator", Name: "patch-operator-webhook-service"},
+		},
+	}
+	tests := []struct {
+		name              string
+		namespaceSelector *metav1.LabelSelector
+		selected          map[string]labels.Set
+	}{
+		{
+			name: "no selector",
+			selected: map[string]labels.Set{
+				"default":         {},
+				"kube-flannel":    {},
+				"patch-operator":  {},
+				"kube-system":     {},
+				"kube-public":     {},
+				"kube-node-lease": {},
+			},
+		},
+		{
+			name:              "selector",
+			namespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			selected: map[string]labels.Set{
+				"team-a":         {"team": "a"},
+				"team-b":         {"team": "b"},
+				"patch-operator": {"team": "a"},
+				"kube-system":    {"team": "a"},
+			},
+		},
+	}
+	expected := map[string]bool{
+		"default":      true,
+		"kube-flannel": true,
+		"team-a":       true,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &redhatcopv1alpha1.InjectionWebhook{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec:       redhatcopv1alpha1.InjectionWebhookSpec{NamespaceSelector: tt.namespaceSelector},
+			}
+			config := getMutatingWebhookConfiguration(instance, reference)
+			selector, err := metav1.LabelSelectorAsSelector(config.Webhooks[0].NamespaceSelector)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for namespace, namespaceLabels := range tt.selected {
+				set := labels.Merge(namespaceLabels, labels.Set{corev1.LabelMetadataName: namespace})
+				if selector.Matches(set) != expected[namespace] {
+					t.Errorf("namespace %s: expected selected %t", namespace, expected[namespace])
+				}
+			}
+			if tt.namespaceSelector != nil && len(tt.namespaceSelector.MatchExpressions) != 0 {
+				t.Errorf("the selector of the instance was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const metricsNamespace = "patch_operator"
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+const (
+	injectionPatched   = "patched"
+	injectionUnchanged = "unchanged"
+	injectionError     = "error"
+)
+
+var (
+	patchTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_targets",
+		Help:      "Number of targets of a patch, by state: matched are the targets currently selected, applied and failed the ones on which the last application of the patch succeeded or failed.",
+	}, []string{"kind", "namespace", "name", "patch", "state"})
+
+	patchApplications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_applications_total",
+		Help:      "Number of applications of a patch to its targets, by result. A steadily increasing number of successful applications usually means that another actor is reverting the patch.",
+	}, []string{"kind", "namespace", "name", "patch", "result"})
+
+	patchRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_request_duration_seconds",
+		Help:      "Latency of the patch requests issued to the api server by the enforcing controllers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind", "namespace", "name"})
+
+	patchReapplications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_reapplications_total",
+		Help:      "Number of times a patch had to be applied again to a target because another actor reverted it.",
+	}, []string{"kind", "namespace", "name", "patch"})
+
+	patchSuspended = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_suspended",
+		Help:      "Whether the enforcement of a patch is suspended because of drift.",
+	}, []string{"kind", "namespace", "name", "patch"})
+
+	templateRenderErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "template_render_errors_total",
+		Help:      "Number of failed applications of a patch caused by errors rendering its template.",
+	}, []string{"kind", "namespace", "name", "patch"})
+
+	serviceAccountTokenExpiration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_account_token_expiration_timestamp_seconds",
+		Help:      "Time at which the service account token used by the enforcing controllers expires, in seconds since the epoch.",
+	}, []string{"kind", "namespace", "name"})
+
+	serviceAccountTokenRotation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_account_token_rotation_timestamp_seconds",
+		Help:      "Time at which the service account token used by the enforcing controllers will be renewed, in seconds since the epoch.",
+	}, []string{"kind", "namespace", "name"})
+
+	injections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injections_total",
+		Help:      "Number of creation time patch injections, by patch type and result.",
+	}, []string{"patch_type", "result"})
+
+	groupVersionUnavailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "openapi_group_version_unavailable",
+		Help:      "Whether the OpenAPI document of a group version could not be loaded, usually because the aggregated API serving it is unavailable. Strategic merge patches of its kinds fail until it is available.",
+	}, []string{"group_version"})
+)
+
+// RegisterMetrics registers the collectors of the patch operator
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		patchTargets,
+		patchApplications,
+		patchRequestDuration,
+		patchReapplications,
+		patchSuspended,
+		templateRenderErrors,
+		serviceAccountTokenExpiration,
+		serviceAccountTokenRotation,
+		injections,
+		groupVersionUnavailable,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPatchObjectKind returns the kind of the instance, typed objects returned by the client don't have it set
+func getPatchObjectKind(instance redhatcopv1alpha1.PatchObject) string {
+	if _, ok := instance.(*redhatcopv1alpha1.ClusterPatch); ok {
+		return "ClusterPatch"
+	}
+	return "Patch"
+}
+
+// recordServiceAccountTokenMetrics exports the expiration and rotation time of the token of the instance
+func recordServiceAccountTokenMetrics(instance redhatcopv1alpha1.PatchObject, token *serviceAccountToken) {
+	kind := getPatchObjectKind(instance)
+	serviceAccountTokenExpiration.WithLabelValues(kind, instance.GetNamespace(), instance.GetName()).Set(float64(token.GetExpirationTimestamp().Unix()))
+	serviceAccountTokenRotation.WithLabelValues(kind, instance.GetNamespace(), instance.GetName()).Set(float64(token.GetRotationTimestamp().Unix()))
+}
+
+// recordPatchMetrics exports the number of targets of each patch and counts the applications that happened since the last time the statuses were observed.
+// Applications are recognized by the transition time of the conditions reported by the enforcing controllers, applications happening in between two observations are counted once.
+func (r *PatchReconciler) recordPatchMetrics(instance redhatcopv1alpha1.PatchObject, lockedPatchStatuses map[string]utilsv1alpha1.ConditionMap, targetStatuses map[string]redhatcopv1alpha1.PatchTargetsStatus) {
+	kind := getPatchObjectKind(instance)
+	r.observedConditionsLock.Lock()
+	defer r.observedConditionsLock.Unlock()
+	if r.observedConditions == nil {
+		r.observedConditions = map[string]map[string]metav1.Time{}
+	}
+	previouslyObserved := r.observedConditions[apis.GetKeyShort(instance)]
+	observed := map[string]metav1.Time{}
+	for patchName, conditionMap := range lockedPatchStatuses {
+		for targetKey, conditions := range conditionMap {
+			// the conditions of the enforcing controller itself, such as the one set each time it starts, are not applications
+			if targetKey == reconcilerStatusKey {
+				continue
+			}
+			for _, condition := range conditions {
+				key := patchName + "/" + targetKey + "/" + condition.Type
+				observed[key] = condition.LastTransitionTime
+				if previous, ok := previouslyObserved[key]; ok && previous.Equal(&condition.LastTransitionTime) {
+					continue
+				}
+				if condition.Type == apis.ReconcileSuccess {
+					patchApplications.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName, resultSuccess).Inc()
+					continue
+				}
+				if condition.Type != apis.ReconcileError {
+					continue
+				}
+				patchApplications.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName, resultFailure).Inc()
+				if isTemplateRenderError(condition.Message) {
+					templateRenderErrors.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName).Inc()
+				}
+			}
+		}
+	}
+	r.observedConditions[apis.GetKeyShort(instance)] = observed
+	for patchName, targetsStatus := range targetStatuses {
+		patchTargets.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName, "matched").Set(float64(targetsStatus.Matched))
+		patchTargets.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName, "applied").Set(float64(targetsStatus.Applied))
+		patchTargets.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName, "failed").Set(float64(targetsStatus.Failed))
+		suspended := 0.0
+		if targetsStatus.Suspension.IsActive(instance.GetGeneration(), time.Now()) {
+			suspended = 1
+		}
+		patchSuspended.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName).Set(suspended)
+	}
+	// forget the patches that have been removed
+	for patchName := range instance.GetPatchStatus().TargetStatuses {
+		if _, ok := targetStatuses[patchName]; !ok {
+			deletePatchMetrics(kind, instance.GetNamespace(), instance.GetName(), patchName)
+		}
+	}
+}
+
+// removeMetrics deletes all the metrics of the instance
+func (r *PatchReconciler) removeMetrics(instance redhatcopv1alpha1.PatchObject) {
+	kind := getPatchObjectKind(instance)
+	for patchName := range instance.GetPatches() {
+		deletePatchMetrics(kind, instance.GetNamespace(), instance.GetName(), patchName)
+	}
+	patchRequestDuration.DeleteLabelValues(kind, instance.GetNamespace(), instance.GetName())
+	serviceAccountTokenExpiration.DeleteLabelValues(kind, instance.GetNamespace(), instance.GetName())
+	serviceAccountTokenRotation.DeleteLabelValues(kind, instance.GetNamespace(), instance.GetName())
+	r.observedConditionsLock.Lock()
+	defer r.observedConditionsLock.Unlock()
+	delete(r.observedConditions, apis.GetKeyShort(instance))
+}
+
+func deletePatchMetrics(kind string, namespace string, name string, patchName string) {
+	for _, state := range []string{"matched", "applied", "failed"} {
+		patchTargets.DeleteLabelValues(kind, namespace, name, patchName, state)
+	}
+	for _, result := range []string{resultSuccess, resultFailure} {
+		patchApplications.DeleteLabelValues(kind, namespace, name, patchName, result)
+	}
+	templateRenderErrors.DeleteLabelValues(kind, namespace, name, patchName)
+	patchReapplications.DeleteLabelValues(kind, namespace, name, patchName)
+	patchSuspended.DeleteLabelValues(kind, namespace, name, patchName)
+}
+
+// isTemplateRenderError recognizes the errors returned by text/template and by the conversion of the rendered template to json
+func isTemplateRenderError(message string) bool {
+	return strings.HasPrefix(message, "template: ") || strings.HasPrefix(message, "error converting YAML to JSON")
+}
+
+// unknownPatchTypeLabel is the patch_type label of the injections whose patch type is not supported, so that arbitrary annotation values don't create new series
+const unknownPatchTypeLabel = "unknown"
+
+// recordInjection counts the outcome of the injection of a creation time patch
+func recordInjection(patchType PatchType, result string) {
+	injections.WithLabelValues(getPatchTypeLabel(patchType), result).Inc()
+}
+
+// getPatchTypeLabel returns the patch_type label of a patch type, unknownPatchTypeLabel for the unsupported ones
+func getPatchTypeLabel(patchType PatchType) string {
+	switch patchType {
+	case jsonPatch, mergePatch, strategicMergePatch:
+		return string(patchType)
+	default:
+		return unknownPatchTypeLabel
+	}
+}
+
+// recordGroupVersionAvailability exports the unavailable group versions, it returns whether the set of unavailable group versions changed
+func recordGroupVersionAvailability(previouslyUnavailable map[schema.GroupVersion]string, unavailable map[schema.GroupVersion]string) bool {
+	changed := len(previouslyUnavailable) != len(unavailable)
+	for groupVersion := range previouslyUnavailable {
+		if _, ok := unavailable[groupVersion]; !ok {
+			groupVersionUnavailable.DeleteLabelValues(groupVersion.String())
+			changed = true
+		}
+	}
+	for groupVersion := range unavailable {
+		groupVersionUnavailable.WithLabelValues(groupVersion.String()).Set(1)
+	}
+	return changed
+}
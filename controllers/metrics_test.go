@@ -0,0 +1,104 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetPatchTypeLabel(t *testing.T) {
+	tests := []struct {
+		patchType PatchType
+		expected  string
+	}{
+		{patchType: jsonPatch, expected: "application/json-patch+json"},
+		{patchType: mergePatch, expected: "application/merge-patch+json"},
+		{patchType: strategicMergePatch, expected: "application/strategic-merge-patch+json"},
+		{patchType: "application/apply-patch+yaml", expected: unknownPatchTypeLabel},
+		{patchType: "", expected: unknownPatchTypeLabel},
+		{patchType: "anything{{ .Values }}", expected: unknownPatchTypeLabel},
+	}
+	for _, tt := range tests {
+		if actual := getPatchTypeLabel(tt.patchType); actual != tt.expected {
+			t.Errorf("expected label %q for patch type %q, got %q", tt.expected, tt.patchType, actual)
+		}
+	}
+}
+
+func TestRecordPatchMetrics(t *testing.T) {
+	now := time.Now()
+	instance := &redhatcopv1alpha1.Patch{ObjectMeta: metav1.ObjectMeta{Name: "metrics", Namespace: "test"}, Spec: redhatcopv1alpha1.PatchSpec{Patches: map[string]redhatcopv1alpha1.PatchDefinition{"label": {}}}}
+	initializing := metav1.Condition{Type: "Initializing", Status: metav1.ConditionTrue, Reason: "ReconcilerManagerRestarting", LastTransitionTime: metav1.NewTime(now)}
+	tests := []struct {
+		name            string
+		conditionMap    utilsv1alpha1.ConditionMap
+		expectedSuccess float64
+		expectedFailure float64
+	}{
+		{
+			name:         "enforcing controller starting",
+			conditionMap: utilsv1alpha1.ConditionMap{reconcilerStatusKey: {initializing}},
+		},
+		{
+			name: "targets applied",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				reconcilerStatusKey: {initializing},
+				"test/a":            {newSuccessCondition(now)},
+				"test/b":            {newErrorCondition(now, "forbidden")},
+			},
+			expectedSuccess: 1,
+			expectedFailure: 1,
+		},
+		{
+			name: "enforcing controller restarted",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				reconcilerStatusKey: {{Type: "Initializing", Status: metav1.ConditionTrue, Reason: "ReconcilerManagerRestarting", LastTransitionTime: metav1.NewTime(now.Add(time.Second))}},
+				"test/a":            {newSuccessCondition(now)},
+				"test/b":            {newErrorCondition(now, "forbidden")},
+			},
+			expectedSuccess: 1,
+			expectedFailure: 1,
+		},
+		{
+			name: "target applied again",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				"test/a": {newSuccessCondition(now)},
+				"test/b": {newErrorCondition(now, "forbidden"), newSuccessCondition(now.Add(time.Second))},
+			},
+			expectedSuccess: 2,
+			expectedFailure: 1,
+		},
+	}
+	r := &PatchReconciler{}
+	defer r.removeMetrics(instance)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.recordPatchMetrics(instance, map[string]utilsv1alpha1.ConditionMap{"label": tt.conditionMap}, map[string]redhatcopv1alpha1.PatchTargetsStatus{})
+			success := testutil.ToFloat64(patchApplications.WithLabelValues("Patch", "test", "metrics", "label", resultSuccess))
+			failure := testutil.ToFloat64(patchApplications.WithLabelValues("Patch", "test", "metrics", "label", resultFailure))
+			if success != tt.expectedSuccess || failure != tt.expectedFailure {
+				t.Errorf("expected %v successful and %v failed applications, got %v and %v", tt.expectedSuccess, tt.expectedFailure, success, failure)
+			}
+		})
+	}
+}
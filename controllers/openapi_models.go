@@ -0,0 +1,123 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	openapi_v3 "github.com/google/gnostic/openapiv3"
+	apiextension "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+)
+
+const groupVersionKindExtension = "x-kubernetes-group-version-kind"
+
+// getOpenAPIV3Path returns the path of the OpenAPI v3 document of the group version, as listed by the /openapi/v3 endpoint
+func getOpenAPIV3Path(groupVersion schema.GroupVersion) string {
+	if groupVersion.Group == "" {
+		return "api/" + groupVersion.Version
+	}
+	return "apis/" + groupVersion.Group + "/" + groupVersion.Version
+}
+
+// getCRDGroupVersions returns the group versions defined by the CustomResourceDefinitions
+func getCRDGroupVersions(crds ...*apiextension.CustomResourceDefinition) []schema.GroupVersion {
+	groupVersions := []schema.GroupVersion{}
+	for _, crd := range crds {
+		for _, version := range crd.Spec.Versions {
+			groupVersions = append(groupVersions, schema.GroupVersion{Group: crd.Spec.Group, Version: version.Name})
+		}
+	}
+	return groupVersions
+}
+
+// getModelGroupVersionKinds returns the GVKs of a top level model, as declared by its x-kubernetes-group-version-kind extension.
+// The extensions of v2 documents are parsed with yaml.v2 and the ones of v3 documents with yaml.v3, so both map types are handled.
+func getModelGroupVersionKinds(model openapi.Schema) []schema.GroupVersionKind {
+	gvks := []schema.GroupVersionKind{}
+	values, ok := model.GetExtensions()[groupVersionKindExtension].([]interface{})
+	if !ok {
+		return gvks
+	}
+	for _, value := range values {
+		gvk := map[string]string{}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for k, v := range value {
+				gvk[k] = fmt.Sprint(v)
+			}
+		case map[interface{}]interface{}:
+			for k, v := range value {
+				gvk[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		default:
+			continue
+		}
+		gvks = append(gvks, schema.GroupVersionKind{Group: gvk["group"], Version: gvk["version"], Kind: gvk["kind"]})
+	}
+	return gvks
+}
+
+// indexModels returns the top level models by GVK, when groupVersion is not nil only the kinds of that group version are returned.
+// The OpenAPI v3 document of a group version also contains the models it references from other group versions, which are indexed from their own document.
+func indexModels(models openapi.Models, groupVersion *schema.GroupVersion) map[schema.GroupVersionKind]openapi.Schema {
+	index := map[schema.GroupVersionKind]openapi.Schema{}
+	for _, name := range models.ListModels() {
+		model := models.LookupModel(name)
+		if model == nil {
+			continue
+		}
+		for _, gvk := range getModelGroupVersionKinds(model) {
+			if groupVersion != nil && gvk.GroupVersion() != *groupVersion {
+				continue
+			}
+			index[gvk] = model
+		}
+	}
+	return index
+}
+
+// flattenAllOf replaces the schemas that only wrap a reference in an allOf with the reference itself.
+// Recent API servers publish the fields referencing another model, along with their description or default, this way and the OpenAPI v3 parser treats them as arbitrary objects, losing the patch metadata of the referenced model.
+func flattenAllOf(doc *openapi_v3.Document) {
+	for _, namedSchema := range doc.GetComponents().GetSchemas().GetAdditionalProperties() {
+		namedSchema.Value = flattenSchemaOrReference(namedSchema.Value)
+	}
+}
+
+func flattenSchemaOrReference(schemaOrReference *openapi_v3.SchemaOrReference) *openapi_v3.SchemaOrReference {
+	s := schemaOrReference.GetSchema()
+	if s == nil {
+		return schemaOrReference
+	}
+	if s.GetType() == "" && len(s.GetAllOf()) == 1 && s.GetAllOf()[0].GetReference() != nil && len(s.GetProperties().GetAdditionalProperties()) == 0 {
+		return s.GetAllOf()[0]
+	}
+	for _, property := range s.GetProperties().GetAdditionalProperties() {
+		property.Value = flattenSchemaOrReference(property.Value)
+	}
+	if s.GetItems() != nil {
+		for i := range s.Items.SchemaOrReference {
+			s.Items.SchemaOrReference[i] = flattenSchemaOrReference(s.Items.SchemaOrReference[i])
+		}
+	}
+	if additionalProperties, ok := s.GetAdditionalProperties().GetOneof().(*openapi_v3.AdditionalPropertiesItem_SchemaOrReference); ok {
+		additionalProperties.SchemaOrReference = flattenSchemaOrReference(additionalProperties.SchemaOrReference)
+	}
+	return schemaOrReference
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// minServiceAccountTokenExpirationDuration is the shortest token lifetime accepted by the TokenRequest API
+const minServiceAccountTokenExpirationDuration = 10 * time.Minute
+
+// OperatorSettings are the settings of the operator that the PatchOperatorConfig can change at runtime
+// +kubebuilder:object:generate:=false
+type OperatorSettings struct {
+	// ServiceAccountTokenExpirationDuration is the requested lifetime of the service account tokens of the enforcing controllers
+	ServiceAccountTokenExpirationDuration time.Duration
+	// PatchDefaults are the defaults materialized by the defaulting webhooks
+	PatchDefaults redhatcopv1alpha1.PatchDefaults
+	// InjectFailOpen admits the objects on which the creation time patches cannot be injected unchanged
+	InjectFailOpen bool
+	// AllowedTargets are the kinds that can be patched, all kinds when empty
+	AllowedTargets []redhatcopv1alpha1.KindSelector
+	// MaxConcurrentReconciles is the maximum number of Patches, and of ClusterPatches, reconciled concurrently
+	MaxConcurrentReconciles int
+	// LogLevel is the level of the logger of the operator
+	LogLevel zapcore.Level
+	// WebhooksEnabled is whether the webhooks are served, it cannot be changed at runtime
+	WebhooksEnabled bool
+}
+
+// withConfig returns the settings overridden by the fields set in the spec, an invalid spec is rejected
+func (s OperatorSettings) withConfig(spec *redhatcopv1alpha1.PatchOperatorConfigSpec) (OperatorSettings, error) {
+	if spec.ServiceAccountTokenExpirationDuration != nil {
+		if spec.ServiceAccountTokenExpirationDuration.Duration < minServiceAccountTokenExpirationDuration {
+			return s, errors.New("serviceAccountTokenExpirationDuration must be at least " + minServiceAccountTokenExpirationDuration.String())
+		}
+		s.ServiceAccountTokenExpirationDuration = spec.ServiceAccountTokenExpirationDuration.Duration
+	}
+	if spec.DefaultPatchType != "" {
+		s.PatchDefaults.PatchType = spec.DefaultPatchType
+		if err := s.PatchDefaults.Validate(); err != nil {
+			return s, err
+		}
+	}
+	if spec.InjectFailOpen != nil {
+		s.InjectFailOpen = *spec.InjectFailOpen
+	}
+	if len(spec.AllowedTargets) > 0 {
+		for i := range spec.AllowedTargets {
+			if spec.AllowedTargets[i].Kind == "" {
+				return s, errors.New("allowedTargets[" + strconv.Itoa(i) + "].kind is required")
+			}
+		}
+		s.AllowedTargets = spec.AllowedTargets
+	}
+	if spec.MaxConcurrentReconciles != nil {
+		if *spec.MaxConcurrentReconciles < 1 || *spec.MaxConcurrentReconciles > redhatcopv1alpha1.MaxConcurrentReconcilesLimit {
+			return s, errors.New("maxConcurrentReconciles must be between 1 and " + strconv.Itoa(redhatcopv1alpha1.MaxConcurrentReconcilesLimit))
+		}
+		s.MaxConcurrentReconciles = int(*spec.MaxConcurrentReconciles)
+	}
+	if spec.LogLevel != "" {
+		level, err := parseLogLevel(spec.LogLevel)
+		if err != nil {
+			return s, err
+		}
+		s.LogLevel = level
+	}
+	return s, nil
+}
+
+// getEffectiveSettings returns the settings as reported by the status of the PatchOperatorConfig
+func (s *OperatorSettings) getEffectiveSettings() *redhatcopv1alpha1.EffectiveSettings {
+	return &redhatcopv1alpha1.EffectiveSettings{
+		ServiceAccountTokenExpirationDuration: metav1.Duration{Duration: s.ServiceAccountTokenExpirationDuration},
+		DefaultPatchType:                      s.PatchDefaults.PatchType,
+		InjectFailOpen:                        s.InjectFailOpen,
+		AllowedTargets:                        s.AllowedTargets,
+		MaxConcurrentReconciles:               int32(s.MaxConcurrentReconciles),
+		LogLevel:                              formatLogLevel(s.LogLevel),
+		WebhooksEnabled:                       s.WebhooksEnabled,
+	}
+}
+
+// parseLogLevel parses a log level with the same syntax as the --zap-log-level flag: debug, info, error or an integer > 0 for increasingly verbose debug logs
+func parseLogLevel(value string) (zapcore.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "info":
+		return zapcore.InfoLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	}
+	verbosity, err := strconv.Atoi(value)
+	if err != nil || verbosity <= 0 || verbosity > 127 {
+		return 0, errors.New("invalid log level " + value + ", expected one of debug, info, error or an integer > 0")
+	}
+	return zapcore.Level(-verbosity), nil
+}
+
+// formatLogLevel formats a log level with the syntax of parseLogLevel
+func formatLogLevel(level zapcore.Level) string {
+	if level < zapcore.DebugLevel {
+		return strconv.Itoa(-int(level))
+	}
+	return level.String()
+}
+
+// operatorSettingsApplier applies the settings to the subsystems of the operator
+type operatorSettingsApplier struct {
+	lock    sync.Mutex
+	applied *OperatorSettings
+	// injector is nil when the webhooks are disabled
+	injector *PatchInjector
+	// logLevel is nil when the level of the logger cannot be changed
+	logLevel *zap.AtomicLevel
+}
+
+// apply applies the settings, when the allowed targets change all the Patches and ClusterPatches are reconciled again
+func (a *operatorSettingsApplier) apply(settings OperatorSettings) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := redhatcopv1alpha1.SetPatchDefaults(settings.PatchDefaults)
+	if err != nil {
+		return err
+	}
+	setServiceAccountTokenExpirationDuration(settings.ServiceAccountTokenExpirationDuration)
+	if a.injector != nil {
+		a.injector.SetFailOpen(settings.InjectFailOpen)
+	}
+	for _, limiter := range reconcileLimiters {
+		limiter.setLimit(settings.MaxConcurrentReconciles)
+	}
+	if a.logLevel != nil {
+		a.logLevel.SetLevel(settings.LogLevel)
+	}
+	redhatcopv1alpha1.SetAllowedTargets(settings.AllowedTargets)
+	if a.applied != nil && !reflect.DeepEqual(a.applied.AllowedTargets, settings.AllowedTargets) {
+		for _, changes := range allowedTargetsChanges {
+			select {
+			case changes <- event.GenericEvent{Object: &redhatcopv1alpha1.PatchOperatorConfig{}}:
+			default:
+				// a change is already signaled
+			}
+		}
+	}
+	a.applied = &settings
+	return nil
+}
+
+// getApplied returns the settings currently applied, nil if none have been applied yet
+func (a *operatorSettingsApplier) getApplied() *OperatorSettings {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.applied
+}
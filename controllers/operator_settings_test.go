@@ -0,0 +1,191 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestOperatorSettings() OperatorSettings {
+	return OperatorSettings{
+		ServiceAccountTokenExpirationDuration: time.Hour,
+		PatchDefaults: redhatcopv1alpha1.PatchDefaults{
+			PatchType:          types.StrategicMergePatchType,
+			ServiceAccountName: redhatcopv1alpha1.DefaultServiceAccountName,
+		},
+		MaxConcurrentReconciles: 1,
+		LogLevel:                zapcore.InfoLevel,
+		WebhooksEnabled:         true,
+	}
+}
+
+func TestWithConfig(t *testing.T) {
+	injectFailOpen := true
+	maxConcurrentReconciles := int32(4)
+	tooManyConcurrentReconciles := int32(redhatcopv1alpha1.MaxConcurrentReconcilesLimit + 1)
+	noConcurrentReconciles := int32(0)
+	allowedTargets := []redhatcopv1alpha1.KindSelector{{Group: "apps", Kind: "Deployment"}}
+	tests := []struct {
+		name        string
+		spec        redhatcopv1alpha1.PatchOperatorConfigSpec
+		expected    func(*OperatorSettings)
+		expectedErr bool
+	}{
+		{
+			name:     "empty spec keeps the defaults",
+			expected: func(*OperatorSettings) {},
+		},
+		{
+			name: "all fields overridden",
+			spec: redhatcopv1alpha1.PatchOperatorConfigSpec{
+				ServiceAccountTokenExpirationDuration: &metav1.Duration{Duration: 2 * time.Hour},
+				DefaultPatchType:                      types.JSONPatchType,
+				InjectFailOpen:                        &injectFailOpen,
+				AllowedTargets:                        allowedTargets,
+				MaxConcurrentReconciles:               &maxConcurrentReconciles,
+				LogLevel:                              "debug",
+			},
+			expected: func(s *OperatorSettings) {
+				s.ServiceAccountTokenExpirationDuration = 2 * time.Hour
+				s.PatchDefaults.PatchType = types.JSONPatchType
+				s.InjectFailOpen = true
+				s.AllowedTargets = allowedTargets
+				s.MaxConcurrentReconciles = 4
+				s.LogLevel = zapcore.DebugLevel
+			},
+		},
+		{
+			name: "shortest token lifetime",
+			spec: redhatcopv1alpha1.PatchOperatorConfigSpec{ServiceAccountTokenExpirationDuration: &metav1.Duration{Duration: minServiceAccountTokenExpirationDuration}},
+			expected: func(s *OperatorSettings) {
+				s.ServiceAccountTokenExpirationDuration = minServiceAccountTokenExpirationDuration
+			},
+		},
+		{
+			name:        "token lifetime too short",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{ServiceAccountTokenExpirationDuration: &metav1.Duration{Duration: time.Minute}},
+			expectedErr: true,
+		},
+		{
+			name:        "unsupported default patch type",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{DefaultPatchType: "text/plain"},
+			expectedErr: true,
+		},
+		{
+			name:        "allowed target without kind",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{AllowedTargets: []redhatcopv1alpha1.KindSelector{{Group: "apps"}}},
+			expectedErr: true,
+		},
+		{
+			name:        "no concurrent reconciles",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{MaxConcurrentReconciles: &noConcurrentReconciles},
+			expectedErr: true,
+		},
+		{
+			name:        "too many concurrent reconciles",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{MaxConcurrentReconciles: &tooManyConcurrentReconciles},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid log level",
+			spec:        redhatcopv1alpha1.PatchOperatorConfigSpec{LogLevel: "verbose"},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaults := newTestOperatorSettings()
+			settings, err := defaults.withConfig(&tt.spec)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", settings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := newTestOperatorSettings()
+			tt.expected(&expected)
+			if !reflect.DeepEqual(settings, expected) {
+				t.Errorf("expected %+v, got %+v", expected, settings)
+			}
+			if !reflect.DeepEqual(defaults, newTestOperatorSettings()) {
+				t.Errorf("the defaults were modified: %+v", defaults)
+			}
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    zapcore.Level
+		expectedErr bool
+	}{
+		{value: "debug", expected: zapcore.DebugLevel},
+		{value: "info", expected: zapcore.InfoLevel},
+		{value: "error", expected: zapcore.ErrorLevel},
+		{value: "Info", expected: zapcore.InfoLevel},
+		{value: "1", expected: zapcore.DebugLevel},
+		{value: "5", expected: zapcore.Level(-5)},
+		{value: "127", expected: zapcore.Level(-127)},
+		{value: "", expectedErr: true},
+		{value: "0", expectedErr: true},
+		{value: "-1", expectedErr: true},
+		{value: "128", expectedErr: true},
+		{value: "warn", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			level, err := parseLogLevel(tt.value)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", level)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if level != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, level)
+			}
+		})
+	}
+}
+
+func TestFormatLogLevel(t *testing.T) {
+	for _, value := range []string{"debug", "info", "error", "2", "127"} {
+		t.Run(value, func(t *testing.T) {
+			level, err := parseLogLevel(value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if formatted := formatLogLevel(level); formatted != value {
+				t.Errorf("expected %q, got %q", value, formatted)
+			}
+		})
+	}
+}
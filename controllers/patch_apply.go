@@ -0,0 +1,51 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// patchOptions are the options with which a patch is sent to its targets
+type patchOptions struct {
+	// fieldManager and force are only set for server-side apply patches
+	fieldManager string
+	force        bool
+	dryRun       bool
+}
+
+// getPatchOptions returns the options of each patch, by patch name.
+// The options are not part of the locked patches of operator-utils, they are passed to the enforcing controllers separately.
+func getPatchOptions(patches map[string]redhatcopv1alpha1.PatchDefinition) map[string]patchOptions {
+	options := map[string]patchOptions{}
+	for patchName, patch := range patches {
+		options[patchName] = getApplyOptions(patch)
+	}
+	return options
+}
+
+// getApplyOptions returns the options of a patch, only server-side apply patches have any
+func getApplyOptions(patch redhatcopv1alpha1.PatchDefinition) patchOptions {
+	if patch.PatchType != types.ApplyPatchType {
+		return patchOptions{}
+	}
+	return patchOptions{
+		fieldManager: patch.GetFieldManager(),
+		force:        patch.Force,
+	}
+}
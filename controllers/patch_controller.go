@@ -18,20 +18,30 @@ package controllers
 
 import (
 	"context"
+	goerrors "errors"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redhat-cop/operator-utils/pkg/util"
 	"github.com/redhat-cop/operator-utils/pkg/util/apis"
-	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller"
 	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
 	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
 	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -41,7 +51,33 @@ import (
 
 // PatchReconciler reconciles a Patch object
 type PatchReconciler struct {
-	lockedresourcecontroller.EnforcingReconciler
+	util.ReconcilerBase
+	// patchEnforcers run, for each instance, the controllers enforcing its patches
+	patchEnforcers     map[string]*patchEnforcer
+	patchEnforcersLock sync.Mutex
+	// statusChanges receives the notifications of the enforcing controllers when the status of a target changes
+	statusChanges            *statusChangeNotifier
+	serviceAccountTokens     map[string]*serviceAccountToken
+	serviceAccountTokensLock sync.Mutex
+	// enforcedPatches contains, for each instance, the names of the patches passed to the enforcing controllers
+	enforcedPatches     map[string]map[string]bool
+	enforcedPatchesLock sync.Mutex
+	// observedConditions contains, for each instance, the transition time of the conditions reported by the enforcing controllers when they were last observed
+	observedConditions     map[string]map[string]metav1.Time
+	observedConditionsLock sync.Mutex
+	// patchDrifts contains, for each instance and patch, the changes made to the targets
+	patchDrifts     map[string]map[string]*patchDrift
+	patchDriftsLock sync.Mutex
+	// Models provides the OpenAPI models of the custom resources, needed to apply strategic merge patches to them. When nil, they are applied as merge patches.
+	Models *CustomResourceDefinitionReconciler
+}
+
+func NewPatchReconciler(reconcilerBase util.ReconcilerBase, models *CustomResourceDefinitionReconciler) *PatchReconciler {
+	return &PatchReconciler{
+		ReconcilerBase: reconcilerBase,
+		statusChanges:  newStatusChangeNotifier(statusChangeCoalescingPeriod),
+		Models:         models,
+	}
 }
 
 //+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=patches,verbs=get;list;watch;create;update;patch;delete
@@ -81,6 +117,15 @@ func (r *PatchReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return reconcile.Result{}, err
 	}
 
+	return r.reconcilePatchObject(ctx, instance)
+}
+
+// reconcilePatchObject enforces the patches of a Patch or ClusterPatch
+func (r *PatchReconciler) reconcilePatchObject(ctx context.Context, instance redhatcopv1alpha1.PatchObject) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx)
+	limiter := reconcileLimiters[getPatchObjectKind(instance)]
+	limiter.acquire()
+	defer limiter.release()
 	if util.IsBeingDeleted(instance) {
 		if !controllerutil.ContainsFinalizer(instance, redhatcopv1alpha1.PatchControllerFinalizerName) {
 			return reconcile.Result{}, nil
@@ -99,56 +144,199 @@ func (r *PatchReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return reconcile.Result{}, nil
 	}
 
-	config, err := r.getRestConfigFromInstance(ctx, instance)
+	err := checkAllowedTargets(instance)
+	if err != nil {
+		rlog.Error(err, "patch targets are not allowed", "instance", instance)
+		// the patches are no longer enforced, the targets keep their current state
+		r.stopEnforcing(instance)
+		r.removeEnforcedPatches(instance)
+		return r.ManageError(ctx, instance, err)
+	}
+
+	config, token, err := r.getRestConfigFromInstance(ctx, instance)
 	if err != nil {
 		rlog.Error(err, "unable to get restconfig for", "instance", instance)
 		return r.ManageError(ctx, instance, err)
 	}
+	status := instance.GetPatchStatus()
+	expirationTimestamp := metav1.NewTime(token.GetExpirationTimestamp())
+	rotationTimestamp := metav1.NewTime(token.GetRotationTimestamp())
+	status.ServiceAccountTokenExpirationTimestamp = &expirationTimestamp
+	status.ServiceAccountTokenRotationTimestamp = &rotationTimestamp
+	recordServiceAccountTokenMetrics(instance, token)
 
-	lockedPatches, err := lockedpatch.GetLockedPatches(instance.Spec.Patches, config, rlog)
+	lockedPatches, err := lockedpatch.GetLockedPatches(redhatcopv1alpha1.GetPatchSpecs(instance.GetPatches()), config, rlog)
 
 	if err != nil {
 		rlog.Error(err, "unable to get patches for", "instance", instance)
 		return r.ManageError(ctx, instance, err)
 	}
 
-	err = r.UpdateLockedResourcesWithRestConfig(ctx, instance, nil, lockedPatches, config)
+	if instance.IsDryRun() {
+		return r.manageDryRun(ctx, instance, lockedPatches, config, token)
+	}
+
+	if status.PreviewConfigMapRef != nil {
+		err = r.deleteConfigMapIfExists(ctx, instance.GetServiceAccountNamespace(), status.PreviewConfigMapRef.Name)
+		if err != nil {
+			rlog.Error(err, "unable to delete preview configmap for", "instance", instance)
+			return r.ManageError(ctx, instance, err)
+		}
+		status.PreviewConfigMapRef = nil
+	}
+
+	enforceablePatches, blockedPatches, err := r.getEnforceablePatches(instance, lockedPatches)
+	if err != nil {
+		rlog.Error(err, "unable to resolve patch dependencies for", "instance", instance)
+		return r.ManageError(ctx, instance, err)
+	}
+	status.BlockedPatches = blockedPatches
+
+	err = r.updateEnforcedPatches(ctx, instance, enforceablePatches, getPatchOptions(instance.GetPatches()), config)
 	if err != nil {
 		rlog.Error(err, "unable to update locked resources")
 		return r.ManageError(ctx, instance, err)
 	}
+	r.setEnforcedPatches(instance, enforceablePatches)
 
-	return r.ManageSuccess(ctx, instance)
+	result, err := r.ManageSuccess(ctx, instance)
+	if err != nil {
+		return result, err
+	}
+	// come back in time to rotate the token before it expires and to resume the suspended patches
+	result.RequeueAfter = time.Until(token.GetRotationTimestamp())
+	if resumeTime, ok := getNextResumeTime(status, instance.GetGeneration(), time.Now()); ok && time.Until(resumeTime) < result.RequeueAfter {
+		result.RequeueAfter = time.Until(resumeTime)
+	}
+	return result, nil
+}
 
+// manageDryRun stops the enforcement of the patches, if it was running, and writes their preview.
+func (r *PatchReconciler) manageDryRun(ctx context.Context, instance redhatcopv1alpha1.PatchObject, lockedPatches []lockedpatch.LockedPatch, config *rest.Config, token *serviceAccountToken) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx)
+	r.stopEnforcing(instance)
+	r.removeEnforcedPatches(instance)
+	instance.GetPatchStatus().BlockedPatches = nil
+	err := r.managePreview(ctx, instance, lockedPatches, config)
+	if err != nil {
+		rlog.Error(err, "unable to compute preview for", "instance", instance)
+		return r.ManageError(ctx, instance, err)
+	}
+	instance.GetPatchStatus().PreviewConfigMapRef = &corev1.LocalObjectReference{
+		Name: getPreviewConfigMapName(instance),
+	}
+	result, err := r.ManageSuccess(ctx, instance)
+	if err != nil {
+		return result, err
+	}
+	result.RequeueAfter = time.Until(token.GetRotationTimestamp())
+	return result, nil
+}
+
+// checkAllowedTargets returns an error if any of the patches targets a kind that the operator is not allowed to patch
+func checkAllowedTargets(instance redhatcopv1alpha1.PatchObject) error {
+	patchNames := []string{}
+	for patchName := range instance.GetPatches() {
+		patchNames = append(patchNames, patchName)
+	}
+	sort.Strings(patchNames)
+	for _, patchName := range patchNames {
+		targetObjectRef := instance.GetPatches()[patchName].TargetObjectRef
+		gvk := schema.FromAPIVersionAndKind(targetObjectRef.APIVersion, targetObjectRef.Kind)
+		if !redhatcopv1alpha1.IsAllowedTarget(gvk) {
+			return goerrors.New("patch " + patchName + " targets kind " + gvk.String() + ", which is not an allowed target of the operator")
+		}
+	}
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
+// The controller runs as many workers as the highest concurrency limit, the actual limit is enforced by the reconcile limiter of the kind.
 func (r *PatchReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	err := mgr.Add(r.statusChanges)
+	if err != nil {
+		return err
+	}
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&redhatcopv1alpha1.Patch{}).
-		Watches(&source.Channel{Source: r.GetStatusChangeChannel()}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Channel{Source: r.getStatusChanges()}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Channel{Source: allowedTargetsChanges["Patch"]}, handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+			return r.listRequests(&redhatcopv1alpha1.PatchList{}, nil)
+		}))
+	if r.Models != nil {
+		controllerBuilder = controllerBuilder.Watches(&source.Channel{Source: r.Models.StatusChanges()}, handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+			return r.listRequests(&redhatcopv1alpha1.PatchList{}, isModelDependent)
+		}))
+	}
+	return controllerBuilder.
+		WithOptions(controller.Options{MaxConcurrentReconciles: redhatcopv1alpha1.MaxConcurrentReconcilesLimit}).
 		Complete(r)
 }
 
-func getJWTToken(context context.Context, serviceAccountName string, kubeNamespace string) (string, error) {
-	log := log.FromContext(context)
+// isModelDependent returns whether the instance has strategic merge patches of custom resources, whose status depends on the availability of the OpenAPI documents
+func isModelDependent(instance redhatcopv1alpha1.PatchObject) bool {
+	return len(getModelDependentGroupVersions(instance)) > 0
+}
 
-	restConfig := context.Value("restConfig").(*rest.Config)
+// listRequests returns the requests of the Patches or ClusterPatches accepted by the filter, all of them when it is nil.
+// They are listed when the allowed targets or the available group versions change.
+func (r *PatchReconciler) listRequests(list client.ObjectList, filter func(redhatcopv1alpha1.PatchObject) bool) []reconcile.Request {
+	err := r.GetClient().List(context.TODO(), list)
+	if err != nil {
+		ctrl.Log.Error(err, "unable to list patches")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	err = meta.EachListItem(list, func(object runtime.Object) error {
+		if instance, ok := object.(redhatcopv1alpha1.PatchObject); ok && (filter == nil || filter(instance)) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(instance)})
+		}
+		return nil
+	})
+	if err != nil {
+		ctrl.Log.Error(err, "unable to list patches")
+		return nil
+	}
+	return requests
+}
+
+// serviceAccountTokenExpirationDuration is the lifetime of the tokens set by the PatchOperatorConfig, in nanoseconds, 0 when not set
+var serviceAccountTokenExpirationDuration atomic.Int64
+
+// setServiceAccountTokenExpirationDuration sets the lifetime of the tokens requested from now on
+func setServiceAccountTokenExpirationDuration(duration time.Duration) {
+	serviceAccountTokenExpirationDuration.Store(int64(duration))
+}
+
+func getServiceAccountTokenExpirationDuration(context context.Context) time.Duration {
+	if duration := serviceAccountTokenExpirationDuration.Load(); duration > 0 {
+		return time.Duration(duration)
+	}
+	return DefaultServiceAccountTokenExpirationDuration(context)
+}
+
+// DefaultServiceAccountTokenExpirationDuration returns the lifetime of the tokens set by the SERVICE_ACCOUNT_TOKEN_EXPIRATION_DURATION environment variable, 1 year by default
+func DefaultServiceAccountTokenExpirationDuration(context context.Context) time.Duration {
+	log := log.FromContext(context)
 	lenght, found := os.LookupEnv("SERVICE_ACCOUNT_TOKEN_EXPIRATION_DURATION")
 	//default is 1 year
 	defaultDuration, _ := time.ParseDuration("8760h")
-	var duration time.Duration
-	if found {
-		parsedDuration, err := time.ParseDuration(lenght)
-		if err != nil {
-			log.Error(err, "unable to parse SERVICE_ACCOUNT_TOKEN_EXPIRATION_DURATION to duration, continuing with", "default duration", defaultDuration)
-			duration = defaultDuration
-		} else {
-			duration = parsedDuration
-		}
-	} else {
-		duration = defaultDuration
+	if !found {
+		return defaultDuration
+	}
+	parsedDuration, err := time.ParseDuration(lenght)
+	if err != nil {
+		log.Error(err, "unable to parse SERVICE_ACCOUNT_TOKEN_EXPIRATION_DURATION to duration, continuing with", "default duration", defaultDuration)
+		return defaultDuration
 	}
+	return parsedDuration
+}
+
+func getJWTToken(context context.Context, serviceAccountName string, kubeNamespace string) (*authv1.TokenRequestStatus, error) {
+	log := log.FromContext(context)
+
+	restConfig := context.Value("restConfig").(*rest.Config)
+	duration := getServiceAccountTokenExpirationDuration(context)
 
 	seconds := int64(duration.Seconds())
 	treq := &authv1.TokenRequest{
@@ -161,53 +349,122 @@ func getJWTToken(context context.Context, serviceAccountName string, kubeNamespa
 
 	if err != nil {
 		log.Error(err, "unable to create kubernetes clientset")
-		return "", err
+		return nil, err
 	}
 
 	treq, err = clientset.CoreV1().ServiceAccounts(kubeNamespace).CreateToken(context, serviceAccountName, treq, metav1.CreateOptions{})
 	if err != nil {
 		log.Error(err, "unable to create service account token request", "in namespace", kubeNamespace, "for service account", serviceAccountName)
-		return "", err
+		return nil, err
 	}
 
 	log.Info("token expiration: " + treq.Status.ExpirationTimestamp.String())
 
-	return treq.Status.Token, nil
+	return &treq.Status, nil
 }
 
-func (r *PatchReconciler) getRestConfigFromInstance(ctx context.Context, instance *redhatcopv1alpha1.Patch) (*rest.Config, error) {
-	rlog := log.FromContext(ctx)
-	ctx = context.WithValue(ctx, "restConfig", r.GetRestConfig())
-	token, err := getJWTToken(ctx, instance.Spec.ServiceAccountRef.Name, instance.GetNamespace())
-	if err != nil {
-		rlog.Error(err, "unable to retrieve token for", "service account", instance.Spec.ServiceAccountRef.Name, "in namespace", instance.GetNamespace())
-		return nil, err
+func (r *PatchReconciler) getServiceAccountToken(instance redhatcopv1alpha1.PatchObject) *serviceAccountToken {
+	r.serviceAccountTokensLock.Lock()
+	defer r.serviceAccountTokensLock.Unlock()
+	if r.serviceAccountTokens == nil {
+		r.serviceAccountTokens = map[string]*serviceAccountToken{}
+	}
+	token, ok := r.serviceAccountTokens[apis.GetKeyShort(instance)]
+	if !ok {
+		token = newServiceAccountToken(r.GetRestConfig())
+		r.serviceAccountTokens[apis.GetKeyShort(instance)] = token
+	}
+	return token
+}
+
+// setGroupVersionsStatus reports the unavailable group versions targeted by the strategic merge patches of the instance
+func (r *PatchReconciler) setGroupVersionsStatus(instance redhatcopv1alpha1.PatchObject) {
+	unavailableGroupVersions := map[schema.GroupVersion]string{}
+	if r.Models != nil {
+		unavailableGroupVersions = r.Models.GetUnavailableGroupVersions()
 	}
+	setGroupVersionsStatus(instance, unavailableGroupVersions)
+}
 
-	config := rest.Config{
-		Host:        r.GetRestConfig().Host,
-		BearerToken: token,
-		TLSClientConfig: rest.TLSClientConfig{
-			CAData: r.GetRestConfig().CAData,
-			CAFile: r.GetRestConfig().CAFile,
-		},
+// getModels returns the models used by the enforcing controllers, the nil reconciler is turned into a nil interface
+func (r *PatchReconciler) getModels() modelGetter {
+	if r.Models == nil {
+		return nil
+	}
+	return r.Models
+}
+
+// lookupServiceAccountToken returns the token of the instance, if one has already been issued
+func (r *PatchReconciler) lookupServiceAccountToken(instance redhatcopv1alpha1.PatchObject) (*serviceAccountToken, bool) {
+	r.serviceAccountTokensLock.Lock()
+	defer r.serviceAccountTokensLock.Unlock()
+	token, ok := r.serviceAccountTokens[apis.GetKeyShort(instance)]
+	if !ok || token.getToken() == "" {
+		return nil, false
 	}
-	return &config, nil
+	return token, true
 }
 
-// manageCleanupLogic delete resources. We don't touch pacthes because we cannot undo them.
-func (r *PatchReconciler) manageCleanUpLogic(ctx context.Context, instance *redhatcopv1alpha1.Patch) error {
+func (r *PatchReconciler) removeServiceAccountToken(instance redhatcopv1alpha1.PatchObject) {
+	r.serviceAccountTokensLock.Lock()
+	defer r.serviceAccountTokensLock.Unlock()
+	delete(r.serviceAccountTokens, apis.GetKeyShort(instance))
+}
+
+// getRestConfigFromInstance returns the rest config with which the enforcing controllers of this instance run.
+// The returned config is the same for the whole life of the instance, when the token is close to expiration or the service account of the instance changed, a new one is requested and swapped in place.
+func (r *PatchReconciler) getRestConfigFromInstance(ctx context.Context, instance redhatcopv1alpha1.PatchObject) (*rest.Config, *serviceAccountToken, error) {
 	rlog := log.FromContext(ctx)
-	err := r.Terminate(instance, true)
-	if err != nil {
-		rlog.Error(err, "unable to terminate enforcing reconciler for", "instance", instance)
-		return err
+	token := r.getServiceAccountToken(instance)
+	serviceAccount := types.NamespacedName{Namespace: instance.GetServiceAccountNamespace(), Name: instance.GetServiceAccountName()}
+	if token.NeedsRotation(serviceAccount, time.Now()) {
+		ctx = context.WithValue(ctx, "restConfig", r.GetRestConfig())
+		issueTimestamp := time.Now()
+		tokenStatus, err := getJWTToken(ctx, instance.GetServiceAccountName(), instance.GetServiceAccountNamespace())
+		if err != nil {
+			rlog.Error(err, "unable to retrieve token for", "service account", instance.GetServiceAccountName(), "in namespace", instance.GetServiceAccountNamespace())
+			return nil, nil, err
+		}
+		token.setToken(serviceAccount, tokenStatus.Token, issueTimestamp, tokenStatus.ExpirationTimestamp.Time)
+		rlog.V(1).Info("service account token rotated", "next rotation", token.GetRotationTimestamp())
 	}
+	return token.restConfig, token, nil
+}
+
+// manageCleanupLogic stops the enforcing controllers and reverts the patches with the Revert deletion policy. Other patches are left in place.
+func (r *PatchReconciler) manageCleanUpLogic(ctx context.Context, instance redhatcopv1alpha1.PatchObject) error {
+	rlog := log.FromContext(ctx)
+	r.stopEnforcing(instance)
+	if hasRevertDeletionPolicy(instance) {
+		config, _, err := r.getRestConfigFromInstance(ctx, instance)
+		if err != nil {
+			rlog.Error(err, "unable to get restconfig for", "instance", instance)
+			return err
+		}
+		err = r.revertPatches(ctx, instance, config)
+		if err != nil {
+			rlog.Error(err, "unable to revert patches for", "instance", instance)
+			return err
+		}
+	}
+	r.removeServiceAccountToken(instance)
+	r.removeEnforcedPatches(instance)
+	r.removeMetrics(instance)
+	r.removeDrift(instance)
 	return nil
 }
 
+func hasRevertDeletionPolicy(instance redhatcopv1alpha1.PatchObject) bool {
+	for _, patch := range instance.GetPatches() {
+		if patch.DeletionPolicy == redhatcopv1alpha1.RevertDeletionPolicy {
+			return true
+		}
+	}
+	return false
+}
+
 // ManageError manage error sets an error status in the CR and fires an event, finally it returns the error so the operator can re-attempt
-func (er *PatchReconciler) ManageError(ctx context.Context, instance *redhatcopv1alpha1.Patch, issue error) (reconcile.Result, error) {
+func (er *PatchReconciler) ManageError(ctx context.Context, instance redhatcopv1alpha1.PatchObject, issue error) (reconcile.Result, error) {
 	rlog := log.FromContext(ctx)
 	er.GetRecorder().Event(instance, "Warning", "ProcessingError", issue.Error())
 	condition := metav1.Condition{
@@ -218,8 +475,14 @@ func (er *PatchReconciler) ManageError(ctx context.Context, instance *redhatcopv
 		Reason:             apis.ReconcileErrorReason,
 		Status:             metav1.ConditionTrue,
 	}
-	instance.Status.Conditions = apis.AddOrReplaceCondition(condition, instance.Status.Conditions)
-	instance.Status.PatchStatuses = er.GetLockedPatchStatuses(instance)
+	status := instance.GetPatchStatus()
+	status.Conditions = apis.AddOrReplaceCondition(condition, status.Conditions)
+	er.setGroupVersionsStatus(instance)
+	lockedPatchStatuses := er.getPatchStatuses(instance)
+	targetStatuses := er.getTargetStatuses(ctx, instance, lockedPatchStatuses)
+	er.recordPatchMetrics(instance, lockedPatchStatuses, targetStatuses)
+	status.PatchStatuses = filterFailingPatchStatuses(lockedPatchStatuses)
+	status.TargetStatuses = targetStatuses
 	err := er.GetClient().Status().Update(ctx, instance)
 	if err != nil {
 		if errors.IsResourceExpired(err) {
@@ -234,7 +497,7 @@ func (er *PatchReconciler) ManageError(ctx context.Context, instance *redhatcopv
 }
 
 // ManageSuccess will update the status of the CR and return a successful reconcile result
-func (er *PatchReconciler) ManageSuccess(ctx context.Context, instance *redhatcopv1alpha1.Patch) (reconcile.Result, error) {
+func (er *PatchReconciler) ManageSuccess(ctx context.Context, instance redhatcopv1alpha1.PatchObject) (reconcile.Result, error) {
 	rlog := log.FromContext(ctx)
 
 	condition := metav1.Condition{
@@ -244,9 +507,15 @@ func (er *PatchReconciler) ManageSuccess(ctx context.Context, instance *redhatco
 		Reason:             apis.ReconcileSuccessReason,
 		Status:             metav1.ConditionTrue,
 	}
-	instance.Status.Conditions = apis.AddOrReplaceCondition(condition, instance.Status.Conditions)
+	status := instance.GetPatchStatus()
+	status.Conditions = apis.AddOrReplaceCondition(condition, status.Conditions)
+	er.setGroupVersionsStatus(instance)
 	//we expect only one element
-	instance.Status.PatchStatuses = er.GetLockedPatchStatuses(instance)
+	lockedPatchStatuses := er.getPatchStatuses(instance)
+	targetStatuses := er.getTargetStatuses(ctx, instance, lockedPatchStatuses)
+	er.recordPatchMetrics(instance, lockedPatchStatuses, targetStatuses)
+	status.PatchStatuses = filterFailingPatchStatuses(lockedPatchStatuses)
+	status.TargetStatuses = targetStatuses
 	err := er.GetClient().Status().Update(ctx, instance)
 	if err != nil {
 		if errors.IsResourceExpired(err) {
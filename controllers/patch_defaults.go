@@ -0,0 +1,69 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// the keys of the ConfigMap overriding the default patch type and service accounts
+const (
+	patchTypeDefaultsKey                    = "patchType"
+	serviceAccountNameDefaultsKey           = "serviceAccountName"
+	namespaceServiceAccountNamesDefaultsKey = "namespaceServiceAccountNames"
+)
+
+// ParseNamespacedName parses a reference in the namespace/name format
+func ParseNamespacedName(value string) (types.NamespacedName, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, errors.New("expected namespace/name, got: " + value)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// LoadPatchDefaults overrides the defaults with the ones set in the ConfigMap, the keys missing from the ConfigMap keep their value.
+// namespaceServiceAccountNames is a yaml map from namespace to the name of the default service account of the Patches of that namespace.
+func LoadPatchDefaults(ctx context.Context, reader client.Reader, configMapName types.NamespacedName, defaults redhatcopv1alpha1.PatchDefaults) (redhatcopv1alpha1.PatchDefaults, error) {
+	configMap := &corev1.ConfigMap{}
+	err := reader.Get(ctx, configMapName, configMap)
+	if err != nil {
+		return defaults, err
+	}
+	if patchType, ok := configMap.Data[patchTypeDefaultsKey]; ok {
+		defaults.PatchType = types.PatchType(strings.TrimSpace(patchType))
+	}
+	if serviceAccountName, ok := configMap.Data[serviceAccountNameDefaultsKey]; ok {
+		defaults.ServiceAccountName = strings.TrimSpace(serviceAccountName)
+	}
+	if namespaceServiceAccountNames, ok := configMap.Data[namespaceServiceAccountNamesDefaultsKey]; ok {
+		defaults.NamespaceServiceAccountNames = map[string]string{}
+		err = yaml.Unmarshal([]byte(namespaceServiceAccountNames), &defaults.NamespaceServiceAccountNames)
+		if err != nil {
+			return defaults, errors.New("unable to parse key " + namespaceServiceAccountNamesDefaultsKey + " of ConfigMap " + configMapName.String() + ": " + err.Error())
+		}
+	}
+	return defaults, defaults.Validate()
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+)
+
+// getEnforceablePatches returns the patches whose dependencies are satisfied and whose enforcement is not suspended and, for the other ones, the reason why they are blocked.
+// A patch can be enforced when the patches it depends on are enforced and have been successfully applied to all of their targets, a patch without targets has nothing to apply.
+// Once enforced, a patch stays enforced as long as the patches it depends on are, because restarting the enforcing controllers resets the statuses they report.
+func (r *PatchReconciler) getEnforceablePatches(instance redhatcopv1alpha1.PatchObject, lockedPatches []lockedpatch.LockedPatch) ([]lockedpatch.LockedPatch, map[string]string, error) {
+	patches := instance.GetPatches()
+	sortedPatchNames, err := redhatcopv1alpha1.SortPatchesByDependencies(patches)
+	if err != nil {
+		return nil, nil, err
+	}
+	lockedPatchStatuses := r.getPatchStatuses(instance)
+	previouslyEnforced := r.getEnforcedPatches(instance)
+	targetStatuses := instance.GetPatchStatus().TargetStatuses
+	now := time.Now()
+	enforced := map[string]bool{}
+	blockedPatches := map[string]string{}
+	for _, patchName := range sortedPatchNames {
+		if suspension := targetStatuses[patchName].Suspension; suspension.IsActive(instance.GetGeneration(), now) {
+			blockedPatches[patchName] = "enforcement suspended: " + suspension.Reason
+			continue
+		}
+		reason := ""
+		for _, dependency := range patches[patchName].DependsOn {
+			if !enforced[dependency] {
+				reason = "waiting for patch " + dependency + " to be enforced"
+				break
+			}
+			if !previouslyEnforced[patchName] && !hasSucceeded(lockedPatchStatuses[dependency], targetStatuses[dependency], getPatchHash(patches[dependency])) {
+				reason = "waiting for patch " + dependency + " to be successfully applied"
+				break
+			}
+		}
+		if reason != "" {
+			blockedPatches[patchName] = reason
+			continue
+		}
+		enforced[patchName] = true
+	}
+	enforceablePatches := []lockedpatch.LockedPatch{}
+	for i := range lockedPatches {
+		if enforced[lockedPatches[i].Name] {
+			enforceablePatches = append(enforceablePatches, lockedPatches[i])
+		}
+	}
+	if len(blockedPatches) == 0 {
+		blockedPatches = nil
+	}
+	return enforceablePatches, blockedPatches, nil
+}
+
+// hasSucceeded returns whether a patch has been applied and the last application succeeded on all of its targets.
+// The conditions that don't refer to a target only count when they are errors. The enforcing controller reports the targets one at a time,
+// so the patch has succeeded only once it has been applied to as many targets as were matched when the targets were last listed
+// for the current definition of the patch, as reported in targetsStatus, which is none when no target is matched.
+func hasSucceeded(conditionMap utilsv1alpha1.ConditionMap, targetsStatus redhatcopv1alpha1.PatchTargetsStatus, patchHash string) bool {
+	applied := 0
+	for key, conditions := range conditionMap {
+		lastCondition, ok := apis.GetLastCondition(conditions)
+		if key == reconcilerStatusKey {
+			if ok && lastCondition.Type == apis.ReconcileError {
+				return false
+			}
+			continue
+		}
+		if !ok || lastCondition.Type != apis.ReconcileSuccess {
+			return false
+		}
+		applied++
+	}
+	return conditionMap != nil && targetsStatus.PatchHash == patchHash && applied == targetsStatus.Matched
+}
+
+func (r *PatchReconciler) getEnforcedPatches(instance redhatcopv1alpha1.PatchObject) map[string]bool {
+	r.enforcedPatchesLock.Lock()
+	defer r.enforcedPatchesLock.Unlock()
+	return r.enforcedPatches[apis.GetKeyShort(instance)]
+}
+
+// setEnforcedPatches records the patches that are currently enforced for the instance
+func (r *PatchReconciler) setEnforcedPatches(instance redhatcopv1alpha1.PatchObject, lockedPatches []lockedpatch.LockedPatch) {
+	r.enforcedPatchesLock.Lock()
+	defer r.enforcedPatchesLock.Unlock()
+	if r.enforcedPatches == nil {
+		r.enforcedPatches = map[string]map[string]bool{}
+	}
+	enforced := map[string]bool{}
+	for i := range lockedPatches {
+		enforced[lockedPatches[i].Name] = true
+	}
+	r.enforcedPatches[apis.GetKeyShort(instance)] = enforced
+}
+
+func (r *PatchReconciler) removeEnforcedPatches(instance redhatcopv1alpha1.PatchObject) {
+	r.enforcedPatchesLock.Lock()
+	defer r.enforcedPatchesLock.Unlock()
+	delete(r.enforcedPatches, apis.GetKeyShort(instance))
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHasSucceeded(t *testing.T) {
+	now := time.Now()
+	initializing := []metav1.Condition{{Type: "Initializing", Status: metav1.ConditionTrue, Reason: "ReconcilerManagerRestarting", LastTransitionTime: metav1.NewTime(now)}}
+	tests := []struct {
+		name          string
+		conditionMap  utilsv1alpha1.ConditionMap
+		targetsStatus redhatcopv1alpha1.PatchTargetsStatus
+		expected      bool
+	}{
+		{
+			name:     "patch not enforced",
+			expected: false,
+		},
+		{
+			name:          "enforcing controller starting",
+			conditionMap:  utilsv1alpha1.ConditionMap{reconcilerStatusKey: initializing},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "old-hash"},
+			expected:      false,
+		},
+		{
+			name: "all targets applied",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				reconcilerStatusKey: initializing,
+				"default/a":         {newSuccessCondition(now)},
+				"default/b":         {newErrorCondition(now.Add(-time.Second), "conflict"), newSuccessCondition(now)},
+			},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "hash", Matched: 2},
+			expected:      true,
+		},
+		{
+			name: "some matched targets not yet reconciled",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				reconcilerStatusKey: initializing,
+				"default/a":         {newSuccessCondition(now)},
+			},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "hash", Matched: 5},
+			expected:      false,
+		},
+		{
+			name: "all targets applied with a previous definition",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				"default/a": {newSuccessCondition(now)},
+				"default/b": {newSuccessCondition(now)},
+			},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "old-hash", Matched: 2},
+			expected:      false,
+		},
+		{
+			name: "one target failed",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				"default/a": {newSuccessCondition(now)},
+				"default/b": {newSuccessCondition(now.Add(-time.Second)), newErrorCondition(now, "forbidden")},
+			},
+			expected: false,
+		},
+		{
+			name: "target not retrieved",
+			conditionMap: utilsv1alpha1.ConditionMap{
+				reconcilerStatusKey: {newErrorCondition(now, "forbidden")},
+				"default/a":         {newSuccessCondition(now)},
+			},
+			expected: false,
+		},
+		{
+			name:          "no target matched by the current definition",
+			conditionMap:  utilsv1alpha1.ConditionMap{reconcilerStatusKey: initializing},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "hash", Matched: 0},
+			expected:      true,
+		},
+		{
+			name:          "targets matched but not applied yet",
+			conditionMap:  utilsv1alpha1.ConditionMap{reconcilerStatusKey: initializing},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "hash", Matched: 2},
+			expected:      false,
+		},
+		{
+			name:          "no target matched by a previous definition",
+			conditionMap:  utilsv1alpha1.ConditionMap{reconcilerStatusKey: initializing},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "old-hash", Matched: 0},
+			expected:      false,
+		},
+		{
+			name:          "no target matched but the enforcing controller failed",
+			conditionMap:  utilsv1alpha1.ConditionMap{reconcilerStatusKey: {newErrorCondition(now, "forbidden")}},
+			targetsStatus: redhatcopv1alpha1.PatchTargetsStatus{PatchHash: "hash", Matched: 0},
+			expected:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := hasSucceeded(tt.conditionMap, tt.targetsStatus, "hash"); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// patchDrift tracks the changes made by a patch to its targets
+type patchDrift struct {
+	// patchHash is the hash of the patch definition, the tracking is reset when the patch changes because its targets are legitimately changed again
+	patchHash string
+	targets   map[string]*targetDrift
+}
+
+// targetDrift tracks the changes made by a patch to a target
+type targetDrift struct {
+	// lastChangeTime is the last time the patch operator changed the target, as recorded in its managedFields
+	lastChangeTime time.Time
+	// reapplications are the times at which the target had to be changed again
+	reapplications []time.Time
+	// conflictingFieldManager is the field manager that changed the target before the last reapplication
+	conflictingFieldManager string
+}
+
+// detectDrift updates the drift tracking of the targets of a patch, it returns the tracking by target key.
+// The enforcing controllers apply the patch again whenever a target changes, but the target is only modified if another actor reverted the patch.
+// So reapplications are recognized by the time of the last change made by the patch operator, as recorded in the managedFields of the target, moving forward.
+// A Warning event is emitted when the number of reapplications to a target within the drift window reaches the threshold.
+func (r *PatchReconciler) detectDrift(instance redhatcopv1alpha1.PatchObject, patchName string, patch redhatcopv1alpha1.PatchDefinition, targets []unstructured.Unstructured, now time.Time) map[string]*targetDrift {
+	r.patchDriftsLock.Lock()
+	defer r.patchDriftsLock.Unlock()
+	if r.patchDrifts == nil {
+		r.patchDrifts = map[string]map[string]*patchDrift{}
+	}
+	if _, ok := r.patchDrifts[apis.GetKeyShort(instance)]; !ok {
+		r.patchDrifts[apis.GetKeyShort(instance)] = map[string]*patchDrift{}
+	}
+	patchHash := getPatchHash(patch)
+	previous, ok := r.patchDrifts[apis.GetKeyShort(instance)][patchName]
+	if !ok || previous.patchHash != patchHash {
+		previous = &patchDrift{patchHash: patchHash, targets: map[string]*targetDrift{}}
+	}
+	current := &patchDrift{patchHash: patchHash, targets: map[string]*targetDrift{}}
+	window := patch.DriftPolicy.GetWindow()
+	threshold := patch.DriftPolicy.GetThreshold()
+	kind := getPatchObjectKind(instance)
+	for i := range targets {
+		key := apis.GetKeyShort(&targets[i])
+		lastChangeTime, conflictingFieldManager := getLastChange(&targets[i], patch.GetFieldManager())
+		drift, ok := previous.targets[key]
+		if !ok {
+			// the first observation is the baseline
+			current.targets[key] = &targetDrift{lastChangeTime: lastChangeTime}
+			continue
+		}
+		reapplications := []time.Time{}
+		for _, reapplication := range drift.reapplications {
+			if now.Sub(reapplication) < window {
+				reapplications = append(reapplications, reapplication)
+			}
+		}
+		previousCount := len(reapplications)
+		if !drift.lastChangeTime.IsZero() && lastChangeTime.After(drift.lastChangeTime) {
+			reapplications = append(reapplications, lastChangeTime)
+			drift.conflictingFieldManager = conflictingFieldManager
+			patchReapplications.WithLabelValues(kind, instance.GetNamespace(), instance.GetName(), patchName).Inc()
+		}
+		if previousCount < threshold && len(reapplications) >= threshold {
+			r.GetRecorder().Event(instance, "Warning", "PatchDrift", getDriftMessage(patchName, key, len(reapplications), window, drift.conflictingFieldManager))
+		}
+		current.targets[key] = &targetDrift{
+			lastChangeTime:          lastChangeTime,
+			reapplications:          reapplications,
+			conflictingFieldManager: drift.conflictingFieldManager,
+		}
+	}
+	r.patchDrifts[apis.GetKeyShort(instance)][patchName] = current
+	return current.targets
+}
+
+// getLastChange returns the last time the field manager of the patch changed the object and the field manager that changed it before then.
+// Changes to subresources are ignored, because patches are applied to the main resource.
+func getLastChange(obj *unstructured.Unstructured, fieldManager string) (time.Time, string) {
+	lastChangeTime := time.Time{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager == fieldManager && entry.Subresource == "" && entry.Time != nil && entry.Time.Time.After(lastChangeTime) {
+			lastChangeTime = entry.Time.Time
+		}
+	}
+	conflictingFieldManager := ""
+	conflictingChangeTime := time.Time{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager == fieldManager || entry.Subresource != "" || entry.Time == nil {
+			continue
+		}
+		if entry.Time.Time.After(lastChangeTime) || entry.Time.Time.Before(conflictingChangeTime) {
+			continue
+		}
+		conflictingFieldManager = entry.Manager
+		conflictingChangeTime = entry.Time.Time
+	}
+	return lastChangeTime, conflictingFieldManager
+}
+
+func getDriftMessage(patchName string, targetKey string, reapplications int, window time.Duration, conflictingFieldManager string) string {
+	actor := "another actor"
+	if conflictingFieldManager != "" {
+		actor = "field manager " + conflictingFieldManager
+	}
+	return fmt.Sprintf("patch %s was applied again %d times in %s to %s, it is being reverted by %s", patchName, reapplications, window, targetKey, actor)
+}
+
+// getPatchSuspension returns the suspension of the enforcement of a patch.
+// A still active suspension is kept, otherwise the enforcement is suspended if the drift action is Suspend and one of the targets reached the drift threshold.
+func (r *PatchReconciler) getPatchSuspension(instance redhatcopv1alpha1.PatchObject, patchName string, patch redhatcopv1alpha1.PatchDefinition, previous *redhatcopv1alpha1.PatchSuspension, drifts map[string]*targetDrift, now time.Time) *redhatcopv1alpha1.PatchSuspension {
+	if previous.IsActive(instance.GetGeneration(), now) {
+		return previous
+	}
+	if patch.DriftPolicy.GetAction() != redhatcopv1alpha1.SuspendDriftAction {
+		return nil
+	}
+	for key, drift := range drifts {
+		if len(drift.reapplications) < patch.DriftPolicy.GetThreshold() {
+			continue
+		}
+		suspension := &redhatcopv1alpha1.PatchSuspension{
+			Reason:             getDriftMessage(patchName, key, len(drift.reapplications), patch.DriftPolicy.GetWindow(), drift.conflictingFieldManager),
+			Since:              metav1.NewTime(now),
+			ObservedGeneration: instance.GetGeneration(),
+		}
+		if patch.DriftPolicy.SuspensionDuration != nil {
+			until := metav1.NewTime(now.Add(patch.DriftPolicy.SuspensionDuration.Duration))
+			suspension.Until = &until
+		}
+		r.GetRecorder().Event(instance, "Warning", "PatchSuspended", "enforcement of patch "+patchName+" suspended: "+suspension.Reason)
+		// start counting from scratch when the enforcement is resumed
+		r.resetDrift(instance, patchName)
+		return suspension
+	}
+	return nil
+}
+
+func (r *PatchReconciler) resetDrift(instance redhatcopv1alpha1.PatchObject, patchName string) {
+	r.patchDriftsLock.Lock()
+	defer r.patchDriftsLock.Unlock()
+	delete(r.patchDrifts[apis.GetKeyShort(instance)], patchName)
+}
+
+// pruneDrift forgets the patches that are no longer defined by the instance
+func (r *PatchReconciler) pruneDrift(instance redhatcopv1alpha1.PatchObject) {
+	r.patchDriftsLock.Lock()
+	defer r.patchDriftsLock.Unlock()
+	for patchName := range r.patchDrifts[apis.GetKeyShort(instance)] {
+		if _, ok := instance.GetPatches()[patchName]; !ok {
+			delete(r.patchDrifts[apis.GetKeyShort(instance)], patchName)
+		}
+	}
+}
+
+func (r *PatchReconciler) removeDrift(instance redhatcopv1alpha1.PatchObject) {
+	r.patchDriftsLock.Lock()
+	defer r.patchDriftsLock.Unlock()
+	delete(r.patchDrifts, apis.GetKeyShort(instance))
+}
+
+// getNextResumeTime returns the earliest time at which a suspended patch will be enforced again
+func getNextResumeTime(status *redhatcopv1alpha1.PatchStatus, generation int64, now time.Time) (time.Time, bool) {
+	next := time.Time{}
+	found := false
+	for _, targetsStatus := range status.TargetStatuses {
+		suspension := targetsStatus.Suspension
+		if !suspension.IsActive(generation, now) || suspension.Until == nil {
+			continue
+		}
+		if !found || suspension.Until.Time.Before(next) {
+			next = suspension.Until.Time
+			found = true
+		}
+	}
+	return next, found
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+func newManagedFieldsEntry(manager string, subresource string, changeTime time.Time) metav1.ManagedFieldsEntry {
+	entryTime := metav1.NewTime(changeTime)
+	return metav1.ManagedFieldsEntry{Manager: manager, Operation: metav1.ManagedFieldsOperationUpdate, Subresource: subresource, Time: &entryTime}
+}
+
+func newDriftTarget(managedFields ...metav1.ManagedFieldsEntry) unstructured.Unstructured {
+	target := newTestObject("v1", "ConfigMap", "default", "target", nil)
+	target.SetManagedFields(managedFields)
+	return *target
+}
+
+func TestGetLastChange(t *testing.T) {
+	t0 := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name                            string
+		managedFields                   []metav1.ManagedFieldsEntry
+		expectedLastChangeTime          time.Time
+		expectedConflictingFieldManager string
+	}{
+		{
+			name: "never changed by the patch operator",
+			managedFields: []metav1.ManagedFieldsEntry{
+				newManagedFieldsEntry("kubectl", "", t0),
+			},
+		},
+		{
+			name: "changed by the patch operator only",
+			managedFields: []metav1.ManagedFieldsEntry{
+				newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0),
+			},
+			expectedLastChangeTime: t0,
+		},
+		{
+			name: "last conflicting change before the change of the patch operator",
+			managedFields: []metav1.ManagedFieldsEntry{
+				newManagedFieldsEntry("kubectl", "", t0),
+				newManagedFieldsEntry("argocd", "", t0.Add(time.Second)),
+				newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(2*time.Second)),
+				newManagedFieldsEntry("helm", "", t0.Add(3*time.Second)),
+			},
+			expectedLastChangeTime:          t0.Add(2 * time.Second),
+			expectedConflictingFieldManager: "argocd",
+		},
+		{
+			name: "subresource changes ignored",
+			managedFields: []metav1.ManagedFieldsEntry{
+				newManagedFieldsEntry("kubectl", "", t0),
+				newManagedFieldsEntry("kube-controller-manager", "status", t0.Add(time.Second)),
+				newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "status", t0.Add(3*time.Second)),
+				newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(2*time.Second)),
+			},
+			expectedLastChangeTime:          t0.Add(2 * time.Second),
+			expectedConflictingFieldManager: "kubectl",
+		},
+		{
+			name: "entries without time ignored",
+			managedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationUpdate},
+				newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0),
+			},
+			expectedLastChangeTime: t0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newDriftTarget(tt.managedFields...)
+			lastChangeTime, conflictingFieldManager := getLastChange(&target, redhatcopv1alpha1.DefaultFieldManager)
+			if !lastChangeTime.Equal(tt.expectedLastChangeTime) {
+				t.Errorf("expected last change time %v, got %v", tt.expectedLastChangeTime, lastChangeTime)
+			}
+			if conflictingFieldManager != tt.expectedConflictingFieldManager {
+				t.Errorf("expected conflicting field manager %q, got %q", tt.expectedConflictingFieldManager, conflictingFieldManager)
+			}
+		})
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	t0 := time.Now().Truncate(time.Second)
+	window := 10 * time.Minute
+	patch := redhatcopv1alpha1.PatchDefinition{
+		DriftPolicy: &redhatcopv1alpha1.DriftPolicy{Window: &metav1.Duration{Duration: window}, Threshold: 2},
+	}
+	changedPatch := *patch.DeepCopy()
+	changedPatch.PatchTemplate = "metadata: {labels: {changed: 'true'}}"
+
+	steps := []struct {
+		name                            string
+		patch                           redhatcopv1alpha1.PatchDefinition
+		target                          unstructured.Unstructured
+		now                             time.Time
+		expectedReapplications          int
+		expectedConflictingFieldManager string
+		expectedEvent                   bool
+	}{
+		{
+			name:   "first observation is the baseline",
+			patch:  patch,
+			target: newDriftTarget(newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0)),
+			now:    t0,
+		},
+		{
+			name:   "target not changed again",
+			patch:  patch,
+			target: newDriftTarget(newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0)),
+			now:    t0.Add(time.Minute),
+		},
+		{
+			name:                            "target reverted and patched again",
+			patch:                           patch,
+			target:                          newDriftTarget(newManagedFieldsEntry("kubectl", "", t0.Add(time.Minute)), newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(2*time.Minute))),
+			now:                             t0.Add(2 * time.Minute),
+			expectedReapplications:          1,
+			expectedConflictingFieldManager: "kubectl",
+		},
+		{
+			name:                            "threshold reached",
+			patch:                           patch,
+			target:                          newDriftTarget(newManagedFieldsEntry("kubectl", "", t0.Add(2*time.Minute)), newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(3*time.Minute))),
+			now:                             t0.Add(3 * time.Minute),
+			expectedReapplications:          2,
+			expectedConflictingFieldManager: "kubectl",
+			expectedEvent:                   true,
+		},
+		{
+			name:                            "reapplications outside of the window forgotten",
+			patch:                           patch,
+			target:                          newDriftTarget(newManagedFieldsEntry("kubectl", "", t0.Add(2*time.Minute)), newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(3*time.Minute))),
+			now:                             t0.Add(2*time.Minute + window),
+			expectedReapplications:          1,
+			expectedConflictingFieldManager: "kubectl",
+		},
+		{
+			name:   "tracking reset when the patch changes",
+			patch:  changedPatch,
+			target: newDriftTarget(newManagedFieldsEntry("kubectl", "", t0.Add(13*time.Minute)), newManagedFieldsEntry(redhatcopv1alpha1.DefaultFieldManager, "", t0.Add(14*time.Minute))),
+			now:    t0.Add(14 * time.Minute),
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := NewPatchReconciler(util.NewReconcilerBase(nil, nil, nil, recorder, nil), nil)
+	instance := &redhatcopv1alpha1.Patch{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+	for _, step := range steps {
+		drifts := r.detectDrift(instance, "test", step.patch, []unstructured.Unstructured{step.target}, step.now)
+		drift, ok := drifts["default/target"]
+		if !ok {
+			t.Fatalf("%s: expected the target to be tracked", step.name)
+		}
+		if len(drift.reapplications) != step.expectedReapplications {
+			t.Errorf("%s: expected %d reapplications, got %d", step.name, step.expectedReapplications, len(drift.reapplications))
+		}
+		if drift.conflictingFieldManager != step.expectedConflictingFieldManager {
+			t.Errorf("%s: expected conflicting field manager %q, got %q", step.name, step.expectedConflictingFieldManager, drift.conflictingFieldManager)
+		}
+		select {
+		case event := <-recorder.Events:
+			if !step.expectedEvent {
+				t.Errorf("%s: unexpected event %s", step.name, event)
+			} else if !strings.Contains(event, "PatchDrift") || !strings.Contains(event, "kubectl") {
+				t.Errorf("%s: unexpected event %s", step.name, event)
+			}
+		default:
+			if step.expectedEvent {
+				t.Errorf("%s: expected a PatchDrift event", step.name)
+			}
+		}
+	}
+}
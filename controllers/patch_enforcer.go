@@ -0,0 +1,432 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	"github.com/redhat-cop/operator-utils/pkg/util/stoppablemanager"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// reconcilerStatusKey is the key of the conditions that don't refer to a target, such as the failure to get the target, in the statuses of the enforcing controllers
+const reconcilerStatusKey = "reconciler"
+
+// patchEnforcer runs the controllers enforcing the patches of a Patch or ClusterPatch, with the rest config of the service account of the instance.
+// It replaces the LockedResourceManager of operator-utils, which sends the rendered patches without options, so that the enforcing controllers send each patch with its own options.
+// The statuses reported by the controllers have the same format as the ones of the LockedPatchReconciler of operator-utils,
+// their changes are signaled to the parent controller through a statusChangeNotifier, which coalesces them and never blocks the controllers.
+type patchEnforcer struct {
+	stoppableManager *stoppablemanager.StoppableManager
+	patches          []lockedpatch.LockedPatch
+	options          map[string]patchOptions
+	revert           *revertRecorder
+	reconcilers      []*patchEnforcingReconciler
+}
+
+// isStarted returns whether the enforcing controllers are running
+func (e *patchEnforcer) isStarted() bool {
+	return e.stoppableManager != nil && e.stoppableManager.IsStarted()
+}
+
+// isSame returns whether the enforced patches, their options and the recorded patches are the same as the passed ones
+func (e *patchEnforcer) isSame(patches []lockedpatch.LockedPatch, options map[string]patchOptions, revert *revertRecorder) bool {
+	if len(patches) != len(e.patches) || !reflect.DeepEqual(options, e.options) || !reflect.DeepEqual(revert.getPatchHashes(), e.revert.getPatchHashes()) {
+		return false
+	}
+	currentPatches := map[string]string{}
+	for i := range e.patches {
+		bb, err := json.Marshal(e.patches[i])
+		if err != nil {
+			return false
+		}
+		currentPatches[e.patches[i].Name] = string(bb)
+	}
+	for i := range patches {
+		bb, err := json.Marshal(patches[i])
+		if err != nil || currentPatches[patches[i].Name] != string(bb) {
+			return false
+		}
+	}
+	return true
+}
+
+// start creates a manager with the rest config of the service account and starts one controller per patch, revert records the targets of the patches with the Revert deletion policy
+func (e *patchEnforcer) start(ctx context.Context, parent redhatcopv1alpha1.PatchObject, patches []lockedpatch.LockedPatch, options map[string]patchOptions, revert *revertRecorder, config *rest.Config, models modelGetter, requestDuration prometheus.Observer, statusChanges *statusChangeNotifier) error {
+	stoppableManager, err := stoppablemanager.NewStoppableManager(config, manager.Options{
+		// the metrics of the enforcing controllers are exported by the operator
+		MetricsBindAddress: "0",
+		LeaderElection:     false,
+	})
+	if err != nil {
+		return err
+	}
+	reconcilers := []*patchEnforcingReconciler{}
+	for i := range patches {
+		reconciler, err := newPatchEnforcingReconciler(stoppableManager.Manager, parent, patches[i], options[patches[i].Name], revert, models, requestDuration, statusChanges)
+		if err != nil {
+			return err
+		}
+		reconcilers = append(reconcilers, reconciler)
+	}
+	e.stoppableManager = &stoppableManager
+	e.patches = patches
+	e.options = options
+	e.revert = revert
+	e.reconcilers = reconcilers
+	e.stoppableManager.Start(ctx)
+	return nil
+}
+
+// stop stops the enforcing controllers, the targets are left as they are
+func (e *patchEnforcer) stop() {
+	if e.isStarted() {
+		e.stoppableManager.Stop()
+	}
+}
+
+// getStatuses returns the conditions reported by the enforcing controllers, by patch name and target key
+func (e *patchEnforcer) getStatuses() map[string]utilsv1alpha1.ConditionMap {
+	statuses := map[string]utilsv1alpha1.ConditionMap{}
+	for _, reconciler := range e.reconcilers {
+		statuses[reconciler.patch.Name] = reconciler.getStatus()
+	}
+	return statuses
+}
+
+// patchEnforcingReconciler applies a patch to each of its targets, every time the target or one of the source objects changes.
+type patchEnforcingReconciler struct {
+	restConfig *rest.Config
+	patch      lockedpatch.LockedPatch
+	options    patchOptions
+	// revert is nil when no patch of the parent has the Revert deletion policy
+	revert *revertRecorder
+	models modelGetter
+	// requestDuration observes the latency of the patch requests sent to the targets
+	requestDuration prometheus.Observer
+	parent          client.Object
+	statusChanges   *statusChangeNotifier
+	statusLock      sync.Mutex
+	status          utilsv1alpha1.ConditionMap
+	log             logr.Logger
+}
+
+func newPatchEnforcingReconciler(mgr manager.Manager, parent redhatcopv1alpha1.PatchObject, patch lockedpatch.LockedPatch, options patchOptions, revert *revertRecorder, models modelGetter, requestDuration prometheus.Observer, statusChanges *statusChangeNotifier) (*patchEnforcingReconciler, error) {
+	reconciler := &patchEnforcingReconciler{
+		restConfig:      mgr.GetConfig(),
+		patch:           patch,
+		options:         options,
+		revert:          revert,
+		models:          models,
+		requestDuration: requestDuration,
+		parent:          parent,
+		statusChanges:   statusChanges,
+		status: utilsv1alpha1.ConditionMap{
+			reconcilerStatusKey: []metav1.Condition{{
+				Type:               "Initializing",
+				LastTransitionTime: metav1.Now(),
+				Status:             metav1.ConditionTrue,
+				Reason:             "ReconcilerManagerRestarting",
+			}},
+		},
+		log: ctrl.Log.WithName("patch-enforcer").WithName(apis.GetKeyShort(parent)).WithName(patch.Name),
+	}
+	enforcingController, err := controller.New("patch-enforcer_"+patch.Name, mgr, controller.Options{Reconciler: reconciler})
+	if err != nil {
+		return nil, err
+	}
+	err = enforcingController.Watch(&source.Kind{Type: newUnstructured(patch.TargetObjectRef.APIVersion, patch.TargetObjectRef.Kind)}, &handler.EnqueueRequestForObject{}, predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return reconciler.selects(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return reconciler.selects(e.ObjectNew) && !isSameObject(e.ObjectNew, e.ObjectOld, "")
+		},
+		// a deleted target doesn't need to be patched
+		DeleteFunc: func(event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(event.GenericEvent) bool {
+			return false
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range patch.SourceObjectRefs {
+		sourceObjectRef := patch.SourceObjectRefs[i]
+		err = enforcingController.Watch(&source.Kind{Type: newUnstructured(sourceObjectRef.APIVersion, sourceObjectRef.Kind)}, handler.EnqueueRequestsFromMapFunc(func(object client.Object) []reconcile.Request {
+			return reconciler.getSourceRequests(&sourceObjectRef, object)
+		}), predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				return mayBeSource(&sourceObjectRef, e.Object)
+			},
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return mayBeSource(&sourceObjectRef, e.ObjectNew) && !isSameObject(e.ObjectNew, e.ObjectOld, sourceObjectRef.FieldPath)
+			},
+			// the patch cannot be rendered without its sources
+			DeleteFunc: func(event.DeleteEvent) bool {
+				return false
+			},
+			GenericFunc: func(event.GenericEvent) bool {
+				return false
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reconciler, nil
+}
+
+func newUnstructured(apiVersion string, kind string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	return obj
+}
+
+// getContext returns a context with the logger and the rest config expected by the operator-utils object references
+func (r *patchEnforcingReconciler) getContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, "restConfig", r.restConfig)
+	return log.IntoContext(ctx, r.log)
+}
+
+// selects returns whether the object is selected by the target reference of the patch
+func (r *patchEnforcingReconciler) selects(object client.Object) bool {
+	selected, err := r.patch.TargetObjectRef.Selects(r.getContext(context.TODO()), object)
+	if err != nil {
+		r.log.Error(err, "unable to determine if the object is selected", "object", apis.GetKeyShort(object))
+		return false
+	}
+	return selected
+}
+
+// mayBeSource filters the events of the source objects, when the name and namespace of the source are not templates only that object can be a source
+func mayBeSource(sourceObjectRef *utilsv1alpha1.SourceObjectReference, object client.Object) bool {
+	if strings.Contains(sourceObjectRef.Name, "{{") || strings.Contains(sourceObjectRef.Namespace, "{{") {
+		return true
+	}
+	return object.GetName() == sourceObjectRef.Name && object.GetNamespace() == sourceObjectRef.Namespace
+}
+
+// getSourceRequests returns the requests of the targets for which the object is the source
+func (r *patchEnforcingReconciler) getSourceRequests(sourceObjectRef *utilsv1alpha1.SourceObjectReference, object client.Object) []reconcile.Request {
+	ctx := r.getContext(context.TODO())
+	targets, err := getTargetObjects(ctx, &r.patch.TargetObjectRef)
+	if err != nil {
+		r.log.Error(err, "unable to get targets")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for i := range targets {
+		name, namespace, err := sourceObjectRef.GetNameAndNamespace(ctx, &targets[i])
+		if err != nil {
+			r.log.Error(err, "unable to process name and namespace templates", "source", sourceObjectRef, "target", getTargetKey(&targets[i]))
+			continue
+		}
+		if name == object.GetName() && namespace == object.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: targets[i].GetNamespace(), Name: targets[i].GetName()}})
+		}
+	}
+	return requests
+}
+
+// isSameObject returns whether the objects are the same, ignoring the fields that change on every update. When fieldPath is set, only that field is compared.
+func isSameObject(newObject client.Object, oldObject client.Object, fieldPath string) bool {
+	newUnstructured, ok := newObject.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	oldUnstructured, ok := oldObject.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	if fieldPath != "" {
+		ctx := context.TODO()
+		newField, newErr := getSubMapFromObject(ctx, newUnstructured, fieldPath)
+		oldField, oldErr := getSubMapFromObject(ctx, oldUnstructured, fieldPath)
+		return newErr == nil && oldErr == nil && reflect.DeepEqual(newField, oldField)
+	}
+	newUnstructured = newUnstructured.DeepCopy()
+	oldUnstructured = oldUnstructured.DeepCopy()
+	for _, obj := range []*unstructured.Unstructured{newUnstructured, oldUnstructured} {
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+	}
+	return reflect.DeepEqual(newUnstructured.Object, oldUnstructured.Object)
+}
+
+// Reconcile renders the patch for the target and applies it, the targets of patches with the Revert deletion policy are only patched once their revert record is stored
+func (r *patchEnforcingReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	ctx = r.getContext(ctx)
+	target, err := r.patch.TargetObjectRef.GetReferencedObjectWithName(ctx, req.NamespacedName)
+	if apierrors.IsNotFound(err) {
+		// the target was deleted, its status must not hold back the patches that depend on this one
+		r.removeStatus(req.NamespacedName.String())
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		r.log.Error(err, "unable to retrieve", "target", req.NamespacedName)
+		return r.manageError(reconcilerStatusKey, 0, err)
+	}
+	patch, err := renderPatch(ctx, &r.patch, target)
+	if err != nil {
+		return r.manageError(apis.GetKeyShort(target), target.GetGeneration(), err)
+	}
+	if r.revert.isRecorded(r.patch.Name) {
+		err = r.revert.record(ctx, r.patch.Name, target, func() ([]byte, error) {
+			return computeRevertPatch(ctx, r.models, target, r.patch.PatchType, patch, r.options)
+		})
+		if err != nil {
+			r.log.Error(err, "unable to record the revert patch of", "target", getTargetKey(target))
+			return r.manageError(apis.GetKeyShort(target), target.GetGeneration(), err)
+		}
+	}
+	start := time.Now()
+	_, err = patchTarget(ctx, r.models, target, r.patch.PatchType, patch, r.options)
+	r.requestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		r.log.Error(err, "unable to apply", "patch", string(patch), "on target", getTargetKey(target))
+		return r.manageError(apis.GetKeyShort(target), target.GetGeneration(), err)
+	}
+	return r.manageSuccess(apis.GetKeyShort(target), target.GetGeneration())
+}
+
+func (r *patchEnforcingReconciler) manageError(key string, generation int64, err error) (reconcile.Result, error) {
+	r.setCondition(key, metav1.Condition{
+		Type:               apis.ReconcileError,
+		LastTransitionTime: metav1.Now(),
+		Message:            err.Error(),
+		Reason:             apis.ReconcileErrorReason,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+	})
+	return reconcile.Result{}, err
+}
+
+func (r *patchEnforcingReconciler) manageSuccess(key string, generation int64) (reconcile.Result, error) {
+	r.setCondition(key, metav1.Condition{
+		Type:               apis.ReconcileSuccess,
+		LastTransitionTime: metav1.Now(),
+		Reason:             apis.ReconcileSuccessReason,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+	})
+	return reconcile.Result{}, nil
+}
+
+// setCondition records the condition of the target and notifies the parent reconciler, which reports it in the status of the instance
+func (r *patchEnforcingReconciler) setCondition(key string, condition metav1.Condition) {
+	r.statusLock.Lock()
+	r.status[key] = apis.AddOrReplaceCondition(condition, r.status[key])
+	r.statusLock.Unlock()
+	r.statusChanges.notify(r.parent)
+}
+
+// removeStatus forgets the conditions of a target
+func (r *patchEnforcingReconciler) removeStatus(key string) {
+	r.statusLock.Lock()
+	_, ok := r.status[key]
+	delete(r.status, key)
+	r.statusLock.Unlock()
+	if ok {
+		r.statusChanges.notify(r.parent)
+	}
+}
+
+func (r *patchEnforcingReconciler) getStatus() utilsv1alpha1.ConditionMap {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	status := utilsv1alpha1.ConditionMap{}
+	for key, conditions := range r.status {
+		status[key] = conditions
+	}
+	return status
+}
+
+// updateEnforcedPatches starts enforcing the patches of the instance with the passed rest config, the enforcing controllers are restarted only if the patches or their options changed
+func (r *PatchReconciler) updateEnforcedPatches(ctx context.Context, instance redhatcopv1alpha1.PatchObject, lockedPatches []lockedpatch.LockedPatch, options map[string]patchOptions, config *rest.Config) error {
+	r.patchEnforcersLock.Lock()
+	defer r.patchEnforcersLock.Unlock()
+	if r.patchEnforcers == nil {
+		r.patchEnforcers = map[string]*patchEnforcer{}
+	}
+	revert := r.newRevertRecorder(instance)
+	enforcer, ok := r.patchEnforcers[apis.GetKeyShort(instance)]
+	if ok && enforcer.isStarted() && enforcer.isSame(lockedPatches, options, revert) {
+		return nil
+	}
+	if ok {
+		enforcer.stop()
+	}
+	enforcer = &patchEnforcer{}
+	r.patchEnforcers[apis.GetKeyShort(instance)] = enforcer
+	requestDuration := patchRequestDuration.WithLabelValues(getPatchObjectKind(instance), instance.GetNamespace(), instance.GetName())
+	return enforcer.start(ctx, instance, lockedPatches, options, revert, config, r.getModels(), requestDuration, r.statusChanges)
+}
+
+// stopEnforcing stops the enforcing controllers of the instance, the targets are left as they are
+func (r *PatchReconciler) stopEnforcing(instance redhatcopv1alpha1.PatchObject) {
+	r.patchEnforcersLock.Lock()
+	defer r.patchEnforcersLock.Unlock()
+	if enforcer, ok := r.patchEnforcers[apis.GetKeyShort(instance)]; ok {
+		enforcer.stop()
+		delete(r.patchEnforcers, apis.GetKeyShort(instance))
+	}
+}
+
+// getPatchStatuses returns the statuses reported by the enforcing controllers of the instance, by patch name and target key
+func (r *PatchReconciler) getPatchStatuses(instance redhatcopv1alpha1.PatchObject) map[string]utilsv1alpha1.ConditionMap {
+	r.patchEnforcersLock.Lock()
+	defer r.patchEnforcersLock.Unlock()
+	enforcer, ok := r.patchEnforcers[apis.GetKeyShort(instance)]
+	if !ok {
+		return map[string]utilsv1alpha1.ConditionMap{}
+	}
+	return enforcer.getStatuses()
+}
+
+// getStatusChanges returns the channel through which the enforcing controllers signal a change of their statuses, the changes of an instance are coalesced
+func (r *PatchReconciler) getStatusChanges() <-chan event.GenericEvent {
+	return r.statusChanges.getChanges()
+}
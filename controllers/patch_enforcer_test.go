@@ -0,0 +1,231 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newTestEnforcedPatch(name string, template string) lockedpatch.LockedPatch {
+	return lockedpatch.LockedPatch{
+		Name:          name,
+		PatchTemplate: template,
+		PatchType:     types.MergePatchType,
+		TargetObjectRef: utilsv1alpha1.TargetObjectReference{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Namespace:  "test",
+		},
+	}
+}
+
+func TestPatchEnforcerIsSame(t *testing.T) {
+	patches := []lockedpatch.LockedPatch{newTestEnforcedPatch("a", "data: {a: a}"), newTestEnforcedPatch("b", "data: {b: b}")}
+	options := map[string]patchOptions{"a": {}, "b": {fieldManager: "test", force: true}}
+	revert := &revertRecorder{patchHashes: map[string]string{"a": "hash"}}
+	enforcer := &patchEnforcer{patches: patches, options: options, revert: revert}
+	tests := []struct {
+		name     string
+		patches  []lockedpatch.LockedPatch
+		options  map[string]patchOptions
+		revert   *revertRecorder
+		expected bool
+	}{
+		{
+			name:     "same patches in another order",
+			patches:  []lockedpatch.LockedPatch{patches[1], patches[0]},
+			options:  map[string]patchOptions{"a": {}, "b": {fieldManager: "test", force: true}},
+			revert:   &revertRecorder{patchHashes: map[string]string{"a": "hash"}},
+			expected: true,
+		},
+		{
+			name:    "patch template changed",
+			patches: []lockedpatch.LockedPatch{patches[0], newTestEnforcedPatch("b", "data: {b: c}")},
+			options: options,
+			revert:  revert,
+		},
+		{
+			name:    "patch removed",
+			patches: patches[:1],
+			options: map[string]patchOptions{"a": {}},
+			revert:  revert,
+		},
+		{
+			name:    "options changed",
+			patches: patches,
+			options: map[string]patchOptions{"a": {}, "b": {fieldManager: "test"}},
+			revert:  revert,
+		},
+		{
+			name:    "revert deletion policy removed",
+			patches: patches,
+			options: options,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := enforcer.isSame(tt.patches, tt.options, tt.revert); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPatchEnforcingReconcilerStatus(t *testing.T) {
+	parent := &redhatcopv1alpha1.Patch{}
+	parent.Name = "test"
+	parent.Namespace = "test"
+	notifier := newStatusChangeNotifier(0)
+	reconciler := &patchEnforcingReconciler{
+		patch:         newTestEnforcedPatch("a", "data: {a: a}"),
+		parent:        parent,
+		statusChanges: notifier,
+		status:        utilsv1alpha1.ConditionMap{},
+	}
+	expectNotified := func(expected bool) {
+		t.Helper()
+		if notified := notifier.queue.Len() > 0 || len(notifier.pending) > 0; notified != expected {
+			t.Fatalf("expected a status change notification: %t, got %t", expected, notified)
+		}
+		for notifier.queue.Len() > 0 {
+			item, _ := notifier.queue.Get()
+			notifier.queue.Done(item)
+		}
+		notifier.pending = map[types.NamespacedName]client.Object{}
+	}
+
+	_, err := reconciler.manageError("test/a", 1, errors.New("forbidden"))
+	if err == nil {
+		t.Fatalf("expected the error to be returned")
+	}
+	expectNotified(true)
+	reconciler.manageSuccess("test/a", 1)
+	expectNotified(true)
+	reconciler.manageSuccess("test/b", 2)
+	expectNotified(true)
+
+	status := reconciler.getStatus()
+	if len(status) != 2 {
+		t.Fatalf("expected the conditions of 2 targets, got %v", status)
+	}
+	for _, key := range []string{"test/a", "test/b"} {
+		lastCondition, ok := apis.GetLastCondition(status[key])
+		if !ok || lastCondition.Type != apis.ReconcileSuccess {
+			t.Errorf("expected the last condition of %s to be a success, got %v", key, status[key])
+		}
+	}
+	// the returned status is a copy
+	delete(status, "test/a")
+	if _, ok := reconciler.getStatus()["test/a"]; !ok {
+		t.Errorf("expected the status of the reconciler not to be modified by its callers")
+	}
+
+	// a deleted target is forgotten, forgetting an unknown target doesn't change the status
+	reconciler.removeStatus("test/b")
+	expectNotified(true)
+	reconciler.removeStatus("test/c")
+	expectNotified(false)
+	if _, ok := reconciler.getStatus()["test/b"]; ok {
+		t.Errorf("expected the status of the deleted target to be removed")
+	}
+}
+
+func TestMayBeSource(t *testing.T) {
+	object := newUnstructured("v1", "ConfigMap")
+	object.SetNamespace("test")
+	object.SetName("source")
+	tests := []struct {
+		name            string
+		sourceObjectRef utilsv1alpha1.SourceObjectReference
+		expected        bool
+	}{
+		{name: "same object", sourceObjectRef: utilsv1alpha1.SourceObjectReference{Name: "source", Namespace: "test"}, expected: true},
+		{name: "other name", sourceObjectRef: utilsv1alpha1.SourceObjectReference{Name: "other", Namespace: "test"}},
+		{name: "other namespace", sourceObjectRef: utilsv1alpha1.SourceObjectReference{Name: "source", Namespace: "other"}},
+		{name: "templated name", sourceObjectRef: utilsv1alpha1.SourceObjectReference{Name: "{{ .metadata.name }}", Namespace: "other"}, expected: true},
+		{name: "templated namespace", sourceObjectRef: utilsv1alpha1.SourceObjectReference{Name: "other", Namespace: "{{ .metadata.namespace }}"}, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := mayBeSource(&tt.sourceObjectRef, object); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIsSameObject(t *testing.T) {
+	newConfigMap := func(resourceVersion string, data map[string]interface{}, labels map[string]string) *unstructured.Unstructured {
+		object := newUnstructured("v1", "ConfigMap")
+		object.SetName("test")
+		object.SetResourceVersion(resourceVersion)
+		object.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "test-" + resourceVersion, Time: &metav1.Time{Time: time.Now()}}})
+		object.SetLabels(labels)
+		object.Object["data"] = data
+		return object
+	}
+	tests := []struct {
+		name      string
+		newObject *unstructured.Unstructured
+		oldObject *unstructured.Unstructured
+		fieldPath string
+		expected  bool
+	}{
+		{
+			name:      "only the resource version and managed fields changed",
+			newObject: newConfigMap("2", map[string]interface{}{"a": "a"}, nil),
+			oldObject: newConfigMap("1", map[string]interface{}{"a": "a"}, nil),
+			expected:  true,
+		},
+		{
+			name:      "data changed",
+			newObject: newConfigMap("2", map[string]interface{}{"a": "b"}, nil),
+			oldObject: newConfigMap("1", map[string]interface{}{"a": "a"}, nil),
+		},
+		{
+			name:      "field path unchanged",
+			newObject: newConfigMap("2", map[string]interface{}{"a": "a"}, map[string]string{"changed": "true"}),
+			oldObject: newConfigMap("1", map[string]interface{}{"a": "a"}, nil),
+			fieldPath: "$.data",
+			expected:  true,
+		},
+		{
+			name:      "field path changed",
+			newObject: newConfigMap("2", map[string]interface{}{"a": "b"}, nil),
+			oldObject: newConfigMap("1", map[string]interface{}{"a": "a"}, nil),
+			fieldPath: "$.data",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := isSameObject(tt.newObject, tt.oldObject, tt.fieldPath); actual != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, actual)
+			}
+		})
+	}
+}
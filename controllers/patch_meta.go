@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+)
+
+// the list markers of CRD schemas, see https://kubernetes.io/docs/reference/using-api/server-side-apply/#merge-strategy
+const (
+	listTypeExtension    = "x-kubernetes-list-type"
+	listMapKeysExtension = "x-kubernetes-list-map-keys"
+	mapListType          = "map"
+	setListType          = "set"
+	mergePatchStrategy   = "merge"
+)
+
+// listTypePatchMeta is the patch metadata of an OpenAPI model, the lists that don't declare a patch strategy get one from their list markers.
+// CRD schemas cannot declare x-kubernetes-patch-strategy and x-kubernetes-patch-merge-key, so without the translation strategic merge patches replace all their lists.
+// Lists of type map are merged by their key, lists of type set are merged as sets of primitives. Strategic merge patches only support a single merge key, so lists of type map with more than one key are replaced.
+type listTypePatchMeta struct {
+	strategicpatch.PatchMetaFromOpenAPI
+}
+
+var _ strategicpatch.LookupPatchMeta = listTypePatchMeta{}
+
+// newPatchMetaFromOpenAPI returns the patch metadata of the model, the model can be nil in which case lists are replaced, as they are by merge patches
+func newPatchMetaFromOpenAPI(model openapi.Schema) strategicpatch.LookupPatchMeta {
+	if model == nil {
+		return replaceListsPatchMeta{}
+	}
+	return listTypePatchMeta{strategicpatch.NewPatchMetaFromOpenAPI(model)}
+}
+
+// replaceListsPatchMeta is the patch metadata of an unknown model, no field declares a patch strategy
+type replaceListsPatchMeta struct{}
+
+var _ strategicpatch.LookupPatchMeta = replaceListsPatchMeta{}
+
+func (s replaceListsPatchMeta) LookupPatchMetadataForStruct(string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	return s, strategicpatch.PatchMeta{}, nil
+}
+
+func (s replaceListsPatchMeta) LookupPatchMetadataForSlice(string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	return s, strategicpatch.PatchMeta{}, nil
+}
+
+func (s replaceListsPatchMeta) Name() string {
+	return ""
+}
+
+func (s listTypePatchMeta) LookupPatchMetadataForStruct(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	lookupPatchMeta, patchMeta, err := s.PatchMetaFromOpenAPI.LookupPatchMetadataForStruct(key)
+	return wrapLookupPatchMeta(lookupPatchMeta), patchMeta, err
+}
+
+func (s listTypePatchMeta) LookupPatchMetadataForSlice(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	lookupPatchMeta, patchMeta, err := s.PatchMetaFromOpenAPI.LookupPatchMetadataForSlice(key)
+	if err != nil {
+		return nil, patchMeta, err
+	}
+	if len(patchMeta.GetPatchStrategies()) == 0 {
+		setListTypePatchMeta(&patchMeta, getFieldModel(s.Schema, key), lookupPatchMeta)
+	}
+	return wrapLookupPatchMeta(lookupPatchMeta), patchMeta, nil
+}
+
+func wrapLookupPatchMeta(lookupPatchMeta strategicpatch.LookupPatchMeta) strategicpatch.LookupPatchMeta {
+	if patchMetaFromOpenAPI, ok := lookupPatchMeta.(strategicpatch.PatchMetaFromOpenAPI); ok {
+		return listTypePatchMeta{patchMetaFromOpenAPI}
+	}
+	return lookupPatchMeta
+}
+
+// setListTypePatchMeta sets the patch strategy and merge key of a list from its list markers
+func setListTypePatchMeta(patchMeta *strategicpatch.PatchMeta, list openapi.Schema, items strategicpatch.LookupPatchMeta) {
+	if list == nil {
+		return
+	}
+	extensions := list.GetExtensions()
+	switch extensions[listTypeExtension] {
+	case mapListType:
+		keys, ok := extensions[listMapKeysExtension].([]interface{})
+		if !ok || len(keys) != 1 {
+			return
+		}
+		key, ok := keys[0].(string)
+		if !ok {
+			return
+		}
+		patchMeta.SetPatchStrategies([]string{mergePatchStrategy})
+		patchMeta.SetPatchMergeKey(key)
+	case setListType:
+		// strategic merge patches can only merge lists of objects by key
+		if itemsMeta, ok := items.(strategicpatch.PatchMetaFromOpenAPI); ok {
+			if _, ok := resolveModel(itemsMeta.Schema).(*openapi.Primitive); ok {
+				patchMeta.SetPatchStrategies([]string{mergePatchStrategy})
+			}
+		}
+	}
+}
+
+// getFieldModel returns the model of a field of an object, nil if the model doesn't describe the field
+func getFieldModel(model openapi.Schema, key string) openapi.Schema {
+	switch model := resolveModel(model).(type) {
+	case *openapi.Kind:
+		field := model.Fields[key]
+		// the list markers are on the list itself, unless it is defined by a separate model
+		if field != nil {
+			if _, ok := field.GetExtensions()[listTypeExtension]; !ok {
+				if ref, ok := field.(openapi.Reference); ok {
+					return ref.SubSchema()
+				}
+			}
+		}
+		return field
+	case *openapi.Map:
+		return model.SubType
+	default:
+		return nil
+	}
+}
+
+// resolveModel follows the references until a model that isn't a reference
+func resolveModel(model openapi.Schema) openapi.Schema {
+	for {
+		ref, ok := model.(openapi.Reference)
+		if !ok {
+			return model
+		}
+		model = ref.SubSchema()
+	}
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	openapi_v3 "github.com/google/gnostic/openapiv3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+)
+
+// widgetGVK is the kind described by widgetOpenAPIV3Document
+var widgetGVK = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+
+// widgetOpenAPIV3Document is the OpenAPI v3 document of a CRD group version, as published by the api server, with one list per list type
+const widgetOpenAPIV3Document = `{
+  "openapi": "3.0.0",
+  "info": {"title": "Kubernetes CRD Swagger", "version": "v0.1.0"},
+  "paths": {},
+  "components": {
+    "schemas": {
+      "com.example.v1.Widget": {
+        "type": "object",
+        "x-kubernetes-group-version-kind": [{"group": "example.com", "version": "v1", "kind": "Widget"}],
+        "properties": {
+          "apiVersion": {"type": "string"},
+          "kind": {"type": "string"},
+          "metadata": {"type": "object"},
+          "spec": {
+            "type": "object",
+            "properties": {
+              "ports": {
+                "type": "array",
+                "x-kubernetes-list-type": "map",
+                "x-kubernetes-list-map-keys": ["name"],
+                "items": {"type": "object", "properties": {"name": {"type": "string"}, "port": {"type": "integer"}}}
+              },
+              "tags": {
+                "type": "array",
+                "x-kubernetes-list-type": "set",
+                "items": {"type": "string"}
+              },
+              "endpoints": {
+                "type": "array",
+                "x-kubernetes-list-type": "map",
+                "x-kubernetes-list-map-keys": ["host", "port"],
+                "items": {"type": "object", "properties": {"host": {"type": "string"}, "port": {"type": "integer"}}}
+              },
+              "args": {
+                "type": "array",
+                "x-kubernetes-list-type": "atomic",
+                "items": {"type": "string"}
+              },
+              "rules": {
+                "type": "array",
+                "items": {"type": "object", "properties": {"name": {"type": "string"}}}
+              },
+              "template": {
+                "type": "object",
+                "properties": {
+                  "volumes": {
+                    "type": "array",
+                    "x-kubernetes-list-type": "map",
+                    "x-kubernetes-list-map-keys": ["name"],
+                    "items": {"type": "object", "properties": {"name": {"type": "string"}, "path": {"type": "string"}}}
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+func getWidgetModel(t *testing.T) openapi.Schema {
+	t.Helper()
+	doc, err := openapi_v3.ParseDocument([]byte(widgetOpenAPIV3Document))
+	if err != nil {
+		t.Fatalf("unable to parse document: %v", err)
+	}
+	flattenAllOf(doc)
+	models, err := openapi.NewOpenAPIV3Data(doc)
+	if err != nil {
+		t.Fatalf("unable to load models: %v", err)
+	}
+	model, ok := indexModels(models, &schema.GroupVersion{Group: widgetGVK.Group, Version: widgetGVK.Version})[widgetGVK]
+	if !ok {
+		t.Fatalf("model of %s not found", widgetGVK)
+	}
+	return model
+}
+
+func TestListTypePatchMeta(t *testing.T) {
+	model := getWidgetModel(t)
+	tests := []struct {
+		name     string
+		original string
+		patch    string
+		expected string
+	}{
+		{
+			name:     "list of type map is merged by key",
+			original: `{"spec":{"ports":[{"name":"http","port":80},{"name":"https","port":443}]}}`,
+			patch:    `{"spec":{"ports":[{"name":"http","port":8080},{"name":"metrics","port":9090}]}}`,
+			expected: `{"spec":{"ports":[{"name":"http","port":8080},{"name":"metrics","port":9090},{"name":"https","port":443}]}}`,
+		},
+		{
+			name:     "list of type map supports the delete directive",
+			original: `{"spec":{"ports":[{"name":"http","port":80},{"name":"https","port":443}]}}`,
+			patch:    `{"spec":{"ports":[{"name":"http","$patch":"delete"}]}}`,
+			expected: `{"spec":{"ports":[{"name":"https","port":443}]}}`,
+		},
+		{
+			name:     "list of type set of primitives is merged",
+			original: `{"spec":{"tags":["a","b"]}}`,
+			patch:    `{"spec":{"tags":["b","c"]}}`,
+			expected: `{"spec":{"tags":["a","b","c"]}}`,
+		},
+		{
+			name:     "list of type map with more than one key is replaced",
+			original: `{"spec":{"endpoints":[{"host":"a","port":1}]}}`,
+			patch:    `{"spec":{"endpoints":[{"host":"b","port":2}]}}`,
+			expected: `{"spec":{"endpoints":[{"host":"b","port":2}]}}`,
+		},
+		{
+			name:     "list of type atomic is replaced",
+			original: `{"spec":{"args":["a","b"]}}`,
+			patch:    `{"spec":{"args":["c"]}}`,
+			expected: `{"spec":{"args":["c"]}}`,
+		},
+		{
+			name:     "list without list type is replaced",
+			original: `{"spec":{"rules":[{"name":"a"}]}}`,
+			patch:    `{"spec":{"rules":[{"name":"b"}]}}`,
+			expected: `{"spec":{"rules":[{"name":"b"}]}}`,
+		},
+		{
+			name:     "nested list of type map is merged by key",
+			original: `{"spec":{"template":{"volumes":[{"name":"a","path":"/a"}]}}}`,
+			patch:    `{"spec":{"template":{"volumes":[{"name":"b","path":"/b"}]}}}`,
+			expected: `{"spec":{"template":{"volumes":[{"name":"b","path":"/b"},{"name":"a","path":"/a"}]}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta([]byte(tt.original), []byte(tt.patch), newPatchMetaFromOpenAPI(model))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSONEqual(t, tt.expected, patched)
+		})
+	}
+}
+
+func TestListTypePatchMetaWithoutModel(t *testing.T) {
+	patched, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta([]byte(`{"spec":{"ports":[{"name":"http","port":80}]}}`), []byte(`{"spec":{"ports":[{"name":"https","port":443}]}}`), newPatchMetaFromOpenAPI(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertJSONEqual(t, `{"spec":{"ports":[{"name":"https","port":443}]}}`, patched)
+}
+
+// staticModels is a modelGetter returning a fixed model for widgetGVK
+type staticModels struct {
+	model openapi.Schema
+	err   error
+}
+
+func (m staticModels) GetModel(_ context.Context, gvk schema.GroupVersionKind) (openapi.Schema, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if gvk != widgetGVK {
+		return nil, nil
+	}
+	return m.model, nil
+}
+
+func TestGetPatchForTarget(t *testing.T) {
+	model := getWidgetModel(t)
+	widget := &unstructured.Unstructured{}
+	widget.SetGroupVersionKind(widgetGVK)
+	widget.SetName("widget")
+	widget.SetNamespace("default")
+	widget.SetResourceVersion("42")
+	err := unstructured.SetNestedSlice(widget.Object, []interface{}{
+		map[string]interface{}{"name": "http", "port": int64(80)},
+	}, "spec", "ports")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	unknownWidget := widget.DeepCopy()
+	unknownWidget.SetKind("Gadget")
+	deployment := &unstructured.Unstructured{}
+	deployment.SetGroupVersionKind(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"})
+	deployment.SetName("deployment")
+	errModels := errors.New("models not loaded")
+
+	tests := []struct {
+		name              string
+		models            modelGetter
+		target            *unstructured.Unstructured
+		patchType         types.PatchType
+		patch             string
+		expectedPatchType types.PatchType
+		expectedPatch     string
+		expectedErr       error
+	}{
+		{
+			name:              "strategic merge patch on a custom resource is sent as a merge patch with the resource version",
+			models:            staticModels{model: model},
+			target:            widget,
+			patchType:         types.StrategicMergePatchType,
+			patch:             `{"spec":{"ports":[{"name":"https","port":443}]}}`,
+			expectedPatchType: types.MergePatchType,
+			expectedPatch:     `{"metadata":{"resourceVersion":"42"},"spec":{"ports":[{"name":"https","port":443},{"name":"http","port":80}]}}`,
+		},
+		{
+			name:              "strategic merge patch without changes only carries the resource version",
+			models:            staticModels{model: model},
+			target:            widget,
+			patchType:         types.StrategicMergePatchType,
+			patch:             `{"spec":{"ports":[{"name":"http","port":80}]}}`,
+			expectedPatchType: types.MergePatchType,
+			expectedPatch:     `{"metadata":{"resourceVersion":"42"}}`,
+		},
+		{
+			name:              "strategic merge patch on a built-in type is sent as it is",
+			models:            staticModels{err: errModels},
+			target:            deployment,
+			patchType:         types.StrategicMergePatchType,
+			patch:             `{"spec":{"replicas":2}}`,
+			expectedPatchType: types.StrategicMergePatchType,
+			expectedPatch:     `{"spec":{"replicas":2}}`,
+		},
+		{
+			name:              "strategic merge patch on a type without model is sent as it is",
+			models:            staticModels{model: model},
+			target:            unknownWidget,
+			patchType:         types.StrategicMergePatchType,
+			patch:             `{"spec":{"ports":[]}}`,
+			expectedPatchType: types.StrategicMergePatchType,
+			expectedPatch:     `{"spec":{"ports":[]}}`,
+		},
+		{
+			name:              "strategic merge patch is sent as it is without models",
+			target:            widget,
+			patchType:         types.StrategicMergePatchType,
+			patch:             `{"spec":{"ports":[]}}`,
+			expectedPatchType: types.StrategicMergePatchType,
+			expectedPatch:     `{"spec":{"ports":[]}}`,
+		},
+		{
+			name:              "merge patch is sent as it is",
+			models:            staticModels{model: model},
+			target:            widget,
+			patchType:         types.MergePatchType,
+			patch:             `{"spec":{"ports":[]}}`,
+			expectedPatchType: types.MergePatchType,
+			expectedPatch:     `{"spec":{"ports":[]}}`,
+		},
+		{
+			name:        "models error is returned",
+			models:      staticModels{err: errModels},
+			target:      widget,
+			patchType:   types.StrategicMergePatchType,
+			patch:       `{"spec":{"ports":[]}}`,
+			expectedErr: errModels,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patchType, patch, err := getPatchForTarget(context.TODO(), tt.models, tt.target, tt.patchType, []byte(tt.patch))
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if patchType != tt.expectedPatchType {
+				t.Errorf("expected patch type %s, got %s", tt.expectedPatchType, patchType)
+			}
+			assertJSONEqual(t, tt.expectedPatch, patch)
+		})
+	}
+}
+
+// assertJSONEqual fails the test when the JSON documents are not semantically equal
+func assertJSONEqual(t *testing.T, expected string, actual []byte) {
+	t.Helper()
+	var expectedValue, actualValue interface{}
+	if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		t.Fatalf("unable to unmarshal expected value: %v", err)
+	}
+	if err := json.Unmarshal(actual, &actualValue); err != nil {
+		t.Fatalf("unable to unmarshal actual value %s: %v", string(actual), err)
+	}
+	if !reflect.DeepEqual(expectedValue, actualValue) {
+		t.Errorf("expected %s, got %s", expected, string(actual))
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+const previewConfigMapSuffix = "-preview"
+
+// targetPreview describes what a patch would change on a target
+type targetPreview struct {
+	PatchName  string `json:"patchName"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	// Patch is the rendered patch template
+	Patch interface{} `json:"patch,omitempty"`
+	// Changes is a merge patch describing the difference between the current and the patched target, it is empty when the patch would not change the target
+	Changes interface{} `json:"changes,omitempty"`
+	// Error is set when the patch could not be rendered or applied to the target
+	Error string `json:"error,omitempty"`
+}
+
+func getPreviewConfigMapName(instance redhatcopv1alpha1.PatchObject) string {
+	return getConfigMapName(instance, previewConfigMapSuffix)
+}
+
+// managePreview computes, for each target of each patch, the rendered patch and the changes it would cause and writes them to the preview ConfigMap.
+// Nothing is applied to the targets, the patches are evaluated with a server-side dry-run.
+// config is the rest config of the service account of the instance
+func (r *PatchReconciler) managePreview(ctx context.Context, instance redhatcopv1alpha1.PatchObject, lockedPatches []lockedpatch.LockedPatch, config *rest.Config) error {
+	rlog := log.FromContext(ctx)
+	configMap, err := r.getOwnedConfigMap(ctx, instance, instance.GetServiceAccountNamespace(), getPreviewConfigMapName(instance))
+	if err != nil {
+		rlog.Error(err, "unable to get preview configmap")
+		return err
+	}
+	data := map[string]string{}
+	options := getPatchOptions(instance.GetPatches())
+	ctx = context.WithValue(ctx, "restConfig", config)
+	for i := range lockedPatches {
+		targets, err := getTargetObjects(ctx, &lockedPatches[i].TargetObjectRef)
+		if err != nil {
+			rlog.Error(err, "unable to get targets for", "patch", lockedPatches[i].Name)
+			return err
+		}
+		for j := range targets {
+			preview, err := yaml.Marshal(computeTargetPreview(ctx, r.getModels(), &lockedPatches[i], options[lockedPatches[i].Name], &targets[j]))
+			if err != nil {
+				rlog.Error(err, "unable to marshal preview for", "patch", lockedPatches[i].Name, "target", getTargetKey(&targets[j]))
+				return err
+			}
+			data[getTargetRecordKey(lockedPatches[i].Name, &targets[j])] = string(preview)
+		}
+	}
+	configMap.Data = data
+	return r.createOrUpdateConfigMap(ctx, configMap)
+}
+
+func computeTargetPreview(ctx context.Context, models modelGetter, lockedPatch *lockedpatch.LockedPatch, options patchOptions, target *unstructured.Unstructured) *targetPreview {
+	preview := &targetPreview{
+		PatchName:  lockedPatch.Name,
+		APIVersion: target.GetAPIVersion(),
+		Kind:       target.GetKind(),
+		Namespace:  target.GetNamespace(),
+		Name:       target.GetName(),
+	}
+	patch, err := renderPatch(ctx, lockedPatch, target)
+	if err != nil {
+		preview.Error = err.Error()
+		return preview
+	}
+	preview.Patch = json.RawMessage(patch)
+	options.dryRun = true
+	patched, err := patchTarget(ctx, models, target, lockedPatch.PatchType, patch, options)
+	if err != nil {
+		preview.Error = err.Error()
+		return preview
+	}
+	changes, err := getTargetChanges(target, patched)
+	if err != nil {
+		preview.Error = err.Error()
+		return preview
+	}
+	if changes != nil {
+		preview.Changes = changes
+	}
+	return preview
+}
+
+// getTargetChanges returns a merge patch describing the difference between the target and the patched target, nil if they don't differ.
+// The fields maintained by the api server are ignored.
+func getTargetChanges(target *unstructured.Unstructured, patched *unstructured.Unstructured) (json.RawMessage, error) {
+	original, err := json.Marshal(stripServerFields(target))
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(stripServerFields(patched))
+	if err != nil {
+		return nil, err
+	}
+	changes, err := jsonpatch.CreateMergePatch(original, modified)
+	if err != nil {
+		return nil, err
+	}
+	if string(changes) == "{}" {
+		return nil, nil
+	}
+	return json.RawMessage(changes), nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newTestLockedPatch parses the patch the way the patch controller does
+func newTestLockedPatch(t *testing.T, patchSpec utilsv1alpha1.PatchSpec) *lockedpatch.LockedPatch {
+	t.Helper()
+	lockedPatches, err := lockedpatch.GetLockedPatches(map[string]utilsv1alpha1.PatchSpec{"test": patchSpec}, nil, logr.Discard())
+	if err != nil {
+		t.Fatalf("unable to parse patch: %v", err)
+	}
+	return &lockedPatches[0]
+}
+
+func newTestObject(apiVersion string, kind string, namespace string, name string, fields map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	for key, value := range fields {
+		obj.Object[key] = value
+	}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestRenderPatchWithSources(t *testing.T) {
+	target := newTestObject("v1", "ConfigMap", "default", "target", map[string]interface{}{
+		"data": map[string]interface{}{"key": "target-value"},
+	})
+	source := newTestObject("v1", "Secret", "default", "source", map[string]interface{}{
+		"data": map[string]interface{}{"password": "c2VjcmV0"},
+	})
+	sourceRef := utilsv1alpha1.SourceObjectReference{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "source"}
+	sourceRefWithFieldPath := sourceRef
+	sourceRefWithFieldPath.FieldPath = "$.data.password"
+	errSource := errors.New("source not found")
+
+	tests := []struct {
+		name            string
+		patchSpec       utilsv1alpha1.PatchSpec
+		getSourceObject sourceObjectGetter
+		expected        string
+		expectedErr     string
+	}{
+		{
+			name:      "template referencing the target",
+			patchSpec: utilsv1alpha1.PatchSpec{PatchTemplate: `data: {copy: "{{ (index . 0).data.key }}"}`},
+			expected:  `{"data":{"copy":"target-value"}}`,
+		},
+		{
+			name:            "template referencing a whole source",
+			patchSpec:       utilsv1alpha1.PatchSpec{PatchTemplate: `data: {password: "{{ (index . 1).data.password }}"}`, SourceObjectRefs: []utilsv1alpha1.SourceObjectReference{sourceRef}},
+			getSourceObject: func(*utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error) { return source, nil },
+			expected:        `{"data":{"password":"c2VjcmV0"}}`,
+		},
+		{
+			name:            "template referencing a field of a source",
+			patchSpec:       utilsv1alpha1.PatchSpec{PatchTemplate: `data: {password: "{{ index . 1 | b64dec }}"}`, SourceObjectRefs: []utilsv1alpha1.SourceObjectReference{sourceRefWithFieldPath}},
+			getSourceObject: func(*utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error) { return source, nil },
+			expected:        `{"data":{"password":"secret"}}`,
+		},
+		{
+			name:            "missing source",
+			patchSpec:       utilsv1alpha1.PatchSpec{PatchTemplate: `data: {}`, SourceObjectRefs: []utilsv1alpha1.SourceObjectReference{sourceRef}},
+			getSourceObject: func(*utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error) { return nil, errSource },
+			expectedErr:     errSource.Error(),
+		},
+		{
+			name:        "template execution error",
+			patchSpec:   utilsv1alpha1.PatchSpec{PatchTemplate: `data: {copy: "{{ (index . 3).data }}"}`},
+			expectedErr: "error calling index",
+		},
+		{
+			name:        "template rendering invalid yaml",
+			patchSpec:   utilsv1alpha1.PatchSpec{PatchTemplate: `data: [`},
+			expectedErr: "yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := renderPatchWithSources(context.TODO(), newTestLockedPatch(t, tt.patchSpec), target, tt.getSourceObject)
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSONEqual(t, tt.expected, patch)
+		})
+	}
+}
+
+func TestGetTargetChanges(t *testing.T) {
+	target := newTestObject("v1", "ConfigMap", "default", "target", map[string]interface{}{
+		"data": map[string]interface{}{"a": "1", "b": "2"},
+	})
+	target.SetResourceVersion("1")
+	target.SetUID(types.UID("uid"))
+	target.SetGeneration(1)
+	target.SetCreationTimestamp(metav1.Now())
+
+	unchanged := target.DeepCopy()
+	unchanged.SetResourceVersion("2")
+	unchanged.SetGeneration(2)
+	unchanged.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "patch-operator"}})
+
+	changed := unchanged.DeepCopy()
+	changed.Object["data"] = map[string]interface{}{"a": "1", "c": "3"}
+	changed.SetLabels(map[string]string{"patched": "true"})
+
+	tests := []struct {
+		name     string
+		patched  *unstructured.Unstructured
+		expected string
+	}{
+		{
+			name:    "only server fields differ",
+			patched: unchanged,
+		},
+		{
+			name:     "fields added, changed and removed",
+			patched:  changed,
+			expected: `{"data":{"b":null,"c":"3"},"metadata":{"labels":{"patched":"true"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := getTargetChanges(target, tt.patched)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expected == "" {
+				if changes != nil {
+					t.Errorf("expected no changes, got %s", string(changes))
+				}
+				return
+			}
+			assertJSONEqual(t, tt.expected, changes)
+		})
+	}
+}
+
+func TestComputeTargetPreviewRenderError(t *testing.T) {
+	target := newTestObject("v1", "ConfigMap", "default", "target", nil)
+	lockedPatch := newTestLockedPatch(t, utilsv1alpha1.PatchSpec{PatchTemplate: `data: {copy: "{{ (index . 1).data }}"}`})
+	preview := computeTargetPreview(context.TODO(), nil, lockedPatch, patchOptions{}, target)
+	if preview.Error == "" {
+		t.Fatalf("expected the render error to be reported")
+	}
+	if preview.PatchName != "test" || preview.Kind != "ConfigMap" || preview.Namespace != "default" || preview.Name != "target" {
+		t.Errorf("unexpected target of the preview: %+v", preview)
+	}
+	if preview.Patch != nil || preview.Changes != nil {
+		t.Errorf("expected no patch and no changes, got %+v", preview)
+	}
+}
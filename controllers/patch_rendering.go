@@ -0,0 +1,172 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/dynamicclient"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+// getTargetObjects returns the objects currently selected by the target reference
+// requires context with log and restConfig
+func getTargetObjects(context context.Context, targetObjectRef *utilsv1alpha1.TargetObjectReference) ([]unstructured.Unstructured, error) {
+	log := log.FromContext(context)
+	multiple, _, err := targetObjectRef.IsSelectingMultipleInstances(context)
+	if err != nil {
+		log.Error(err, "unable to determine if target resolves to multiple instances", "target", targetObjectRef)
+		return nil, err
+	}
+	if multiple {
+		return targetObjectRef.GetReferencedObjects(context)
+	}
+	obj, err := targetObjectRef.GetReferencedObject(context)
+	if err != nil {
+		log.Error(err, "unable to get referenced object", "target", targetObjectRef)
+		return nil, err
+	}
+	return []unstructured.Unstructured{*obj}, nil
+}
+
+// renderPatch resolves the source objects of the patch for the passed target and processes the patch template, the result is returned as json.
+// This is the same computation the enforcing controllers perform before patching the target.
+// requires context with log and restConfig
+func renderPatch(context context.Context, lockedPatch *lockedpatch.LockedPatch, target *unstructured.Unstructured) ([]byte, error) {
+	return renderPatchWithSources(context, lockedPatch, target, func(sourceObjectRef *utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error) {
+		return sourceObjectRef.GetReferencedObject(context, target)
+	})
+}
+
+// sourceObjectGetter returns the object referenced by a source object reference
+type sourceObjectGetter func(sourceObjectRef *utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error)
+
+// renderPatchWithSources is renderPatch with the source objects returned by the passed getter, which the render command uses to read local objects
+func renderPatchWithSources(context context.Context, lockedPatch *lockedpatch.LockedPatch, target *unstructured.Unstructured, getSourceObject sourceObjectGetter) ([]byte, error) {
+	log := log.FromContext(context)
+	// the first object is always the target object
+	sourceMaps := []interface{}{target.UnstructuredContent()}
+	for i := range lockedPatch.SourceObjectRefs {
+		sourceObj, err := getSourceObject(&lockedPatch.SourceObjectRefs[i])
+		if err != nil {
+			log.Error(err, "unable to retrieve", "sourceObjectRef", lockedPatch.SourceObjectRefs[i])
+			return nil, err
+		}
+		sourceMap, err := getSubMapFromObject(context, sourceObj, lockedPatch.SourceObjectRefs[i].FieldPath)
+		if err != nil {
+			log.Error(err, "unable to retrieve", "field", lockedPatch.SourceObjectRefs[i].FieldPath, "from object", sourceObj)
+			return nil, err
+		}
+		sourceMaps = append(sourceMaps, sourceMap)
+	}
+	var b bytes.Buffer
+	err := lockedPatch.Template.Execute(&b, sourceMaps)
+	if err != nil {
+		log.Error(err, "unable to process ", "template ", lockedPatch.PatchTemplate, "parameters", sourceMaps)
+		return nil, err
+	}
+	bb, err := yaml.YAMLToJSON(b.Bytes())
+	if err != nil {
+		log.Error(err, "unable to convert to json", "processed template", b.String())
+		return nil, err
+	}
+	return bb, nil
+}
+
+func getSubMapFromObject(context context.Context, obj *unstructured.Unstructured, fieldPath string) (interface{}, error) {
+	log := log.FromContext(context)
+	if fieldPath == "" {
+		return obj.UnstructuredContent(), nil
+	}
+
+	jp := jsonpath.New("fieldPath:" + fieldPath)
+	err := jp.Parse("{" + fieldPath + "}")
+	if err != nil {
+		log.Error(err, "unable to parse ", "fieldPath", fieldPath)
+		return nil, err
+	}
+
+	values, err := jp.FindResults(obj.UnstructuredContent())
+	if err != nil {
+		log.Error(err, "unable to apply ", "jsonpath", jp, " to obj ", obj.UnstructuredContent())
+		return nil, err
+	}
+
+	if len(values) > 0 && len(values[0]) > 0 {
+		return values[0][0].Interface(), nil
+	}
+
+	return nil, errors.New("jsonpath returned empty result")
+}
+
+// patchTarget applies the patch to the target with the passed options, when dryRun is set the api server computes the resulting object without persisting it.
+// Strategic merge patches on custom resources are sent as merge patches, see getPatchForTarget.
+// requires context with log and restConfig
+func patchTarget(context context.Context, models modelGetter, target *unstructured.Unstructured, patchType types.PatchType, patch []byte, options patchOptions) (*unstructured.Unstructured, error) {
+	log := log.FromContext(context)
+	nri, namespaced, err := dynamicclient.GetDynamicClientForGVK(context, target.GroupVersionKind())
+	if err != nil {
+		log.Error(err, "unable to get dynamicClient on ", "gvk", target.GroupVersionKind())
+		return nil, err
+	}
+	patchType, patch, err = getPatchForTarget(context, models, target, patchType, patch)
+	if err != nil {
+		log.Error(err, "unable to compute the patch for", "target", getTargetKey(target))
+		return nil, err
+	}
+	patchOptions := metav1.PatchOptions{
+		FieldManager: options.fieldManager,
+	}
+	if options.dryRun {
+		patchOptions.DryRun = []string{metav1.DryRunAll}
+	}
+	if options.force {
+		patchOptions.Force = &options.force
+	}
+	// server-side apply patches require a field manager, the other patches get the one of the user agent
+	if patchType == types.ApplyPatchType && patchOptions.FieldManager == "" {
+		patchOptions.FieldManager = redhatcopv1alpha1.DefaultFieldManager
+	}
+	if namespaced {
+		return nri.Namespace(target.GetNamespace()).Patch(context, target.GetName(), patchType, patch, patchOptions)
+	}
+	return nri.Patch(context, target.GetName(), patchType, patch, patchOptions)
+}
+
+// getTargetKey returns a key identifying the target in logs and records
+func getTargetKey(target *unstructured.Unstructured) string {
+	return schema.FromAPIVersionAndKind(target.GetAPIVersion(), target.GetKind()).GroupKind().String() + "/" + target.GetNamespace() + "/" + target.GetName()
+}
+
+// getTargetRecordKey returns a key identifying the pair patch, target that can be used as a ConfigMap key
+func getTargetRecordKey(patchName string, target *unstructured.Unstructured) string {
+	hash := sha256.Sum256([]byte(patchName + "/" + getTargetKey(target)))
+	return hex.EncodeToString(hash[:16])
+}
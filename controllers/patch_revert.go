@@ -0,0 +1,336 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"strconv"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	revertConfigMapSuffix = "-revert"
+	// revertConfigMapShards is the number of ConfigMaps the revert records of an instance are spread over, by the first hex digit of their key
+	revertConfigMapShards = 16
+	// maxRevertConfigMapSize bounds the size of the records stored in one ConfigMap, below the 1MiB limit of the api server
+	maxRevertConfigMapSize = 900 * 1024
+)
+
+// revertRecord contains what is needed to restore a target to the state it had before a patch was applied
+type revertRecord struct {
+	PatchName  string `json:"patchName"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	// PatchHash is the hash of the definition of the patch when the record was last updated
+	PatchHash string `json:"patchHash,omitempty"`
+	// RevertPatch is a merge patch that restores the fields touched by the patch
+	RevertPatch json.RawMessage `json:"revertPatch"`
+}
+
+func getRevertConfigMapName(instance redhatcopv1alpha1.PatchObject) string {
+	return getConfigMapName(instance, revertConfigMapSuffix)
+}
+
+// getRevertConfigMapShardName returns the name of the ConfigMap storing the record with the given key
+func getRevertConfigMapShardName(instance redhatcopv1alpha1.PatchObject, key string) string {
+	return getRevertConfigMapName(instance) + "-" + key[:1]
+}
+
+// getRevertConfigMapShardNames returns the names of all the ConfigMaps that can store the records of the instance
+func getRevertConfigMapShardNames(instance redhatcopv1alpha1.PatchObject) []string {
+	names := []string{}
+	for i := 0; i < revertConfigMapShards; i++ {
+		names = append(names, getRevertConfigMapName(instance)+"-"+strconv.FormatInt(int64(i), 16))
+	}
+	return names
+}
+
+// getRevertPatchHashes returns the hashes of the patches with the Revert deletion policy, by patch name
+func getRevertPatchHashes(instance redhatcopv1alpha1.PatchObject) map[string]string {
+	patchHashes := map[string]string{}
+	for patchName, patch := range instance.GetPatches() {
+		if patch.DeletionPolicy == redhatcopv1alpha1.RevertDeletionPolicy {
+			patchHashes[patchName] = getPatchHash(patch)
+		}
+	}
+	return patchHashes
+}
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+
+// revertRecorder stores the revert records of the targets of the patches with the Revert deletion policy, it is shared by the enforcing controllers of an instance.
+// A target is recorded by its enforcing controller right before it is patched, the first time it is selected and again when the definition of the patch changes.
+// The keys of the stored records are cached along with the hash of their patch, so that the targets already recorded are not computed again.
+type revertRecorder struct {
+	reconciler *PatchReconciler
+	instance   redhatcopv1alpha1.PatchObject
+	// patchHashes are the hashes of the patches with the Revert deletion policy, by patch name
+	patchHashes map[string]string
+	lock        sync.Mutex
+	loaded      bool
+	// recorded are the hashes of the patches of the stored records, by record key
+	recorded map[string]string
+}
+
+// newRevertRecorder returns the recorder of the instance, nil if none of its patches has the Revert deletion policy
+func (r *PatchReconciler) newRevertRecorder(instance redhatcopv1alpha1.PatchObject) *revertRecorder {
+	patchHashes := getRevertPatchHashes(instance)
+	if len(patchHashes) == 0 {
+		return nil
+	}
+	return &revertRecorder{
+		reconciler:  r,
+		instance:    instance,
+		patchHashes: patchHashes,
+		recorded:    map[string]string{},
+	}
+}
+
+// getPatchHashes returns the hashes of the recorded patches, nil for a nil recorder
+func (rr *revertRecorder) getPatchHashes() map[string]string {
+	if rr == nil {
+		return nil
+	}
+	return rr.patchHashes
+}
+
+// isRecorded returns whether the targets of the patch must be recorded
+func (rr *revertRecorder) isRecorded(patchName string) bool {
+	if rr == nil {
+		return false
+	}
+	_, ok := rr.patchHashes[patchName]
+	return ok
+}
+
+// record stores the revert record of the target, unless it is already stored for the current definition of the patch.
+// computeRevertPatch is only called when the record must be computed. Values recorded before take precedence over the computed ones, they describe the target before it was ever patched.
+func (rr *revertRecorder) record(ctx context.Context, patchName string, target *unstructured.Unstructured, computeRevertPatch func() ([]byte, error)) error {
+	rlog := log.FromContext(ctx)
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if !rr.loaded {
+		err := rr.load(ctx)
+		if err != nil {
+			rlog.Error(err, "unable to load revert records")
+			return err
+		}
+		rr.loaded = true
+	}
+	key := getTargetRecordKey(patchName, target)
+	patchHash := rr.patchHashes[patchName]
+	if rr.recorded[key] == patchHash {
+		return nil
+	}
+	revertPatch, err := computeRevertPatch()
+	if err != nil {
+		return err
+	}
+	err = retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		return rr.store(ctx, key, revertRecord{
+			PatchName:   patchName,
+			APIVersion:  target.GetAPIVersion(),
+			Kind:        target.GetKind(),
+			Namespace:   target.GetNamespace(),
+			Name:        target.GetName(),
+			PatchHash:   patchHash,
+			RevertPatch: revertPatch,
+		})
+	})
+	if err != nil {
+		rlog.Error(err, "unable to store revert record for", "patch", patchName, "target", getTargetKey(target))
+		return err
+	}
+	rr.recorded[key] = patchHash
+	return nil
+}
+
+// load caches the keys of the stored records
+func (rr *revertRecorder) load(ctx context.Context) error {
+	for _, name := range getRevertConfigMapShardNames(rr.instance) {
+		configMap := &corev1.ConfigMap{}
+		err := rr.reconciler.GetAPIReader().Get(ctx, types.NamespacedName{Name: name, Namespace: rr.instance.GetServiceAccountNamespace()}, configMap)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		for key, value := range configMap.Data {
+			record := revertRecord{}
+			err := json.Unmarshal([]byte(value), &record)
+			if err != nil {
+				return err
+			}
+			rr.recorded[key] = record.PatchHash
+		}
+	}
+	return nil
+}
+
+// store merges the record with the one already stored under the same key and writes it to its ConfigMap
+func (rr *revertRecorder) store(ctx context.Context, key string, record revertRecord) error {
+	configMap, err := rr.reconciler.getOwnedConfigMap(ctx, rr.instance, rr.instance.GetServiceAccountNamespace(), getRevertConfigMapShardName(rr.instance, key))
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	if existing, ok := configMap.Data[key]; ok {
+		existingRecord := revertRecord{}
+		err = json.Unmarshal([]byte(existing), &existingRecord)
+		if err != nil {
+			return err
+		}
+		record.RevertPatch, err = jsonpatch.MergeMergePatches(record.RevertPatch, existingRecord.RevertPatch)
+		if err != nil {
+			return err
+		}
+	} else if string(record.RevertPatch) == "{}" {
+		// the patch doesn't change the target, there is nothing to revert
+		return nil
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if configMap.Data[key] == string(value) {
+		return nil
+	}
+	configMap.Data[key] = string(value)
+	if size := getConfigMapDataSize(configMap); size > maxRevertConfigMapSize {
+		return goerrors.New("the revert records stored in configmap " + configMap.Name + " would exceed " + strconv.Itoa(maxRevertConfigMapSize) + " bytes, the target is not patched because it could not be reverted")
+	}
+	return rr.reconciler.createOrUpdateConfigMap(ctx, configMap)
+}
+
+// getConfigMapDataSize returns the size of the data of a ConfigMap
+func getConfigMapDataSize(configMap *corev1.ConfigMap) int {
+	size := 0
+	for key, value := range configMap.Data {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// computeRevertPatch returns a merge patch that restores the target to its current state after the patch has been applied
+func computeRevertPatch(ctx context.Context, models modelGetter, target *unstructured.Unstructured, patchType types.PatchType, patch []byte, options patchOptions) ([]byte, error) {
+	rlog := log.FromContext(ctx)
+	options.dryRun = true
+	patched, err := patchTarget(ctx, models, target, patchType, patch, options)
+	if err != nil {
+		rlog.Error(err, "unable to dry-run", "patch", string(patch), "on target", getTargetKey(target))
+		return nil, err
+	}
+	return getRevertPatch(target, patched)
+}
+
+// getRevertPatch returns a merge patch that turns the patched object back into the original one.
+// Merge patches replace lists as a whole, so a list touched by the patch is restored entirely to its original content.
+func getRevertPatch(original *unstructured.Unstructured, patched *unstructured.Unstructured) ([]byte, error) {
+	originalJSON, err := json.Marshal(stripServerFields(original))
+	if err != nil {
+		return nil, err
+	}
+	patchedJSON, err := json.Marshal(stripServerFields(patched))
+	if err != nil {
+		return nil, err
+	}
+	return jsonpatch.CreateMergePatch(patchedJSON, originalJSON)
+}
+
+// stripServerFields removes the fields that are maintained by the api server
+func stripServerFields(obj *unstructured.Unstructured) map[string]interface{} {
+	objCopy := obj.DeepCopy()
+	objCopy.SetResourceVersion("")
+	objCopy.SetManagedFields(nil)
+	objCopy.SetGeneration(0)
+	objCopy.SetCreationTimestamp(metav1.Time{})
+	objCopy.SetUID("")
+	return objCopy.UnstructuredContent()
+}
+
+// revertPatches applies the recorded revert patches and then deletes the records
+// config is the rest config of the service account of the instance
+func (r *PatchReconciler) revertPatches(ctx context.Context, instance redhatcopv1alpha1.PatchObject, config *rest.Config) error {
+	for _, name := range getRevertConfigMapShardNames(instance) {
+		err := r.revertPatchesOfConfigMap(ctx, instance.GetServiceAccountNamespace(), name, config)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revertPatchesOfConfigMap applies the revert patches recorded in a ConfigMap and then deletes it
+func (r *PatchReconciler) revertPatchesOfConfigMap(ctx context.Context, namespace string, name string, config *rest.Config) error {
+	rlog := log.FromContext(ctx)
+	configMap := &corev1.ConfigMap{}
+	err := r.GetAPIReader().Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, configMap)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		rlog.Error(err, "unable to get revert configmap", "name", name)
+		return err
+	}
+	ctx = context.WithValue(ctx, "restConfig", config)
+	for key, value := range configMap.Data {
+		record := revertRecord{}
+		err := json.Unmarshal([]byte(value), &record)
+		if err != nil {
+			rlog.Error(err, "unable to unmarshal revert record", "record", value)
+			return err
+		}
+		target := &unstructured.Unstructured{}
+		target.SetAPIVersion(record.APIVersion)
+		target.SetKind(record.Kind)
+		target.SetNamespace(record.Namespace)
+		target.SetName(record.Name)
+		_, err = patchTarget(ctx, nil, target, types.MergePatchType, record.RevertPatch, patchOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			rlog.Error(err, "unable to revert", "patch", record.PatchName, "on target", getTargetKey(target))
+			return err
+		}
+		// we remove the record as soon as it is applied so that a failure does not cause reapplying old values
+		delete(configMap.Data, key)
+		err = r.GetClient().Update(ctx, configMap)
+		if err != nil {
+			rlog.Error(err, "unable to update revert configmap")
+			return err
+		}
+	}
+	return r.GetClient().Delete(ctx, configMap)
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestRevertRecorder returns the recorder of a Patch with a single patch named revert, backed by a fake client
+func newTestRevertRecorder(t *testing.T) (*revertRecorder, client.Client) {
+	t.Helper()
+	testScheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(testScheme); err != nil {
+		t.Fatalf("unable to build the scheme: %v", err)
+	}
+	if err := redhatcopv1alpha1.AddToScheme(testScheme); err != nil {
+		t.Fatalf("unable to build the scheme: %v", err)
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(testScheme).Build()
+	instance := &redhatcopv1alpha1.Patch{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test", UID: types.UID("uid")},
+		Spec: redhatcopv1alpha1.PatchSpec{
+			Patches: map[string]redhatcopv1alpha1.PatchDefinition{
+				"revert": {DeletionPolicy: redhatcopv1alpha1.RevertDeletionPolicy},
+			},
+		},
+	}
+	r := NewPatchReconciler(util.NewReconcilerBase(fakeClient, testScheme, nil, nil, fakeClient), nil)
+	rr := r.newRevertRecorder(instance)
+	if rr == nil {
+		t.Fatalf("expected a revert recorder")
+	}
+	return rr, fakeClient
+}
+
+// getTestRevertConfigMap returns the ConfigMap storing the record with the given key, nil if it does not exist
+func getTestRevertConfigMap(t *testing.T, rr *revertRecorder, c client.Client, key string) *corev1.ConfigMap {
+	t.Helper()
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: getRevertConfigMapShardName(rr.instance, key), Namespace: "test"}, configMap)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("unable to get the revert configmap: %v", err)
+	}
+	return configMap
+}
+
+// getTestRevertRecord returns the record stored with the given key
+func getTestRevertRecord(t *testing.T, rr *revertRecorder, c client.Client, key string) revertRecord {
+	t.Helper()
+	configMap := getTestRevertConfigMap(t, rr, c, key)
+	if configMap == nil {
+		t.Fatalf("expected the revert configmap of %s to exist", key)
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		t.Fatalf("expected a revert record for %s", key)
+	}
+	record := revertRecord{}
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		t.Fatalf("unable to unmarshal the revert record: %v", err)
+	}
+	return record
+}
+
+func TestRevertRecorderStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		previous    string
+		revertPatch string
+		expected    string
+	}{
+		{
+			name:        "new record",
+			revertPatch: `{"data":{"a":"1"}}`,
+			expected:    `{"data":{"a":"1"}}`,
+		},
+		{
+			name:        "new record of a patch changing nothing",
+			revertPatch: `{}`,
+		},
+		{
+			name:        "recorded values take precedence",
+			previous:    `{"data":{"a":"1"}}`,
+			revertPatch: `{"data":{"a":"2","b":null}}`,
+			expected:    `{"data":{"a":"1","b":null}}`,
+		},
+		{
+			name:        "recorded values kept by a patch changing nothing",
+			previous:    `{"data":{"a":"1"}}`,
+			revertPatch: `{}`,
+			expected:    `{"data":{"a":"1"}}`,
+		},
+		{
+			name:        "recorded removal takes precedence",
+			previous:    `{"data":{"a":null}}`,
+			revertPatch: `{"data":{"a":"2"}}`,
+			expected:    `{"data":{"a":null}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, c := newTestRevertRecorder(t)
+			key := "a0"
+			if tt.previous != "" {
+				if err := rr.store(context.TODO(), key, revertRecord{PatchName: "revert", RevertPatch: json.RawMessage(tt.previous)}); err != nil {
+					t.Fatalf("unable to store the previous record: %v", err)
+				}
+			}
+			if err := rr.store(context.TODO(), key, revertRecord{PatchName: "revert", RevertPatch: json.RawMessage(tt.revertPatch)}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expected == "" {
+				if configMap := getTestRevertConfigMap(t, rr, c, key); configMap != nil {
+					t.Fatalf("expected no revert configmap, got %v", configMap.Data)
+				}
+				return
+			}
+			configMap := getTestRevertConfigMap(t, rr, c, key)
+			if configMap == nil {
+				t.Fatalf("expected the revert configmap to exist")
+			}
+			if configMap.Name != "test-patch-revert-a" {
+				t.Errorf("expected the record in shard test-patch-revert-a, got %s", configMap.Name)
+			}
+			if owner := metav1.GetControllerOf(configMap); owner == nil || owner.Kind != "Patch" || owner.Name != "test" {
+				t.Errorf("expected the revert configmap to be owned by the patch, got %v", owner)
+			}
+			assertJSONEqual(t, tt.expected, getTestRevertRecord(t, rr, c, key).RevertPatch)
+		})
+	}
+}
+
+func TestRevertRecorderStoreShards(t *testing.T) {
+	rr, c := newTestRevertRecorder(t)
+	for _, key := range []string{"a0", "a1", "f0"} {
+		if err := rr.store(context.TODO(), key, revertRecord{PatchName: "revert", RevertPatch: json.RawMessage(`{"data":{"` + key + `":"1"}}`)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if configMap := getTestRevertConfigMap(t, rr, c, "a0"); configMap == nil || len(configMap.Data) != 2 {
+		t.Errorf("expected the records a0 and a1 in the same shard, got %v", configMap)
+	}
+	if configMap := getTestRevertConfigMap(t, rr, c, "f0"); configMap == nil || len(configMap.Data) != 1 || configMap.Name != "test-patch-revert-f" {
+		t.Errorf("expected the record f0 alone in shard test-patch-revert-f, got %v", configMap)
+	}
+	for i, name := range getRevertConfigMapShardNames(rr.instance) {
+		if expected := "test-patch-revert-" + "0123456789abcdef"[i:i+1]; name != expected {
+			t.Errorf("expected shard %d to be %s, got %s", i, expected, name)
+		}
+	}
+}
+
+func TestRevertRecorderStoreSizeLimit(t *testing.T) {
+	// a revert patch of half the maximum size of a ConfigMap
+	largeRevertPatch := func(key string) json.RawMessage {
+		return json.RawMessage(`{"data":{"` + key + `":"` + strings.Repeat("x", maxRevertConfigMapSize/2) + `"}}`)
+	}
+	rr, c := newTestRevertRecorder(t)
+	if err := rr.store(context.TODO(), "a0", revertRecord{PatchName: "revert", RevertPatch: largeRevertPatch("a0")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// another shard has room for it
+	if err := rr.store(context.TODO(), "b0", revertRecord{PatchName: "revert", RevertPatch: largeRevertPatch("b0")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := rr.store(context.TODO(), "a1", revertRecord{PatchName: "revert", RevertPatch: largeRevertPatch("a1")})
+	if err == nil || !strings.Contains(err.Error(), "would exceed") {
+		t.Fatalf("expected the size limit to be enforced, got %v", err)
+	}
+	configMap := getTestRevertConfigMap(t, rr, c, "a1")
+	if _, ok := configMap.Data["a1"]; ok || len(configMap.Data) != 1 {
+		t.Errorf("expected the record exceeding the size limit not to be stored, got keys %d", len(configMap.Data))
+	}
+}
+
+// applyTestMergePatch returns the target with the merge patch applied, the way the api server applies patches and revert patches
+func applyTestMergePatch(t *testing.T, target *unstructured.Unstructured, patch []byte) *unstructured.Unstructured {
+	t.Helper()
+	targetJSON, err := json.Marshal(stripServerFields(target))
+	if err != nil {
+		t.Fatalf("unable to marshal the target: %v", err)
+	}
+	revertedJSON, err := jsonpatch.MergePatch(targetJSON, patch)
+	if err != nil {
+		t.Fatalf("unable to apply the revert patch: %v", err)
+	}
+	reverted := &unstructured.Unstructured{}
+	if err := json.Unmarshal(revertedJSON, &reverted.Object); err != nil {
+		t.Fatalf("unable to unmarshal the reverted target: %v", err)
+	}
+	return reverted
+}
+
+func TestRevertRecordRoundTrip(t *testing.T) {
+	original := newTestObject("apps/v1", "Deployment", "test", "target", map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "app", "image": "app:1"},
+						map[string]interface{}{"name": "sidecar", "image": "sidecar:1"},
+					},
+				},
+			},
+		},
+	})
+	original.SetResourceVersion("1")
+	original.SetUID(types.UID("target-uid"))
+	originalJSON, err := json.Marshal(stripServerFields(original))
+	if err != nil {
+		t.Fatalf("unable to marshal the original target: %v", err)
+	}
+
+	rr, c := newTestRevertRecorder(t)
+	key := getTargetRecordKey("revert", original)
+	computed := 0
+	recordPatch := func(target *unstructured.Unstructured, patch string) *unstructured.Unstructured {
+		t.Helper()
+		patched := applyTestMergePatch(t, target, []byte(patch))
+		err := rr.record(context.TODO(), "revert", target, func() ([]byte, error) {
+			computed++
+			return getRevertPatch(target, patched)
+		})
+		if err != nil {
+			t.Fatalf("unable to record the target: %v", err)
+		}
+		return patched
+	}
+
+	// first application of the patch
+	patched := recordPatch(original, `{"metadata":{"labels":{"patched":"true"}},"spec":{"replicas":2}}`)
+	assertJSONEqual(t, `{"metadata":{"labels":null},"spec":{"replicas":1}}`, getTestRevertRecord(t, rr, c, key).RevertPatch)
+	assertJSONEqual(t, string(originalJSON), mustMarshalJSON(t, applyTestMergePatch(t, patched, getTestRevertRecord(t, rr, c, key).RevertPatch).Object))
+
+	// the target is not recorded again while the definition of the patch is unchanged
+	recordPatch(patched, `{"spec":{"replicas":2}}`)
+	if computed != 1 {
+		t.Fatalf("expected the revert patch to be computed once, got %d", computed)
+	}
+
+	// the definition of the patch changes, the values recorded first are kept
+	rr.patchHashes["revert"] = "changed"
+	patched = recordPatch(patched, `{"spec":{"replicas":3,"template":{"spec":{"containers":[{"name":"app","image":"app:1","env":[{"name":"PATCHED","value":"true"}]},{"name":"sidecar","image":"sidecar:1"}]}}}}`)
+	if computed != 2 {
+		t.Fatalf("expected the revert patch to be computed again, got %d", computed)
+	}
+	record := getTestRevertRecord(t, rr, c, key)
+	if record.PatchHash != "changed" || record.Kind != "Deployment" || record.Namespace != "test" || record.Name != "target" {
+		t.Errorf("unexpected revert record: %+v", record)
+	}
+	assertJSONEqual(t, string(originalJSON), mustMarshalJSON(t, applyTestMergePatch(t, patched, record.RevertPatch).Object))
+
+	// the whole list touched by the patch is restored, overwriting the changes other actors made to it after the target was recorded
+	bumped := applyTestMergePatch(t, patched, []byte(`{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"app:1","env":[{"name":"PATCHED","value":"true"}]},{"name":"sidecar","image":"sidecar:2"}]}}}}`))
+	assertJSONEqual(t, string(originalJSON), mustMarshalJSON(t, applyTestMergePatch(t, bumped, record.RevertPatch).Object))
+}
+
+func mustMarshalJSON(t *testing.T, value interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("unable to marshal %v: %v", value, err)
+	}
+	return data
+}
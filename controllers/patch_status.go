@@ -0,0 +1,201 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// maxReportedTargets is the maximum number of targets listed in the status of each patch
+const maxReportedTargets = 100
+
+// getModelDependentGroupVersions returns the group versions whose OpenAPI document is needed by the patches of the instance, with the names of the patches targeting them
+func getModelDependentGroupVersions(instance redhatcopv1alpha1.PatchObject) map[schema.GroupVersion][]string {
+	groupVersions := map[schema.GroupVersion][]string{}
+	for patchName, patch := range instance.GetPatches() {
+		patchType := patch.PatchType
+		if patchType == "" {
+			patchType = redhatcopv1alpha1.GetPatchDefaults().PatchType
+		}
+		gvk := schema.FromAPIVersionAndKind(patch.TargetObjectRef.APIVersion, patch.TargetObjectRef.Kind)
+		if needsModel(types.PatchType(patchType), gvk) {
+			groupVersions[gvk.GroupVersion()] = append(groupVersions[gvk.GroupVersion()], patchName)
+		}
+	}
+	return groupVersions
+}
+
+// setGroupVersionsStatus reports whether the OpenAPI documents needed by the strategic merge patches of custom resources are available.
+// The condition is only set on the instances with such patches.
+func setGroupVersionsStatus(instance redhatcopv1alpha1.PatchObject, unavailableGroupVersions map[schema.GroupVersion]string) {
+	status := instance.GetPatchStatus()
+	groupVersions := getModelDependentGroupVersions(instance)
+	if len(groupVersions) == 0 {
+		apimeta.RemoveStatusCondition(&status.Conditions, redhatcopv1alpha1.GroupVersionsAvailableCondition)
+		return
+	}
+	groupVersionsAvailable := metav1.Condition{
+		Type:               redhatcopv1alpha1.GroupVersionsAvailableCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             redhatcopv1alpha1.AllGroupVersionsAvailableReason,
+		Message:            "the OpenAPI documents needed by the strategic merge patches are loaded",
+	}
+	unavailable := []string{}
+	for groupVersion, patchNames := range groupVersions {
+		if message, ok := unavailableGroupVersions[groupVersion]; ok {
+			sort.Strings(patchNames)
+			unavailable = append(unavailable, "the OpenAPI document of group version "+groupVersion.String()+" is unavailable, patches "+strings.Join(patchNames, ", ")+" fail until it is available: "+message)
+		}
+	}
+	if len(unavailable) > 0 {
+		sort.Strings(unavailable)
+		groupVersionsAvailable.Status = metav1.ConditionFalse
+		groupVersionsAvailable.Reason = redhatcopv1alpha1.GroupVersionsUnavailableReason
+		groupVersionsAvailable.Message = strings.Join(unavailable, "; ")
+	}
+	// the transition time only changes with the status of the condition
+	apimeta.SetStatusCondition(&status.Conditions, groupVersionsAvailable)
+}
+
+// getPatchHash returns a hash of the definition of a patch
+func getPatchHash(patch redhatcopv1alpha1.PatchDefinition) string {
+	bb, err := json.Marshal(patch)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(bb)
+	return hex.EncodeToString(hash[:8])
+}
+
+// filterFailingPatchStatuses returns only the statuses whose last condition is an error
+func filterFailingPatchStatuses(lockedPatchStatuses map[string]utilsv1alpha1.ConditionMap) map[string]utilsv1alpha1.ConditionMap {
+	failingPatchStatuses := map[string]utilsv1alpha1.ConditionMap{}
+	for patchName, conditionMap := range lockedPatchStatuses {
+		for key, conditions := range conditionMap {
+			if lastCondition, ok := apis.GetLastCondition(conditions); ok && apis.IsErrorCondition(lastCondition) {
+				if _, ok := failingPatchStatuses[patchName]; !ok {
+					failingPatchStatuses[patchName] = utilsv1alpha1.ConditionMap{}
+				}
+				failingPatchStatuses[patchName][key] = conditions
+			}
+		}
+	}
+	return failingPatchStatuses
+}
+
+// getTargetStatuses computes the per target status of each patch, combining the statuses reported by the enforcing controllers with the list of the currently selected targets
+func (r *PatchReconciler) getTargetStatuses(ctx context.Context, instance redhatcopv1alpha1.PatchObject, lockedPatchStatuses map[string]utilsv1alpha1.ConditionMap) map[string]redhatcopv1alpha1.PatchTargetsStatus {
+	rlog := log.FromContext(ctx)
+	previousTargetStatuses := instance.GetPatchStatus().TargetStatuses
+	token, ok := r.lookupServiceAccountToken(instance)
+	if !ok {
+		return previousTargetStatuses
+	}
+	ctx = context.WithValue(ctx, "restConfig", token.restConfig)
+	now := time.Now()
+	targetStatuses := map[string]redhatcopv1alpha1.PatchTargetsStatus{}
+	for patchName, patch := range instance.GetPatches() {
+		targetObjectRef := patch.TargetObjectRef
+		targets, err := getTargetObjects(ctx, &targetObjectRef)
+		if err != nil {
+			// the previous status is kept, reporting no targets would let the patches depending on this one be enforced
+			rlog.Error(err, "unable to get targets for", "patch", patchName)
+			if previousTargetStatus, ok := previousTargetStatuses[patchName]; ok {
+				targetStatuses[patchName] = previousTargetStatus
+			}
+			continue
+		}
+		drifts := r.detectDrift(instance, patchName, patch, targets, now)
+		patchTargetsStatus := computePatchTargetsStatus(getPatchHash(patch), targets, lockedPatchStatuses[patchName], previousTargetStatuses[patchName], drifts)
+		patchTargetsStatus.Suspension = r.getPatchSuspension(instance, patchName, patch, previousTargetStatuses[patchName].Suspension, drifts, now)
+		targetStatuses[patchName] = patchTargetsStatus
+	}
+	r.pruneDrift(instance)
+	return targetStatuses
+}
+
+func computePatchTargetsStatus(patchHash string, targets []unstructured.Unstructured, conditionMap utilsv1alpha1.ConditionMap, previous redhatcopv1alpha1.PatchTargetsStatus, drifts map[string]*targetDrift) redhatcopv1alpha1.PatchTargetsStatus {
+	previousTargets := map[string]redhatcopv1alpha1.PatchTargetStatus{}
+	for _, target := range previous.Targets {
+		previousTargets[target.Namespace+"/"+target.Name] = target
+	}
+	patchTargetsStatus := redhatcopv1alpha1.PatchTargetsStatus{
+		Matched:   len(targets),
+		PatchHash: patchHash,
+	}
+	targetStatuses := []redhatcopv1alpha1.PatchTargetStatus{}
+	for i := range targets {
+		key := apis.GetKeyShort(&targets[i])
+		targetStatus := redhatcopv1alpha1.PatchTargetStatus{
+			Namespace: targets[i].GetNamespace(),
+			Name:      targets[i].GetName(),
+			UID:       targets[i].GetUID(),
+		}
+		if drift, ok := drifts[key]; ok && len(drift.reapplications) > 0 {
+			targetStatus.Reapplications = len(drift.reapplications)
+			targetStatus.ConflictingFieldManager = drift.conflictingFieldManager
+		}
+		conditions := conditionMap[key]
+		if success, ok := apis.GetCondition(apis.ReconcileSuccess, conditions); ok {
+			lastAppliedTime := success.LastTransitionTime
+			targetStatus.LastAppliedTime = &lastAppliedTime
+			targetStatus.AppliedPatchHash = patchHash
+			// the hash is carried over if the patch was not applied again since the last time we looked
+			if previousTarget, ok := previousTargets[key]; ok && previousTarget.LastAppliedTime != nil && previousTarget.LastAppliedTime.Equal(&lastAppliedTime) {
+				targetStatus.AppliedPatchHash = previousTarget.AppliedPatchHash
+			}
+		}
+		if lastCondition, ok := apis.GetLastCondition(conditions); ok {
+			if lastCondition.Type == apis.ReconcileSuccess {
+				patchTargetsStatus.Applied++
+			} else {
+				patchTargetsStatus.Failed++
+				targetStatus.Error = lastCondition.Message
+			}
+		}
+		targetStatuses = append(targetStatuses, targetStatus)
+	}
+	sort.SliceStable(targetStatuses, func(i, j int) bool {
+		if (targetStatuses[i].Error != "") != (targetStatuses[j].Error != "") {
+			return targetStatuses[i].Error != ""
+		}
+		return targetStatuses[i].Namespace+"/"+targetStatuses[i].Name < targetStatuses[j].Namespace+"/"+targetStatuses[j].Name
+	})
+	if len(targetStatuses) > maxReportedTargets {
+		targetStatuses = targetStatuses[:maxReportedTargets]
+		patchTargetsStatus.Truncated = true
+	}
+	patchTargetsStatus.Targets = targetStatuses
+	return patchTargetsStatus
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// statusChangeCoalescingPeriod is how long the status changes of the targets of an instance are collected before its status is updated,
+// so that the enforcement of a large selection of targets results in a few updates of the status, each listing the targets once, instead of one per target
+const statusChangeCoalescingPeriod = time.Second
+
+// statusChangeNotifier collects the status changes reported by the enforcing controllers and signals at most one change per instance and coalescing period.
+// Notifying a change never blocks the enforcing controllers, the changes are delivered to the parent controller once the notifier is started by the manager.
+type statusChangeNotifier struct {
+	period time.Duration
+	queue  workqueue.DelayingInterface
+	// pending are the instances whose change is queued, by key
+	pendingLock sync.Mutex
+	pending     map[types.NamespacedName]client.Object
+	changes     chan event.GenericEvent
+}
+
+func newStatusChangeNotifier(period time.Duration) *statusChangeNotifier {
+	return &statusChangeNotifier{
+		period:  period,
+		queue:   workqueue.NewDelayingQueue(),
+		pending: map[types.NamespacedName]client.Object{},
+		changes: make(chan event.GenericEvent),
+	}
+}
+
+// notify signals a change of the status of the targets of the instance, the changes notified before the previous one is delivered are coalesced with it
+func (n *statusChangeNotifier) notify(instance client.Object) {
+	key := client.ObjectKeyFromObject(instance)
+	n.pendingLock.Lock()
+	n.pending[key] = instance
+	n.pendingLock.Unlock()
+	n.queue.AddAfter(key, n.period)
+}
+
+// Start delivers the changes until the context is done
+func (n *statusChangeNotifier) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		n.queue.ShutDown()
+	}()
+	for {
+		item, shutdown := n.queue.Get()
+		if shutdown {
+			return nil
+		}
+		n.pendingLock.Lock()
+		instance := n.pending[item.(types.NamespacedName)]
+		delete(n.pending, item.(types.NamespacedName))
+		n.pendingLock.Unlock()
+		n.queue.Done(item)
+		select {
+		case n.changes <- event.GenericEvent{Object: instance}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// getChanges returns the channel through which the changes are delivered
+func (n *statusChangeNotifier) getChanges() <-chan event.GenericEvent {
+	return n.changes
+}
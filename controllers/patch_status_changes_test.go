@@ -0,0 +1,78 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestStatusChangeNotifier(t *testing.T) {
+	notifier := newStatusChangeNotifier(10 * time.Millisecond)
+	first := &redhatcopv1alpha1.Patch{ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "test"}}
+	second := &redhatcopv1alpha1.Patch{ObjectMeta: metav1.ObjectMeta{Name: "second", Namespace: "test"}}
+	// the enforcing controllers are never blocked, even before the notifier is started
+	for i := 0; i < 1000; i++ {
+		notifier.notify(first)
+	}
+	notifier.notify(second)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	stopped := make(chan struct{})
+	go func() {
+		notifier.Start(ctx)
+		close(stopped)
+	}()
+	received := map[client.ObjectKey]int{}
+	timeout := time.After(time.Second)
+	for len(received) < 2 {
+		select {
+		case change := <-notifier.getChanges():
+			received[client.ObjectKeyFromObject(change.Object)]++
+		case <-timeout:
+			t.Fatalf("expected a change of each instance, got %v", received)
+		}
+	}
+	select {
+	case change := <-notifier.getChanges():
+		t.Errorf("expected the changes of an instance to be coalesced, got another change of %s", client.ObjectKeyFromObject(change.Object))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a change notified after the previous one was delivered is delivered too
+	notifier.notify(first)
+	select {
+	case change := <-notifier.getChanges():
+		if client.ObjectKeyFromObject(change.Object) != client.ObjectKeyFromObject(first) {
+			t.Errorf("expected a change of %s, got %s", client.ObjectKeyFromObject(first), client.ObjectKeyFromObject(change.Object))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a new change to be delivered")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the notifier to stop with its context")
+	}
+}
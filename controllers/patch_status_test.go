@@ -0,0 +1,291 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newSuccessCondition(transitionTime time.Time) metav1.Condition {
+	return metav1.Condition{Type: apis.ReconcileSuccess, Status: metav1.ConditionTrue, Reason: apis.ReconcileSuccessReason, LastTransitionTime: metav1.NewTime(transitionTime)}
+}
+
+func newErrorCondition(transitionTime time.Time, message string) metav1.Condition {
+	return metav1.Condition{Type: apis.ReconcileError, Status: metav1.ConditionTrue, Reason: apis.ReconcileErrorReason, Message: message, LastTransitionTime: metav1.NewTime(transitionTime)}
+}
+
+func newTestTargets(count int) []unstructured.Unstructured {
+	targets := []unstructured.Unstructured{}
+	for i := 0; i < count; i++ {
+		targets = append(targets, *newTestObject("v1", "ConfigMap", "default", fmt.Sprintf("target-%03d", i), nil))
+	}
+	return targets
+}
+
+func TestComputePatchTargetsStatus(t *testing.T) {
+	appliedTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	previousAppliedTime := metav1.NewTime(appliedTime)
+	targets := newTestTargets(3)
+
+	tests := []struct {
+		name              string
+		targets           []unstructured.Unstructured
+		conditionMap      utilsv1alpha1.ConditionMap
+		previous          redhatcopv1alpha1.PatchTargetsStatus
+		drifts            map[string]*targetDrift
+		expectedApplied   int
+		expectedFailed    int
+		expectedTargets   []redhatcopv1alpha1.PatchTargetStatus
+		expectedTruncated bool
+	}{
+		{
+			name:            "targets not reconciled yet",
+			targets:         targets[:2],
+			conditionMap:    utilsv1alpha1.ConditionMap{},
+			expectedTargets: []redhatcopv1alpha1.PatchTargetStatus{{Namespace: "default", Name: "target-000"}, {Namespace: "default", Name: "target-001"}},
+		},
+		{
+			name:    "applied and failed targets, failed targets first",
+			targets: targets,
+			conditionMap: utilsv1alpha1.ConditionMap{
+				"default/target-000": {newSuccessCondition(appliedTime)},
+				"default/target-001": {newSuccessCondition(appliedTime), newErrorCondition(appliedTime.Add(time.Second), "forbidden")},
+				"default/target-002": {newErrorCondition(appliedTime, "conflict"), newSuccessCondition(appliedTime.Add(time.Second))},
+			},
+			expectedApplied: 2,
+			expectedFailed:  1,
+			expectedTargets: []redhatcopv1alpha1.PatchTargetStatus{
+				{Namespace: "default", Name: "target-001", LastAppliedTime: &previousAppliedTime, AppliedPatchHash: "hash", Error: "forbidden"},
+				{Namespace: "default", Name: "target-000", LastAppliedTime: &previousAppliedTime, AppliedPatchHash: "hash"},
+				{Namespace: "default", Name: "target-002", LastAppliedTime: timePtr(appliedTime.Add(time.Second)), AppliedPatchHash: "hash"},
+			},
+		},
+		{
+			name:    "applied hash carried over when the target was not patched again",
+			targets: targets[:2],
+			conditionMap: utilsv1alpha1.ConditionMap{
+				"default/target-000": {newSuccessCondition(appliedTime)},
+				"default/target-001": {newSuccessCondition(appliedTime.Add(time.Second))},
+			},
+			previous: redhatcopv1alpha1.PatchTargetsStatus{Targets: []redhatcopv1alpha1.PatchTargetStatus{
+				{Namespace: "default", Name: "target-000", LastAppliedTime: &previousAppliedTime, AppliedPatchHash: "old-hash"},
+				{Namespace: "default", Name: "target-001", LastAppliedTime: &previousAppliedTime, AppliedPatchHash: "old-hash"},
+			}},
+			expectedApplied: 2,
+			expectedTargets: []redhatcopv1alpha1.PatchTargetStatus{
+				{Namespace: "default", Name: "target-000", LastAppliedTime: &previousAppliedTime, AppliedPatchHash: "old-hash"},
+				{Namespace: "default", Name: "target-001", LastAppliedTime: timePtr(appliedTime.Add(time.Second)), AppliedPatchHash: "hash"},
+			},
+		},
+		{
+			name:         "reapplications reported from the drift",
+			targets:      targets[:1],
+			conditionMap: utilsv1alpha1.ConditionMap{},
+			drifts: map[string]*targetDrift{
+				"default/target-000": {reapplications: []time.Time{appliedTime, appliedTime}, conflictingFieldManager: "kubectl"},
+			},
+			expectedTargets: []redhatcopv1alpha1.PatchTargetStatus{{Namespace: "default", Name: "target-000", Reapplications: 2, ConflictingFieldManager: "kubectl"}},
+		},
+		{
+			name:         "no targets",
+			conditionMap: utilsv1alpha1.ConditionMap{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := computePatchTargetsStatus("hash", tt.targets, tt.conditionMap, tt.previous, tt.drifts)
+			if status.PatchHash != "hash" {
+				t.Errorf("expected patch hash %q, got %q", "hash", status.PatchHash)
+			}
+			if status.Matched != len(tt.targets) || status.Applied != tt.expectedApplied || status.Failed != tt.expectedFailed {
+				t.Errorf("expected matched %d, applied %d, failed %d, got %d, %d, %d", len(tt.targets), tt.expectedApplied, tt.expectedFailed, status.Matched, status.Applied, status.Failed)
+			}
+			if status.Truncated != tt.expectedTruncated {
+				t.Errorf("expected truncated %t, got %t", tt.expectedTruncated, status.Truncated)
+			}
+			if len(status.Targets) != len(tt.expectedTargets) {
+				t.Fatalf("expected %d targets, got %d: %+v", len(tt.expectedTargets), len(status.Targets), status.Targets)
+			}
+			for i := range tt.expectedTargets {
+				assertTargetStatus(t, tt.expectedTargets[i], status.Targets[i])
+			}
+		})
+	}
+}
+
+func TestComputePatchTargetsStatusTruncation(t *testing.T) {
+	targets := newTestTargets(maxReportedTargets + 10)
+	conditionMap := utilsv1alpha1.ConditionMap{}
+	now := time.Now()
+	for i := range targets {
+		conditionMap[apis.GetKeyShort(&targets[i])] = []metav1.Condition{newSuccessCondition(now)}
+	}
+	// the failed targets are the last ones by name, they must still be reported
+	failedTarget := targets[len(targets)-1]
+	conditionMap[apis.GetKeyShort(&failedTarget)] = []metav1.Condition{newErrorCondition(now, "forbidden")}
+
+	status := computePatchTargetsStatus("hash", targets, conditionMap, redhatcopv1alpha1.PatchTargetsStatus{}, nil)
+	if !status.Truncated {
+		t.Errorf("expected the targets to be truncated")
+	}
+	if len(status.Targets) != maxReportedTargets {
+		t.Fatalf("expected %d targets, got %d", maxReportedTargets, len(status.Targets))
+	}
+	if status.Matched != len(targets) || status.Applied != len(targets)-1 || status.Failed != 1 {
+		t.Errorf("expected the counts to include the truncated targets, got matched %d, applied %d, failed %d", status.Matched, status.Applied, status.Failed)
+	}
+	if status.Targets[0].Name != failedTarget.GetName() || status.Targets[0].Error != "forbidden" {
+		t.Errorf("expected the failed target first, got %+v", status.Targets[0])
+	}
+	if status.Targets[1].Name != "target-000" {
+		t.Errorf("expected the applied targets sorted by name, got %s", status.Targets[1].Name)
+	}
+}
+
+func TestComputePatchTargetsStatusNotTruncatedAtLimit(t *testing.T) {
+	status := computePatchTargetsStatus("hash", newTestTargets(maxReportedTargets), utilsv1alpha1.ConditionMap{}, redhatcopv1alpha1.PatchTargetsStatus{}, nil)
+	if status.Truncated || len(status.Targets) != maxReportedTargets {
+		t.Errorf("expected %d targets without truncation, got %d, truncated %t", maxReportedTargets, len(status.Targets), status.Truncated)
+	}
+}
+
+func timePtr(t time.Time) *metav1.Time {
+	mt := metav1.NewTime(t)
+	return &mt
+}
+
+func assertTargetStatus(t *testing.T, expected redhatcopv1alpha1.PatchTargetStatus, actual redhatcopv1alpha1.PatchTargetStatus) {
+	t.Helper()
+	if expected.Namespace != actual.Namespace || expected.Name != actual.Name || expected.Error != actual.Error || expected.AppliedPatchHash != actual.AppliedPatchHash ||
+		expected.Reapplications != actual.Reapplications || expected.ConflictingFieldManager != actual.ConflictingFieldManager {
+		t.Errorf("expected target status %+v, got %+v", expected, actual)
+	}
+	if (expected.LastAppliedTime == nil) != (actual.LastAppliedTime == nil) || (expected.LastAppliedTime != nil && !expected.LastAppliedTime.Equal(actual.LastAppliedTime)) {
+		t.Errorf("expected last applied time %v, got %v", expected.LastAppliedTime, actual.LastAppliedTime)
+	}
+}
+
+func TestSetGroupVersionsStatus(t *testing.T) {
+	widgets := schema.GroupVersion{Group: "example.com", Version: "v1"}
+	newPatch := func(patchType types.PatchType, apiVersion string, kind string) redhatcopv1alpha1.PatchDefinition {
+		patch := redhatcopv1alpha1.PatchDefinition{}
+		patch.PatchType = patchType
+		patch.TargetObjectRef.APIVersion = apiVersion
+		patch.TargetObjectRef.Kind = kind
+		return patch
+	}
+	tests := []struct {
+		name              string
+		patches           map[string]redhatcopv1alpha1.PatchDefinition
+		unavailable       map[schema.GroupVersion]string
+		existing          []metav1.Condition
+		expectedCondition bool
+		expectedStatus    metav1.ConditionStatus
+		expectedReason    string
+	}{
+		{
+			name:    "no patch of custom resources",
+			patches: map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch(types.StrategicMergePatchType, "v1", "ConfigMap")},
+		},
+		{
+			name:        "merge patch of an unavailable group version",
+			patches:     map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch(types.MergePatchType, widgets.String(), "Widget")},
+			unavailable: map[schema.GroupVersion]string{widgets: "the server is currently unable to handle the request"},
+		},
+		{
+			name:     "condition removed when the patches no longer need a model",
+			patches:  map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch(types.JSONPatchType, widgets.String(), "Widget")},
+			existing: []metav1.Condition{{Type: redhatcopv1alpha1.GroupVersionsAvailableCondition, Status: metav1.ConditionFalse}},
+		},
+		{
+			name:              "available group version",
+			patches:           map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch(types.StrategicMergePatchType, widgets.String(), "Widget")},
+			unavailable:       map[schema.GroupVersion]string{{Group: "metrics.k8s.io", Version: "v1beta1"}: "the server is currently unable to handle the request"},
+			expectedCondition: true,
+			expectedStatus:    metav1.ConditionTrue,
+			expectedReason:    redhatcopv1alpha1.AllGroupVersionsAvailableReason,
+		},
+		{
+			name:              "unavailable group version",
+			patches:           map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch(types.StrategicMergePatchType, widgets.String(), "Widget")},
+			unavailable:       map[schema.GroupVersion]string{widgets: "the server is currently unable to handle the request"},
+			expectedCondition: true,
+			expectedStatus:    metav1.ConditionFalse,
+			expectedReason:    redhatcopv1alpha1.GroupVersionsUnavailableReason,
+		},
+		{
+			name:              "unavailable group version with the default patch type",
+			patches:           map[string]redhatcopv1alpha1.PatchDefinition{"a": newPatch("", widgets.String(), "Widget")},
+			unavailable:       map[schema.GroupVersion]string{widgets: "the server is currently unable to handle the request"},
+			expectedCondition: true,
+			expectedStatus:    metav1.ConditionFalse,
+			expectedReason:    redhatcopv1alpha1.GroupVersionsUnavailableReason,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &redhatcopv1alpha1.Patch{}
+			instance.Generation = 2
+			instance.Spec.Patches = tt.patches
+			instance.Status.Conditions = tt.existing
+			setGroupVersionsStatus(instance, tt.unavailable)
+			condition := apimeta.FindStatusCondition(instance.Status.Conditions, redhatcopv1alpha1.GroupVersionsAvailableCondition)
+			if !tt.expectedCondition {
+				if condition != nil {
+					t.Fatalf("expected no condition, got %+v", condition)
+				}
+				return
+			}
+			if condition == nil {
+				t.Fatalf("expected a condition")
+			}
+			if condition.Status != tt.expectedStatus || condition.Reason != tt.expectedReason || condition.ObservedGeneration != 2 {
+				t.Errorf("unexpected condition %+v", condition)
+			}
+		})
+	}
+}
+
+func TestSetGroupVersionsStatusMessage(t *testing.T) {
+	widgets := schema.GroupVersion{Group: "example.com", Version: "v1"}
+	instance := &redhatcopv1alpha1.Patch{}
+	instance.Spec.Patches = map[string]redhatcopv1alpha1.PatchDefinition{}
+	for _, name := range []string{"b", "a"} {
+		patch := redhatcopv1alpha1.PatchDefinition{}
+		patch.PatchType = types.StrategicMergePatchType
+		patch.TargetObjectRef.APIVersion = widgets.String()
+		patch.TargetObjectRef.Kind = "Widget"
+		instance.Spec.Patches[name] = patch
+	}
+	setGroupVersionsStatus(instance, map[schema.GroupVersion]string{widgets: "not found"})
+	condition := apimeta.FindStatusCondition(instance.Status.Conditions, redhatcopv1alpha1.GroupVersionsAvailableCondition)
+	expected := "the OpenAPI document of group version example.com/v1 is unavailable, patches a, b fail until it is available: not found"
+	if condition == nil || condition.Message != expected {
+		t.Errorf("expected the message %q, got %+v", expected, condition)
+	}
+}
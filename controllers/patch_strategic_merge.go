@@ -0,0 +1,89 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+)
+
+// modelGetter returns the OpenAPI model of a GVK, nil if it is not known
+type modelGetter interface {
+	GetModel(ctx context.Context, gvk schema.GroupVersionKind) (openapi.Schema, error)
+}
+
+// getPatchForTarget returns the patch to send to the api server for the target.
+// Custom resources don't support strategic merge patches, so for the types that have a CRD model the patch is applied locally to the target,
+// using the patch metadata derived from the list markers of the CRD schema, and the changes are returned as a merge patch.
+// The merge patch carries the resource version of the target it was computed from, so that a concurrent change results in a conflict and the patch is retried.
+// The other patches, and the strategic merge patches of the built-in and aggregated types, are returned as they are.
+func getPatchForTarget(ctx context.Context, models modelGetter, target *unstructured.Unstructured, patchType types.PatchType, patch []byte) (types.PatchType, []byte, error) {
+	if models == nil || !needsModel(patchType, target.GroupVersionKind()) {
+		return patchType, patch, nil
+	}
+	model, err := models.GetModel(ctx, target.GroupVersionKind())
+	if err != nil {
+		return "", nil, err
+	}
+	if model == nil {
+		return patchType, patch, nil
+	}
+	mergePatch, err := getCustomResourceMergePatch(target, patch, model)
+	if err != nil {
+		return "", nil, err
+	}
+	return types.MergePatchType, mergePatch, nil
+}
+
+// needsModel returns whether patches of the type need the OpenAPI model of the kind: strategic merge patches of the kinds unknown to client-go, such as custom resources
+func needsModel(patchType types.PatchType, gvk schema.GroupVersionKind) bool {
+	return patchType == types.StrategicMergePatchType && !scheme.Scheme.Recognizes(gvk)
+}
+
+// getCustomResourceMergePatch returns the merge patch producing the same object as the strategic merge patch applied to the target
+func getCustomResourceMergePatch(target *unstructured.Unstructured, patch []byte, model openapi.Schema) ([]byte, error) {
+	original, err := target.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patched, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(original, patch, newPatchMetaFromOpenAPI(model))
+	if err != nil {
+		return nil, err
+	}
+	mergePatch, err := jsonpatch.CreateMergePatch(original, patched)
+	if err != nil {
+		return nil, err
+	}
+	mergePatchMap := map[string]interface{}{}
+	err = json.Unmarshal(mergePatch, &mergePatchMap)
+	if err != nil {
+		return nil, err
+	}
+	err = unstructured.SetNestedField(mergePatchMap, target.GetResourceVersion(), "metadata", "resourceVersion")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatchMap)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	v1authn "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// references a PatchTemplate as namespace/name or a ClusterPatchTemplate as name
+const patchTemplateRefAnnotation string = "redhat-cop.redhat.io/patch-template-ref"
+
+// yaml map of the values of the parameters of the referenced template
+const patchTemplateParametersAnnotation string = "redhat-cop.redhat.io/patch-template-parameters"
+
+// getReferencedPatch returns the patch defined by the template referenced by the annotations, or nil if no template is referenced.
+// The template is read impersonating the user issuing the request, so users can only use the templates they are allowed to read.
+func (a *PatchInjector) getReferencedPatch(ctx context.Context, userInfo *v1authn.UserInfo, annotations map[string]string) (*injectedPatch, error) {
+	ref, ok := annotations[patchTemplateRefAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	spec, err := a.getPatchTemplateSpec(ctx, userInfo, ref)
+	if err != nil {
+		createTimePatchLog.Error(err, "unable to get patch template", "reference", ref)
+		return nil, err
+	}
+	return newReferencedPatch(spec, annotations)
+}
+
+// newReferencedPatch returns the patch defined by the referenced template, with the parameters passed by the annotations
+func newReferencedPatch(spec *redhatcopv1alpha1.PatchTemplateSpec, annotations map[string]string) (*injectedPatch, error) {
+	parameters, err := getPatchTemplateParameters(spec, annotations[patchTemplateParametersAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	patchType := strategicMergePatch
+	if spec.PatchType != "" {
+		patchType = PatchType(spec.PatchType)
+	}
+	return &injectedPatch{
+		key:        patchTemplateRefAnnotation,
+		template:   spec.Template,
+		patchType:  patchType,
+		order:      -1,
+		parameters: parameters,
+	}, nil
+}
+
+// getPatchTemplateSpec reads the referenced PatchTemplate, for references of the form namespace/name, or ClusterPatchTemplate, for references of the form name
+func (a *PatchInjector) getPatchTemplateSpec(ctx context.Context, userInfo *v1authn.UserInfo, ref string) (*redhatcopv1alpha1.PatchTemplateSpec, error) {
+	namespace, name, err := parsePatchTemplateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	impersonatingClient, err := a.getImpersonatingClient(userInfo)
+	if err != nil {
+		return nil, err
+	}
+	if namespace != "" {
+		patchTemplate := &redhatcopv1alpha1.PatchTemplate{}
+		err = impersonatingClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, patchTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return &patchTemplate.Spec, nil
+	}
+	clusterPatchTemplate := &redhatcopv1alpha1.ClusterPatchTemplate{}
+	err = impersonatingClient.Get(ctx, client.ObjectKey{Name: name}, clusterPatchTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterPatchTemplate.Spec, nil
+}
+
+// parsePatchTemplateRef returns the namespace and name of the referenced template, the namespace is empty for ClusterPatchTemplates
+func parsePatchTemplateRef(ref string) (namespace string, name string, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return "", "", errors.New("invalid value of annotation " + patchTemplateRefAnnotation + ": " + ref + ", expected namespace/name or name")
+	}
+	if len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	return "", parts[0], nil
+}
+
+// getPatchTemplateParameters returns the values of the parameters of the template, taken from the annotation or from their defaults
+func getPatchTemplateParameters(spec *redhatcopv1alpha1.PatchTemplateSpec, annotation string) (map[string]string, error) {
+	values := map[string]interface{}{}
+	if annotation != "" {
+		err := yaml.Unmarshal([]byte(annotation), &values)
+		if err != nil {
+			return nil, errors.New("invalid value of annotation " + patchTemplateParametersAnnotation + ": " + err.Error())
+		}
+	}
+	parameters := map[string]string{}
+	for _, parameter := range spec.Parameters {
+		value, ok := values[parameter.Name]
+		switch {
+		case ok:
+			parameters[parameter.Name] = fmt.Sprint(value)
+		case parameter.Required:
+			return nil, errors.New("missing value of required parameter " + parameter.Name)
+		default:
+			parameters[parameter.Name] = parameter.Default
+		}
+	}
+	unknown := []string{}
+	for name := range values {
+		if _, ok := parameters[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.New("unknown parameters: " + strings.Join(unknown, ", "))
+	}
+	return parameters, nil
+}
+
+// getParamFunction returns the template function that looks up the value of a parameter
+func getParamFunction(parameters map[string]string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		value, ok := parameters[name]
+		if !ok {
+			return "", errors.New("undefined parameter " + name)
+		}
+		return value, nil
+	}
+}
+
+// getErrorCode returns the http code of api errors, other errors are caused by invalid requests
+func getErrorCode(err error) int32 {
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code
+	}
+	return http.StatusBadRequest
+}
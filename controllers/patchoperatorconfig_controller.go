@@ -0,0 +1,254 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// patchOperatorConfigRequest is the request of the PatchOperatorConfig of the operator
+var patchOperatorConfigRequest = reconcile.Request{
+	NamespacedName: types.NamespacedName{
+		Name: redhatcopv1alpha1.PatchOperatorConfigName,
+	},
+}
+
+var patchOperatorConfigLog = ctrl.Log.WithName("patch-operator-config")
+
+// NewPatchOperatorConfigReconciler returns the reconciler of the PatchOperatorConfig.
+// defaults are the settings given by the flags and environment variables, patchInjector is nil when the webhooks are disabled and logLevel is nil when the level of the logger cannot be changed.
+func NewPatchOperatorConfigReconciler(reconcilerBase util.ReconcilerBase, models *CustomResourceDefinitionReconciler, defaults OperatorSettings, patchInjector *PatchInjector, logLevel *zap.AtomicLevel) *PatchOperatorConfigReconciler {
+	return &PatchOperatorConfigReconciler{
+		ReconcilerBase: reconcilerBase,
+		models:         models,
+		defaults:       defaults,
+		applier: &operatorSettingsApplier{
+			injector: patchInjector,
+			logLevel: logLevel,
+		},
+	}
+}
+
+// PatchOperatorConfigReconciler reconciles the PatchOperatorConfig of the operator, creating it if it doesn't exist.
+// The settings of its spec are applied by every replica as soon as they change, its status reports the effective settings and the health of the subsystems of the operator.
+type PatchOperatorConfigReconciler struct {
+	util.ReconcilerBase
+	models   *CustomResourceDefinitionReconciler
+	defaults OperatorSettings
+	applier  *operatorSettingsApplier
+}
+
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=patchoperatorconfigs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=patchoperatorconfigs/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=redhatcop.redhat.io,resources=patchoperatorconfigs/finalizers,verbs=update
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *PatchOperatorConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	rlog := log.FromContext(ctx).WithName(req.Name)
+	ctx = log.IntoContext(ctx, rlog)
+	if req.Name != redhatcopv1alpha1.PatchOperatorConfigName {
+		rlog.V(1).Info("ignoring PatchOperatorConfig, only " + redhatcopv1alpha1.PatchOperatorConfigName + " is reconciled")
+		return reconcile.Result{}, nil
+	}
+	instance := &redhatcopv1alpha1.PatchOperatorConfig{}
+	err := r.GetClient().Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			// Error reading the object - requeue the request.
+			return reconcile.Result{}, err
+		}
+		instance.Name = redhatcopv1alpha1.PatchOperatorConfigName
+		err = r.GetClient().Create(ctx, instance)
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			rlog.Error(err, "unable to create", "PatchOperatorConfig", instance.Name)
+			return reconcile.Result{}, err
+		}
+		// the creation triggers another reconcile, which sets the status
+		return reconcile.Result{}, nil
+	}
+
+	// the settings are applied by the informer event handler, the same settings are computed here to be reported
+	settings, err := r.defaults.withConfig(&instance.Spec)
+	configurationApplied := metav1.Condition{
+		Type:               redhatcopv1alpha1.ConfigurationAppliedCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             redhatcopv1alpha1.ConfigurationAppliedReason,
+		Message:            "the settings of the spec are applied",
+	}
+	if err != nil {
+		configurationApplied.Status = metav1.ConditionFalse
+		configurationApplied.Reason = redhatcopv1alpha1.InvalidConfigurationReason
+		configurationApplied.Message = "invalid configuration, the previous settings are kept: " + err.Error()
+		if applied := r.applier.getApplied(); applied != nil {
+			settings = *applied
+		} else {
+			settings = r.defaults
+		}
+	}
+	apimeta.SetStatusCondition(&instance.Status.Conditions, configurationApplied)
+	instance.Status.EffectiveSettings = settings.getEffectiveSettings()
+	r.setModelsStatus(instance)
+	r.setWebhooksStatus(instance)
+	return r.ManageSuccess(ctx, instance)
+}
+
+// setModelsStatus reports whether the OpenAPI models are loaded and the group versions whose OpenAPI document could not be loaded
+func (r *PatchOperatorConfigReconciler) setModelsStatus(instance *redhatcopv1alpha1.PatchOperatorConfig) {
+	modelsLoaded := metav1.Condition{
+		Type:               redhatcopv1alpha1.ModelsLoadedCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             redhatcopv1alpha1.ModelsLoadedReason,
+		Message:            "the OpenAPI models needed to apply strategic merge patches are loaded",
+	}
+	if r.models == nil || !r.models.IsLoaded() {
+		modelsLoaded.Status = metav1.ConditionFalse
+		modelsLoaded.Reason = redhatcopv1alpha1.ModelsNotLoadedReason
+		modelsLoaded.Message = errModelsNotLoaded.Error()
+	}
+	// the transition time only changes with the status of the condition
+	apimeta.SetStatusCondition(&instance.Status.Conditions, modelsLoaded)
+
+	unavailableGroupVersions := []redhatcopv1alpha1.UnavailableGroupVersion{}
+	if r.models != nil {
+		for groupVersion, message := range r.models.GetUnavailableGroupVersions() {
+			unavailableGroupVersions = append(unavailableGroupVersions, redhatcopv1alpha1.UnavailableGroupVersion{
+				GroupVersion: groupVersion.String(),
+				Message:      message,
+			})
+		}
+	}
+	sort.Slice(unavailableGroupVersions, func(i, j int) bool {
+		return unavailableGroupVersions[i].GroupVersion < unavailableGroupVersions[j].GroupVersion
+	})
+	instance.Status.UnavailableGroupVersions = unavailableGroupVersions
+	groupVersionsAvailable := metav1.Condition{
+		Type:               redhatcopv1alpha1.GroupVersionsAvailableCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             redhatcopv1alpha1.AllGroupVersionsAvailableReason,
+		Message:            "the OpenAPI documents of all the group versions are loaded",
+	}
+	if len(unavailableGroupVersions) > 0 {
+		groupVersionsAvailable.Status = metav1.ConditionFalse
+		groupVersionsAvailable.Reason = redhatcopv1alpha1.GroupVersionsUnavailableReason
+		groupVersionsAvailable.Message = strconv.Itoa(len(unavailableGroupVersions)) + " group versions are unavailable, strategic merge patches of their kinds fail until they are available"
+	}
+	apimeta.SetStatusCondition(&instance.Status.Conditions, groupVersionsAvailable)
+}
+
+// setWebhooksStatus reports whether the webhooks are served
+func (r *PatchOperatorConfigReconciler) setWebhooksStatus(instance *redhatcopv1alpha1.PatchOperatorConfig) {
+	webhooksEnabled := metav1.Condition{
+		Type:               redhatcopv1alpha1.WebhooksEnabledCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             redhatcopv1alpha1.WebhooksEnabledReason,
+		Message:            "the defaulting, validating and creation time injection webhooks are served",
+	}
+	if !r.defaults.WebhooksEnabled {
+		webhooksEnabled.Status = metav1.ConditionFalse
+		webhooksEnabled.Reason = redhatcopv1alpha1.WebhooksDisabledReason
+		webhooksEnabled.Message = "the webhooks are disabled by the ENABLE_WEBHOOKS environment variable, patches are neither defaulted nor validated and creation time patches are not injected"
+	}
+	apimeta.SetStatusCondition(&instance.Status.Conditions, webhooksEnabled)
+}
+
+// applyConfig applies the settings of the PatchOperatorConfig, or the defaults when it is deleted. Invalid settings are ignored, the current ones are kept.
+func (r *PatchOperatorConfigReconciler) applyConfig(object interface{}) {
+	instance, ok := object.(*redhatcopv1alpha1.PatchOperatorConfig)
+	if !ok || instance.Name != redhatcopv1alpha1.PatchOperatorConfigName {
+		return
+	}
+	settings, err := r.defaults.withConfig(&instance.Spec)
+	if err != nil {
+		patchOperatorConfigLog.Error(err, "invalid configuration, keeping the current settings")
+		return
+	}
+	r.applySettings(settings)
+}
+
+func (r *PatchOperatorConfigReconciler) applySettings(settings OperatorSettings) {
+	err := r.applier.apply(settings)
+	if err != nil {
+		patchOperatorConfigLog.Error(err, "unable to apply settings")
+		return
+	}
+	patchOperatorConfigLog.Info("settings applied", "settings", settings.getEffectiveSettings())
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// The settings are applied by an event handler of the informer, so that they are applied by every replica, the webhooks being served by all of them.
+// The PatchOperatorConfig is reconciled when the controller starts, so that it is created, when it is changed or deleted and when the status of the OpenAPI models changes.
+// The updates of its status are ignored.
+func (r *PatchOperatorConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// until the PatchOperatorConfig is observed, the operator runs with the defaults
+	r.applySettings(r.defaults)
+	informer, err := mgr.GetCache().GetInformer(context.TODO(), &redhatcopv1alpha1.PatchOperatorConfig{})
+	if err != nil {
+		return err
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: r.applyConfig,
+		UpdateFunc: func(_, newObject interface{}) {
+			r.applyConfig(newObject)
+		},
+		DeleteFunc: func(object interface{}) {
+			if tombstone, ok := object.(toolscache.DeletedFinalStateUnknown); ok {
+				object = tombstone.Obj
+			}
+			if instance, ok := object.(*redhatcopv1alpha1.PatchOperatorConfig); ok && instance.Name == redhatcopv1alpha1.PatchOperatorConfigName {
+				r.applySettings(r.defaults)
+			}
+		},
+	})
+
+	startup := make(chan event.GenericEvent, 1)
+	startup <- event.GenericEvent{Object: &redhatcopv1alpha1.PatchOperatorConfig{}}
+	enqueueConfig := handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+		return []reconcile.Request{patchOperatorConfigRequest}
+	})
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
+		For(&redhatcopv1alpha1.PatchOperatorConfig{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Channel{Source: startup}, enqueueConfig)
+	if r.models != nil {
+		controllerBuilder = controllerBuilder.Watches(&source.Channel{Source: r.models.StatusChanges()}, enqueueConfig)
+	}
+	return controllerBuilder.Complete(r)
+}
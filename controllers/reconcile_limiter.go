@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var (
+	// reconcileLimiters limit the number of concurrent reconciles of the Patches and of the ClusterPatches, by kind.
+	// The controllers run MaxConcurrentReconcilesLimit workers so that the limit can be changed at runtime.
+	reconcileLimiters = map[string]*reconcileLimiter{
+		"Patch":        newReconcileLimiter(1),
+		"ClusterPatch": newReconcileLimiter(1),
+	}
+	// allowedTargetsChanges signal the controllers of the Patches and of the ClusterPatches, by kind, that the allowed targets changed
+	allowedTargetsChanges = map[string]chan event.GenericEvent{
+		"Patch":        make(chan event.GenericEvent, 1),
+		"ClusterPatch": make(chan event.GenericEvent, 1),
+	}
+)
+
+// reconcileLimiter is a semaphore whose size can be changed while it is in use
+type reconcileLimiter struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+}
+
+func newReconcileLimiter(limit int) *reconcileLimiter {
+	limiter := &reconcileLimiter{limit: limit}
+	limiter.cond = sync.NewCond(&limiter.lock)
+	return limiter
+}
+
+// acquire waits until fewer reconciles than the limit are running
+func (l *reconcileLimiter) acquire() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.running >= l.limit {
+		l.cond.Wait()
+	}
+	l.running++
+}
+
+func (l *reconcileLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	l.cond.Signal()
+}
+
+// setLimit changes the limit, the reconciles already running above a lowered limit complete normally
+func (l *reconcileLimiter) setLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > redhatcopv1alpha1.MaxConcurrentReconcilesLimit {
+		limit = redhatcopv1alpha1.MaxConcurrentReconcilesLimit
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
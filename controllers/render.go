@@ -0,0 +1,550 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	openapi_v3 "github.com/google/gnostic/openapiv3"
+	utilsv1alpha1 "github.com/redhat-cop/operator-utils/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller/lockedpatch"
+	utilstemplate "github.com/redhat-cop/operator-utils/pkg/util/templates"
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	apiextension "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	openapi "k8s.io/kube-openapi/pkg/util/proto"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+var renderLog = log.Log.WithName("render")
+
+// stringsFlag is a repeatable command line flag whose values can also be comma separated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, strings.Split(value, ",")...)
+	return nil
+}
+
+// renderResult is the outcome of the rendering of a patch for a target
+type renderResult struct {
+	Patch         string      `json:"patch"`
+	Target        string      `json:"target"`
+	PatchType     string      `json:"patchType"`
+	RenderedPatch interface{} `json:"renderedPatch,omitempty"`
+	PatchedObject interface{} `json:"patchedObject,omitempty"`
+	Notes         []string    `json:"notes,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// RenderCommand implements the render subcommand: it renders the patches of Patches, ClusterPatches and objects carrying the injection annotations against local objects, without a cluster.
+// Local objects stand in for the targets, the source objects and the results of the lookups. For each patch and target the rendered patch and the patched object are printed as yaml.
+func RenderCommand(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var files, objectFiles stringsFlag
+	flags.Var(&files, "f", "Yaml file with the Patches, ClusterPatches or annotated objects to render. Can be repeated.")
+	flags.Var(&objectFiles, "objects", "Yaml file with the objects standing in for the targets, the source objects and the results of the lookups. Can be repeated.")
+	flags.Usage = func() {
+		io.WriteString(stderr, "Usage: render -f <file> [-objects <file>]...\n")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if len(files) == 0 {
+		flags.Usage()
+		return errors.New("missing -f")
+	}
+	inputs, err := readObjects(files)
+	if err != nil {
+		return err
+	}
+	objects, err := readObjects(objectFiles)
+	if err != nil {
+		return err
+	}
+	models, err := getLocalModels(objects)
+	if err != nil {
+		return err
+	}
+
+	ctx := log.IntoContext(context.TODO(), renderLog)
+	results := []renderResult{}
+	for i := range inputs {
+		if inputs[i].GetAPIVersion() == redhatcopv1alpha1.GroupVersion.String() && (inputs[i].GetKind() == "Patch" || inputs[i].GetKind() == "ClusterPatch") {
+			patchResults, err := renderPatchObject(ctx, &inputs[i], objects, models)
+			if err != nil {
+				return err
+			}
+			results = append(results, patchResults...)
+			continue
+		}
+		injectionResults, err := renderInjectedPatches(&inputs[i], objects, models)
+		if err != nil {
+			return err
+		}
+		results = append(results, injectionResults...)
+	}
+
+	failed := false
+	for i := range results {
+		out, err := yaml.Marshal(results[i])
+		if err != nil {
+			return err
+		}
+		io.WriteString(stdout, "---\n")
+		stdout.Write(out)
+		failed = failed || results[i].Error != ""
+	}
+	if failed {
+		return errors.New("some patches could not be rendered")
+	}
+	return nil
+}
+
+// renderPatchObject renders the patches of a Patch or ClusterPatch for each of the local objects they target, the same way the enforcing controllers do
+func renderPatchObject(ctx context.Context, input *unstructured.Unstructured, objects localObjects, models localModels) ([]renderResult, error) {
+	// the object references have unexported fields, which the unstructured converter can't handle
+	patch := &redhatcopv1alpha1.Patch{}
+	data, err := input.MarshalJSON()
+	if err == nil {
+		err = json.Unmarshal(data, patch)
+	}
+	if err != nil {
+		return nil, errors.New("unable to read " + input.GetKind() + " " + input.GetName() + ": " + err.Error())
+	}
+	patchNames := []string{}
+	for patchName := range patch.Spec.Patches {
+		patchNames = append(patchNames, patchName)
+	}
+	sort.Strings(patchNames)
+	results := []renderResult{}
+	for _, patchName := range patchNames {
+		patchDefinition := patch.Spec.Patches[patchName]
+		key := input.GetKind() + "/" + input.GetName() + "/" + patchName
+		// the defaulting webhook sets the patch type of the objects stored in a cluster, local objects may not have one
+		if patchDefinition.PatchType == "" {
+			patchDefinition.PatchType = redhatcopv1alpha1.GetPatchDefaults().PatchType
+		}
+		templ, err := template.New(patchDefinition.PatchTemplate).Funcs(objects.templateFuncMap()).Parse(patchDefinition.PatchTemplate)
+		if err != nil {
+			results = append(results, renderResult{Patch: key, PatchType: string(patchDefinition.PatchType), Error: err.Error()})
+			continue
+		}
+		lockedPatch := &lockedpatch.LockedPatch{
+			Name:             patchName,
+			SourceObjectRefs: patchDefinition.SourceObjectRefs,
+			TargetObjectRef:  patchDefinition.TargetObjectRef,
+			PatchType:        patchDefinition.PatchType,
+			PatchTemplate:    patchDefinition.PatchTemplate,
+			Template:         *templ,
+		}
+		targets, err := objects.selectTargets(&patchDefinition.TargetObjectRef)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 {
+			results = append(results, renderResult{Patch: key, PatchType: string(patchDefinition.PatchType), Notes: []string{"no local object is selected by the target reference"}})
+			continue
+		}
+		for j := range targets {
+			target := &targets[j]
+			result := renderResult{Patch: key, Target: getTargetKey(target), PatchType: string(patchDefinition.PatchType)}
+			rendered, err := renderPatchWithSources(ctx, lockedPatch, target, func(sourceObjectRef *utilsv1alpha1.SourceObjectReference) (*unstructured.Unstructured, error) {
+				name, namespace, err := objects.getSourceNameAndNamespace(sourceObjectRef, target)
+				if err != nil {
+					return nil, err
+				}
+				obj, ok := objects.get(sourceObjectRef.APIVersion, sourceObjectRef.Kind, namespace, name)
+				if !ok {
+					return nil, errors.New("source object " + sourceObjectRef.APIVersion + "/" + sourceObjectRef.Kind + " " + namespace + "/" + name + " not found in the local objects")
+				}
+				return obj, nil
+			})
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			patchType, notes := models.getPatchType(target, PatchType(patchDefinition.PatchType))
+			result.Notes = notes
+			original, err := target.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			patched, err := applyPatch(original, target, rendered, patchType, models.getPatchMeta)
+			setRenderResult(&result, rendered, patched, err)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// renderInjectedPatches renders the patches defined by the annotations of the object and applies them in sequence, the same way the creation time webhook does.
+// Injection policies are not evaluated, referenced templates are read from the local objects.
+func renderInjectedPatches(input *unstructured.Unstructured, objects localObjects, models localModels) ([]renderResult, error) {
+	target := getTargetKey(input)
+	patches, err := getInjectedPatches(input.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := input.GetAnnotations()[patchTemplateRefAnnotation]; ok {
+		spec, err := objects.getPatchTemplateSpec(ref)
+		if err != nil {
+			return nil, err
+		}
+		referencedPatch, err := newReferencedPatch(spec, input.GetAnnotations())
+		if err != nil {
+			return nil, err
+		}
+		patches = append([]injectedPatch{*referencedPatch}, patches...)
+	}
+	if len(patches) == 0 {
+		return []renderResult{{Target: target, Notes: []string{"the object defines no patches"}}}, nil
+	}
+	results := []renderResult{}
+	current, err := input.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	for i := range patches {
+		result := renderResult{Patch: patches[i].key, Target: target, PatchType: string(patches[i].patchType)}
+		obj := &unstructured.Unstructured{}
+		err := obj.UnmarshalJSON(current)
+		if err != nil {
+			return nil, err
+		}
+		// the patch type is only changed for the application, the result reports the declared one
+		patch := patches[i]
+		patch.patchType, result.Notes = models.getPatchType(obj, patch.patchType)
+		patched, err := renderAndInjectPatch(current, &patch, objects.templateFuncMap(), models.getPatchMeta)
+		setRenderResult(&result, patch.rendered, patched, err)
+		results = append(results, result)
+		if err != nil {
+			// the following templates would receive an object that the webhook would never pass them
+			break
+		}
+		current = patched
+	}
+	return results, nil
+}
+
+// setRenderResult stores the rendered patch and the patched object, both json, in the result
+func setRenderResult(result *renderResult, rendered []byte, patched []byte, err error) {
+	if rendered != nil {
+		var renderedPatch interface{}
+		if json.Unmarshal(rendered, &renderedPatch) == nil {
+			result.RenderedPatch = renderedPatch
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	var patchedObject interface{}
+	if json.Unmarshal(patched, &patchedObject) == nil {
+		result.PatchedObject = patchedObject
+	}
+}
+
+// localModels are the OpenAPI models of the custom resources defined by the local CustomResourceDefinitions, by GVK
+type localModels map[schema.GroupVersionKind]openapi.Schema
+
+// getLocalModels builds the models of the served versions of the local CustomResourceDefinitions, the same way they are built from the OpenAPI v3 documents published by the api server
+func getLocalModels(objects localObjects) (localModels, error) {
+	models := localModels{}
+	for i := range objects {
+		if objects[i].GroupVersionKind() != apiextension.SchemeGroupVersion.WithKind("CustomResourceDefinition") {
+			continue
+		}
+		crd := &apiextension.CustomResourceDefinition{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(objects[i].Object, crd)
+		if err != nil {
+			return nil, errors.New("unable to read CustomResourceDefinition " + objects[i].GetName() + ": " + err.Error())
+		}
+		crdModels, err := getCRDModels(crd)
+		if err != nil {
+			return nil, errors.New("unable to build the models of CustomResourceDefinition " + crd.Name + ": " + err.Error())
+		}
+		for gvk, model := range crdModels {
+			models[gvk] = model
+		}
+	}
+	return models, nil
+}
+
+// getCRDModels returns the models of the served versions of the CustomResourceDefinition, wrapping their schemas in an OpenAPI v3 document
+func getCRDModels(crd *apiextension.CustomResourceDefinition) (map[schema.GroupVersionKind]openapi.Schema, error) {
+	schemas := map[string]interface{}{}
+	for _, version := range crd.Spec.Versions {
+		if !version.Served || version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		data, err := json.Marshal(version.Schema.OpenAPIV3Schema)
+		if err != nil {
+			return nil, err
+		}
+		versionSchema := map[string]interface{}{}
+		err = json.Unmarshal(data, &versionSchema)
+		if err != nil {
+			return nil, err
+		}
+		versionSchema[groupVersionKindExtension] = []interface{}{map[string]interface{}{"group": crd.Spec.Group, "version": version.Name, "kind": crd.Spec.Names.Kind}}
+		schemas[crd.Spec.Group+"."+version.Name+"."+crd.Spec.Names.Kind] = versionSchema
+	}
+	if len(schemas) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"openapi":    "3.0.0",
+		"info":       map[string]interface{}{"title": crd.Name, "version": "local"},
+		"paths":      map[string]interface{}{},
+		"components": map[string]interface{}{"schemas": schemas},
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := openapi_v3.ParseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	flattenAllOf(doc)
+	openapiModels, err := openapi.NewOpenAPIV3Data(doc)
+	if err != nil {
+		return nil, err
+	}
+	return indexModels(openapiModels, nil), nil
+}
+
+// getPatchType returns the patch type with which the patch can be applied offline, with notes explaining the differences from the cluster.
+// Strategic merge patch metadata is only known for the built-in kinds and the kinds of the local CustomResourceDefinitions, the others are patched with a merge patch.
+func (m localModels) getPatchType(obj *unstructured.Unstructured, patchType PatchType) (PatchType, []string) {
+	notes := []string{}
+	if patchType == PatchType(types.ApplyPatchType) {
+		notes = append(notes, "server-side apply patches are applied as strategic merge patches, as field ownership is only tracked by the api server")
+		patchType = strategicMergePatch
+	}
+	if _, ok := m[obj.GroupVersionKind()]; patchType == strategicMergePatch && !ok && !clientgoscheme.Scheme.Recognizes(obj.GroupVersionKind()) {
+		notes = append(notes, "strategic merge patch metadata is not available for "+obj.GroupVersionKind().String()+", the patch is applied as a merge patch")
+		patchType = mergePatch
+	}
+	if len(notes) == 0 {
+		return patchType, nil
+	}
+	return patchType, notes
+}
+
+// getPatchMeta returns the strategic merge patch metadata of the built-in kinds and of the kinds of the local CustomResourceDefinitions.
+// The lists of custom resources are merged according to their list markers, as they are by the operator.
+func (m localModels) getPatchMeta(obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, error) {
+	if model, ok := m[obj.GroupVersionKind()]; ok {
+		return newPatchMetaFromOpenAPI(model), nil
+	}
+	typed, err := clientgoscheme.Scheme.New(obj.GroupVersionKind())
+	if err != nil {
+		return nil, err
+	}
+	return strategicpatch.NewPatchMetaFromStruct(typed)
+}
+
+// readObjects reads the objects from yaml or json files with one or more documents, lists are expanded into their items
+func readObjects(files []string) (localObjects, error) {
+	objects := localObjects{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			obj := &unstructured.Unstructured{}
+			err := decoder.Decode(&obj.Object)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, errors.New("unable to read " + file + ": " + err.Error())
+			}
+			if len(obj.Object) == 0 {
+				continue
+			}
+			if obj.IsList() {
+				err = obj.EachListItem(func(item runtime.Object) error {
+					objects = append(objects, *item.(*unstructured.Unstructured))
+					return nil
+				})
+				if err != nil {
+					f.Close()
+					return nil, err
+				}
+				continue
+			}
+			objects = append(objects, *obj)
+		}
+		f.Close()
+	}
+	return objects, nil
+}
+
+// localObjects stand in for the objects of a cluster
+type localObjects []unstructured.Unstructured
+
+// get returns the object with the passed coordinates
+func (l localObjects) get(apiVersion string, kind string, namespace string, name string) (*unstructured.Unstructured, bool) {
+	for i := range l {
+		if l[i].GetAPIVersion() == apiVersion && l[i].GetKind() == kind && l[i].GetNamespace() == namespace && l[i].GetName() == name {
+			return &l[i], true
+		}
+	}
+	return nil, false
+}
+
+// lookup has the same semantic as the lookup template function: a missing object results in an empty map, an empty name in a list
+func (l localObjects) lookup(apiVersion string, kind string, namespace string, name string) (map[string]interface{}, error) {
+	if name != "" {
+		obj, ok := l.get(apiVersion, kind, namespace, name)
+		if !ok {
+			return map[string]interface{}{}, nil
+		}
+		return obj.UnstructuredContent(), nil
+	}
+	items := []interface{}{}
+	for i := range l {
+		if l[i].GetAPIVersion() == apiVersion && l[i].GetKind() == kind && (namespace == "" || l[i].GetNamespace() == namespace) {
+			items = append(items, l[i].UnstructuredContent())
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind + "List",
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	}, nil
+}
+
+// templateFuncMap returns the template functions used by the controllers and the webhook, with lookups served by the local objects
+func (l localObjects) templateFuncMap() template.FuncMap {
+	funcs := utilstemplate.AdvancedTemplateFuncMap(nil, renderLog)
+	funcs["lookup"] = l.lookup
+	return funcs
+}
+
+// getSourceNameAndNamespace processes the name and namespace templates of the source object reference for the target, like GetNameAndNamespace does with lookups served by the local objects
+func (l localObjects) getSourceNameAndNamespace(sourceObjectRef *utilsv1alpha1.SourceObjectReference, target *unstructured.Unstructured) (string, string, error) {
+	values := []string{}
+	for _, field := range []string{sourceObjectRef.Name, sourceObjectRef.Namespace} {
+		templ, err := template.New(field).Funcs(l.templateFuncMap()).Parse(field)
+		if err != nil {
+			return "", "", err
+		}
+		var b bytes.Buffer
+		err = templ.Execute(&b, target.UnstructuredContent())
+		if err != nil {
+			return "", "", err
+		}
+		values = append(values, b.String())
+	}
+	return values[0], values[1], nil
+}
+
+// selectTargets returns the objects selected by the target reference, the namespace of the reference is only checked for the objects that have one
+func (l localObjects) selectTargets(targetObjectRef *utilsv1alpha1.TargetObjectReference) ([]unstructured.Unstructured, error) {
+	labelSelector := labels.Everything()
+	annotationSelector := labels.Everything()
+	var err error
+	if targetObjectRef.LabelSelector != nil {
+		labelSelector, err = metav1.LabelSelectorAsSelector(targetObjectRef.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if targetObjectRef.AnnotationSelector != nil {
+		annotationSelector, err = metav1.LabelSelectorAsSelector(targetObjectRef.AnnotationSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	targets := []unstructured.Unstructured{}
+	for i := range l {
+		if l[i].GetAPIVersion() != targetObjectRef.APIVersion || l[i].GetKind() != targetObjectRef.Kind {
+			continue
+		}
+		if targetObjectRef.Namespace != "" && l[i].GetNamespace() != "" && l[i].GetNamespace() != targetObjectRef.Namespace {
+			continue
+		}
+		if targetObjectRef.Name != "" {
+			if l[i].GetName() == targetObjectRef.Name {
+				targets = append(targets, *l[i].DeepCopy())
+			}
+			continue
+		}
+		if labelSelector.Matches(labels.Set(l[i].GetLabels())) && annotationSelector.Matches(labels.Set(l[i].GetAnnotations())) {
+			targets = append(targets, *l[i].DeepCopy())
+		}
+	}
+	return targets, nil
+}
+
+// getPatchTemplateSpec returns the spec of the local PatchTemplate or ClusterPatchTemplate referenced by the annotation
+func (l localObjects) getPatchTemplateSpec(ref string) (*redhatcopv1alpha1.PatchTemplateSpec, error) {
+	namespace, name, err := parsePatchTemplateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	kind := "ClusterPatchTemplate"
+	if namespace != "" {
+		kind = "PatchTemplate"
+	}
+	obj, ok := l.get(redhatcopv1alpha1.GroupVersion.String(), kind, namespace, name)
+	if !ok {
+		return nil, errors.New(kind + " " + ref + " not found in the local objects")
+	}
+	patchTemplate := &redhatcopv1alpha1.PatchTemplate{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), patchTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &patchTemplate.Spec, nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestRenderCommand(t *testing.T) {
+	dir := t.TempDir()
+	patchFile := filepath.Join(dir, "patch.yaml")
+	objectsFile := filepath.Join(dir, "objects.yaml")
+	err := os.WriteFile(patchFile, []byte(`apiVersion: redhatcop.redhat.io/v1alpha1
+kind: Patch
+metadata:
+  name: test
+  namespace: default
+spec:
+  patches:
+    test:
+      targetObjectRef:
+        apiVersion: v1
+        kind: ServiceAccount
+        name: test
+        namespace: default
+      sourceObjectRefs:
+      - apiVersion: v1
+        kind: ConfigMap
+        name: '{{ (lookup "v1" "ConfigMap" "default" "settings").data.source }}'
+        namespace: '{{ .metadata.namespace }}'
+      patchTemplate: |
+        metadata:
+          annotations:
+            source: {{ (index . 1).data.value }}
+`), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = os.WriteFile(objectsFile, []byte(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: test
+  namespace: default
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+  namespace: default
+data:
+  source: values
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+  namespace: default
+data:
+  value: from-values
+`), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var stdout, stderr bytes.Buffer
+	err = RenderCommand([]string{"-f", patchFile, "-objects", objectsFile}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v, output: %s", err, stdout.String())
+	}
+	result := renderResult{}
+	err = yaml.Unmarshal([]byte(strings.TrimPrefix(stdout.String(), "---\n")), &result)
+	if err != nil {
+		t.Fatalf("unable to parse %q: %v", stdout.String(), err)
+	}
+	if result.PatchType != string(strategicMergePatch) {
+		t.Errorf("expected the patch type to default to %s, got %q", strategicMergePatch, result.PatchType)
+	}
+	if result.Target != "ServiceAccount/default/test" {
+		t.Errorf("unexpected target %q", result.Target)
+	}
+	patched, ok := result.PatchedObject.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a patched object, got %v", result.PatchedObject)
+	}
+	annotations, _ := patched["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+	if annotations["source"] != "from-values" {
+		t.Errorf("expected the source object found with the lookup to be used, got annotations %v", annotations)
+	}
+}
+
+func TestRenderCommandWithLocalCRD(t *testing.T) {
+	const crd = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              ports:
+                type: array
+                x-kubernetes-list-type: map
+                x-kubernetes-list-map-keys:
+                - name
+                items:
+                  type: object
+                  properties:
+                    name:
+                      type: string
+                    port:
+                      type: integer
+---
+`
+	const widget = `apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: test
+  namespace: default
+spec:
+  ports:
+  - name: http
+    port: 80
+`
+	tests := []struct {
+		name          string
+		objects       string
+		expectedPorts []interface{}
+		expectNote    bool
+	}{
+		{
+			name:    "list merged by the key of the local CRD",
+			objects: crd + widget,
+			expectedPorts: []interface{}{
+				map[string]interface{}{"name": "https", "port": float64(443)},
+				map[string]interface{}{"name": "http", "port": float64(80)},
+			},
+		},
+		{
+			name:    "list replaced without the CRD",
+			objects: widget,
+			expectedPorts: []interface{}{
+				map[string]interface{}{"name": "https", "port": float64(443)},
+			},
+			expectNote: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			patchFile := filepath.Join(dir, "patch.yaml")
+			objectsFile := filepath.Join(dir, "objects.yaml")
+			err := os.WriteFile(patchFile, []byte(`apiVersion: redhatcop.redhat.io/v1alpha1
+kind: Patch
+metadata:
+  name: test
+  namespace: default
+spec:
+  patches:
+    test:
+      patchType: application/strategic-merge-patch+json
+      targetObjectRef:
+        apiVersion: example.com/v1
+        kind: Widget
+        name: test
+        namespace: default
+      patchTemplate: |
+        spec:
+          ports:
+          - name: https
+            port: 443
+`), 0600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			err = os.WriteFile(objectsFile, []byte(tt.objects), 0600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var stdout, stderr bytes.Buffer
+			err = RenderCommand([]string{"-f", patchFile, "-objects", objectsFile}, &stdout, &stderr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v, output: %s", err, stdout.String())
+			}
+			result := renderResult{}
+			err = yaml.Unmarshal([]byte(strings.TrimPrefix(stdout.String(), "---\n")), &result)
+			if err != nil {
+				t.Fatalf("unable to parse %q: %v", stdout.String(), err)
+			}
+			if (len(result.Notes) > 0) != tt.expectNote {
+				t.Errorf("unexpected notes %v", result.Notes)
+			}
+			patched, ok := result.PatchedObject.(map[string]interface{})
+			if !ok {
+				t.Fatalf("expected a patched object, got %v", result.PatchedObject)
+			}
+			ports := patched["spec"].(map[string]interface{})["ports"]
+			if !reflect.DeepEqual(ports, tt.expectedPorts) {
+				t.Errorf("expected ports %v, got %v", tt.expectedPorts, ports)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// tokenRotationRatio is the fraction of the token lifetime after which a new token is requested
+const tokenRotationRatio = 0.8
+
+// serviceAccountToken holds the token used by the enforcing controllers of a Patch.
+// The rest.Config it exposes never changes, the token is swapped at every request by the wrapped transport,
+// so that rotating the token does not require restarting the controllers and their watches.
+type serviceAccountToken struct {
+	lock  sync.RWMutex
+	token string
+	// serviceAccount is the service account the current token was issued for
+	serviceAccount      types.NamespacedName
+	issueTimestamp      time.Time
+	expirationTimestamp time.Time
+	restConfig          *rest.Config
+}
+
+func newServiceAccountToken(baseConfig *rest.Config) *serviceAccountToken {
+	sat := &serviceAccountToken{}
+	sat.restConfig = &rest.Config{
+		Host: baseConfig.Host,
+		// the user agent determines the field manager of the changes made by the enforcing controllers, except for server-side apply patches, drift detection relies on it
+		UserAgent: redhatcopv1alpha1.DefaultFieldManager,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: baseConfig.CAData,
+			CAFile: baseConfig.CAFile,
+		},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return &serviceAccountTokenRoundTripper{
+				serviceAccountToken: sat,
+				rt:                  rt,
+			}
+		},
+	}
+	return sat
+}
+
+func (sat *serviceAccountToken) setToken(serviceAccount types.NamespacedName, token string, issueTimestamp time.Time, expirationTimestamp time.Time) {
+	sat.lock.Lock()
+	defer sat.lock.Unlock()
+	sat.serviceAccount = serviceAccount
+	sat.token = token
+	sat.issueTimestamp = issueTimestamp
+	sat.expirationTimestamp = expirationTimestamp
+}
+
+func (sat *serviceAccountToken) getToken() string {
+	sat.lock.RLock()
+	defer sat.lock.RUnlock()
+	return sat.token
+}
+
+// GetExpirationTimestamp returns the time at which the current token expires
+func (sat *serviceAccountToken) GetExpirationTimestamp() time.Time {
+	sat.lock.RLock()
+	defer sat.lock.RUnlock()
+	return sat.expirationTimestamp
+}
+
+// GetRotationTimestamp returns the time at which the current token should be replaced
+func (sat *serviceAccountToken) GetRotationTimestamp() time.Time {
+	sat.lock.RLock()
+	defer sat.lock.RUnlock()
+	lifetime := sat.expirationTimestamp.Sub(sat.issueTimestamp)
+	return sat.issueTimestamp.Add(time.Duration(float64(lifetime) * tokenRotationRatio))
+}
+
+// getServiceAccount returns the service account the current token was issued for
+func (sat *serviceAccountToken) getServiceAccount() types.NamespacedName {
+	sat.lock.RLock()
+	defer sat.lock.RUnlock()
+	return sat.serviceAccount
+}
+
+// NeedsRotation returns whether a token has never been issued, the current one was issued for another service account or is due for rotation
+func (sat *serviceAccountToken) NeedsRotation(serviceAccount types.NamespacedName, now time.Time) bool {
+	if sat.getToken() == "" || sat.getServiceAccount() != serviceAccount {
+		return true
+	}
+	return !now.Before(sat.GetRotationTimestamp())
+}
+
+type serviceAccountTokenRoundTripper struct {
+	serviceAccountToken *serviceAccountToken
+	rt                  http.RoundTripper
+}
+
+func (rt *serviceAccountTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) != 0 {
+		return rt.rt.RoundTrip(req)
+	}
+	req = utilnet.CloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+rt.serviceAccountToken.getToken())
+	return rt.rt.RoundTrip(req)
+}
+
+func (rt *serviceAccountTokenRoundTripper) WrappedRoundTripper() http.RoundTripper { return rt.rt }
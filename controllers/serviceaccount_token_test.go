@@ -0,0 +1,187 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+func TestServiceAccountTokenNeedsRotation(t *testing.T) {
+	serviceAccount := types.NamespacedName{Namespace: "test", Name: "patcher"}
+	issued := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	expiration := issued.Add(time.Hour)
+	tests := []struct {
+		name           string
+		token          string
+		serviceAccount types.NamespacedName
+		now            time.Time
+		expected       bool
+	}{
+		{
+			name:           "no token yet",
+			serviceAccount: serviceAccount,
+			now:            issued,
+			expected:       true,
+		},
+		{
+			name:           "service account changed",
+			token:          "token",
+			serviceAccount: types.NamespacedName{Namespace: "test", Name: "other"},
+			now:            issued,
+			expected:       true,
+		},
+		{
+			name:           "just issued",
+			token:          "token",
+			serviceAccount: serviceAccount,
+			now:            issued,
+		},
+		{
+			name:           "before the rotation time",
+			token:          "token",
+			serviceAccount: serviceAccount,
+			now:            issued.Add(48*time.Minute - time.Second),
+		},
+		{
+			name:           "at the rotation time",
+			token:          "token",
+			serviceAccount: serviceAccount,
+			now:            issued.Add(48 * time.Minute),
+			expected:       true,
+		},
+		{
+			name:           "after the expiration",
+			token:          "token",
+			serviceAccount: serviceAccount,
+			now:            expiration.Add(time.Minute),
+			expected:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sat := newServiceAccountToken(&rest.Config{Host: "https://example.com"})
+			sat.setToken(tt.serviceAccount, tt.token, issued, expiration)
+			if needsRotation := sat.NeedsRotation(serviceAccount, tt.now); needsRotation != tt.expected {
+				t.Errorf("expected NeedsRotation to be %t, got %t", tt.expected, needsRotation)
+			}
+		})
+	}
+}
+
+func TestServiceAccountTokenGetRotationTimestamp(t *testing.T) {
+	issued := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		expected time.Duration
+	}{
+		{
+			name:     "one hour token",
+			lifetime: time.Hour,
+			expected: 48 * time.Minute,
+		},
+		{
+			name:     "one day token",
+			lifetime: 24 * time.Hour,
+			expected: 19*time.Hour + 12*time.Minute,
+		},
+		{
+			name:     "ten minutes token",
+			lifetime: 10 * time.Minute,
+			expected: 8 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sat := newServiceAccountToken(&rest.Config{Host: "https://example.com"})
+			sat.setToken(types.NamespacedName{Namespace: "test", Name: "patcher"}, "token", issued, issued.Add(tt.lifetime))
+			if rotation := sat.GetRotationTimestamp(); !rotation.Equal(issued.Add(tt.expected)) {
+				t.Errorf("expected the rotation at %s, got %s", issued.Add(tt.expected), rotation)
+			}
+			if expiration := sat.GetExpirationTimestamp(); !expiration.Equal(issued.Add(tt.lifetime)) {
+				t.Errorf("expected the expiration at %s, got %s", issued.Add(tt.lifetime), expiration)
+			}
+		})
+	}
+}
+
+// headerRecorder is a round tripper recording the Authorization header of the requests it receives
+type headerRecorder struct {
+	authorization string
+}
+
+func (r *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.authorization = req.Header.Get("Authorization")
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestServiceAccountTokenRoundTripper(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        []string
+		authorization string
+		expected      []string
+	}{
+		{
+			name:     "token injected",
+			tokens:   []string{"token"},
+			expected: []string{"Bearer token"},
+		},
+		{
+			name:     "rotated token used by the following requests",
+			tokens:   []string{"token", "rotated"},
+			expected: []string{"Bearer token", "Bearer rotated"},
+		},
+		{
+			name:          "existing Authorization header kept",
+			tokens:        []string{"token"},
+			authorization: "Bearer impersonation",
+			expected:      []string{"Bearer impersonation"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sat := newServiceAccountToken(&rest.Config{Host: "https://example.com"})
+			recorder := &headerRecorder{}
+			rt := sat.restConfig.WrapTransport(recorder)
+			for i, token := range tt.tokens {
+				sat.setToken(types.NamespacedName{Namespace: "test", Name: "patcher"}, token, time.Now(), time.Now().Add(time.Hour))
+				req, err := http.NewRequest(http.MethodGet, "https://example.com/api", nil)
+				if err != nil {
+					t.Fatalf("unable to build the request: %v", err)
+				}
+				if tt.authorization != "" {
+					req.Header.Set("Authorization", tt.authorization)
+				}
+				if _, err := rt.RoundTrip(req); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if recorder.authorization != tt.expected[i] {
+					t.Errorf("expected request %d to carry %q, got %q", i, tt.expected[i], recorder.authorization)
+				}
+				if req.Header.Get("Authorization") != tt.authorization {
+					t.Errorf("expected the original request not to be modified, got %q", req.Header.Get("Authorization"))
+				}
+			}
+		})
+	}
+}
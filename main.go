@@ -17,7 +17,9 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -25,16 +27,20 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
-	"github.com/redhat-cop/operator-utils/pkg/util/lockedresourcecontroller"
+	"github.com/redhat-cop/operator-utils/pkg/util"
 	redhatcopv1alpha1 "github.com/redhat-cop/patch-operator/api/v1alpha1"
 	"github.com/redhat-cop/patch-operator/controllers"
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	apiextension "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	//+kubebuilder:scaffold:imports
 )
@@ -54,20 +60,51 @@ func init() {
 }
 
 func main() {
+	// the render subcommand works offline, it doesn't start the manager
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := controllers.RenderCommand(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var injectFailOpen bool
+	var injectPatchedByAnnotation bool
+	var defaultPatchType string
+	var defaultServiceAccount string
+	var defaultsConfigMap string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&injectFailOpen, "inject-fail-open", false,
+		"Admit the objects on which the creation time patches cannot be injected unchanged, with a warning and an event, instead of rejecting them.")
+	flag.BoolVar(&injectPatchedByAnnotation, "inject-patched-by-annotation", false,
+		"Stamp the objects patched at creation time with the redhat-cop.redhat.io/patched-by annotation, recording the hash of the templates and the time of the injection.")
+	flag.StringVar(&defaultPatchType, "default-patch-type", string(types.StrategicMergePatchType),
+		"The patch type set by the defaulting webhooks on the patches that don't define one.")
+	flag.StringVar(&defaultServiceAccount, "default-service-account", redhatcopv1alpha1.DefaultServiceAccountName,
+		"The service account set by the defaulting webhook on the Patches that don't reference one.")
+	flag.StringVar(&defaultsConfigMap, "defaults-configmap", "",
+		"The namespace/name of a ConfigMap overriding the default patch type and service accounts, it is read at startup. "+
+			"The keys are patchType, serviceAccountName and namespaceServiceAccountNames, a yaml map from namespace to service account.")
 	opts := zap.Options{
 		Development: false,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
+	// the level can be changed at runtime by the PatchOperatorConfig
+	logLevel := uberzap.NewAtomicLevelAt(zapcore.InfoLevel)
+	if level, ok := opts.Level.(uberzap.AtomicLevel); ok {
+		logLevel.SetLevel(level.Level())
+	}
+	opts.Level = logLevel
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -83,25 +120,102 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.PatchReconciler{
-		EnforcingReconciler: lockedresourcecontroller.NewFromManager(mgr, "patch_controller", true, true),
-	}).SetupWithManager(mgr); err != nil {
+	if err = controllers.RegisterMetrics(metrics.Registry); err != nil {
+		setupLog.Error(err, "unable to register metrics")
+		os.Exit(1)
+	}
+
+	// the OpenAPI models are needed to apply strategic merge patches, both by the enforcing controllers and by the injection webhook
+	crr := controllers.NewCustomResourceDefinitionReconciler(mgr.GetConfig())
+	if err = crr.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "CustomResourceDefinition")
+		os.Exit(1)
+	}
+	if err = controllers.NewPatchReconciler(util.NewFromManager(mgr, mgr.GetEventRecorderFor("patch_controller")), crr).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Patch")
 		os.Exit(1)
 	}
-	if value, ok := os.LookupEnv("ENABLE_WEBHOOKS"); !ok || value != "false" {
+	if err = controllers.NewClusterPatchReconciler(util.NewFromManager(mgr, mgr.GetEventRecorderFor("clusterpatch_controller")), crr).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterPatch")
+		os.Exit(1)
+	}
+	patchDefaults := redhatcopv1alpha1.PatchDefaults{
+		PatchType:          types.PatchType(defaultPatchType),
+		ServiceAccountName: defaultServiceAccount,
+	}
+	if defaultsConfigMap != "" {
+		configMapName, err := controllers.ParseNamespacedName(defaultsConfigMap)
+		if err != nil {
+			setupLog.Error(err, "invalid defaults ConfigMap")
+			os.Exit(1)
+		}
+		// the cache is not started yet, the ConfigMap is read directly
+		patchDefaults, err = controllers.LoadPatchDefaults(context.Background(), mgr.GetAPIReader(), configMapName, patchDefaults)
+		if err != nil {
+			setupLog.Error(err, "unable to load the defaults", "configmap", defaultsConfigMap)
+			os.Exit(1)
+		}
+	}
+	if err = redhatcopv1alpha1.SetPatchDefaults(patchDefaults); err != nil {
+		setupLog.Error(err, "invalid defaults")
+		os.Exit(1)
+	}
+	var patchInjector *controllers.PatchInjector
+	value, ok := os.LookupEnv("ENABLE_WEBHOOKS")
+	webhooksEnabled := !ok || value != "false"
+	if webhooksEnabled {
 		if err = (&redhatcopv1alpha1.Patch{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "Patch")
 			os.Exit(1)
 		}
-		crr := controllers.NewCustomResourceDefinitionReconciler(mgr.GetConfig())
-		if err = crr.SetupWithManager(mgr); err != nil {
-			setupLog.Error(err, "unable to create controller", "controller", "CustomResourceDefinition")
+		if err = (&redhatcopv1alpha1.ClusterPatch{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterPatch")
+			os.Exit(1)
+		}
+		if err = (&redhatcopv1alpha1.PatchTemplate{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PatchTemplate")
+			os.Exit(1)
+		}
+		if err = (&redhatcopv1alpha1.ClusterPatchTemplate{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterPatchTemplate")
+			os.Exit(1)
+		}
+		if err = (&redhatcopv1alpha1.InjectionPolicy{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "InjectionPolicy")
+			os.Exit(1)
+		}
+		if err = (&controllers.InjectionWebhookReconciler{
+			ReconcilerBase: util.NewFromManager(mgr, mgr.GetEventRecorderFor("injectionwebhook_controller")),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "InjectionWebhook")
 			os.Exit(1)
 		}
 		//+kubebuilder:scaffold:builder
 
-		mgr.GetWebhookServer().Register("/inject", &webhook.Admission{Handler: controllers.NewPatchInjector(mgr.GetClient(), mgr.GetConfig(), crr)})
+		patchInjector = controllers.NewPatchInjector(mgr.GetClient(), mgr.GetConfig(), crr, mgr.GetEventRecorderFor("patch-injector"), controllers.PatchInjectorOptions{
+			FailOpen:            injectFailOpen,
+			PatchedByAnnotation: injectPatchedByAnnotation,
+		})
+		if err = patchInjector.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to set up the patch injector")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register("/inject", &webhook.Admission{Handler: patchInjector})
+	}
+	// the settings given by the flags and environment variables can be overridden at runtime by the PatchOperatorConfig
+	operatorSettings := controllers.OperatorSettings{
+		ServiceAccountTokenExpirationDuration: controllers.DefaultServiceAccountTokenExpirationDuration(ctrl.LoggerInto(context.Background(), setupLog)),
+		PatchDefaults:                         patchDefaults,
+		InjectFailOpen:                        injectFailOpen,
+		MaxConcurrentReconciles:               1,
+		LogLevel:                              logLevel.Level(),
+		WebhooksEnabled:                       webhooksEnabled,
+	}
+	if err = controllers.NewPatchOperatorConfigReconciler(
+		util.NewFromManager(mgr, mgr.GetEventRecorderFor("patchoperatorconfig_controller")), crr, operatorSettings, patchInjector, &logLevel,
+	).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PatchOperatorConfig")
+		os.Exit(1)
 	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -112,6 +226,11 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// the webhooks need the models to inject strategic merge patches, the pod is not ready until they are loaded
+	if err := mgr.AddReadyzCheck("openapi-models", crr.ModelsLoadedCheck); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {